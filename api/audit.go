@@ -0,0 +1,66 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+)
+
+// ListAuditEvents Get the audit log
+// @Summary Get the audit log
+// @Tags audit
+// @Accept  json
+// @Produce  json
+// @Param  object query string false "Only events for this kind of object, e.g. group"
+// @Param  object_id query int false "Only events for this object"
+// @Success 200 {array} models.AuditEvent
+// @Failure 500 {object} models.APIError
+// @Router /audit [get]
+func ListAuditEvents(c *gin.Context) {
+	query := db.DB.Order("id desc")
+	if v := c.Query("object"); v != "" {
+		query = query.Where("object = ?", v)
+	}
+	if v := c.Query("object_id"); v != "" {
+		query = query.Where("object_id = ?", v)
+	}
+
+	var items []models.AuditEvent
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// audit records who accessed a secret or changed the CA, it fails if the event can't be stored so nothing happens
+// unaudited. the audited routes are behind RequireUser, so the actor is the authenticated user
+func audit(c *gin.Context, action string, object string, id int) error {
+	actor := authenticatedUser(c)
+	if actor == "" {
+		return fmt.Errorf("audited actions require an authenticated user")
+	}
+	event := models.AuditEvent{
+		Actor:    actor,
+		Remote:   c.ClientIP(),
+		Action:   action,
+		Object:   object,
+		ObjectID: id,
+	}
+	if res := db.DB.Create(&event); res.Error != nil {
+		return res.Error
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"actor":  event.Actor,
+		"remote": event.Remote,
+		"object": object,
+		"id":     id,
+	}).Warn("audit: " + action)
+	return nil
+}
@@ -0,0 +1,52 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+)
+
+// the context key of the user RequireUser authenticated
+const authUser = "user"
+
+// RequireUser only lets requests through that carry the basic auth credentials of a user of go-via. every user
+// of go-via may administer it, the user is stored for the audit log and the reviews of kickstart templates
+func RequireUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username, password, ok := c.Request.BasicAuth()
+		if !ok {
+			c.Header("WWW-Authenticate", `Basic realm="go-via"`)
+			Error(c, http.StatusUnauthorized, fmt.Errorf("authentication required")) // 401
+			c.Abort()
+			return
+		}
+
+		var user models.User
+		if res := db.DB.Where("username = ?", username).First(&user); res.Error != nil || !ComparePasswords(user.Password, []byte(password), username) {
+			c.Header("WWW-Authenticate", `Basic realm="go-via"`)
+			Error(c, http.StatusUnauthorized, fmt.Errorf("invalid username or password")) // 401
+			c.Abort()
+			return
+		}
+
+		c.Set(authUser, user.Username)
+		c.Next()
+	}
+}
+
+// authenticatedUser returns the user RequireUser authenticated, it is empty for routes without it
+func authenticatedUser(c *gin.Context) string {
+	return c.GetString(authUser)
+}
+
+// requestUser returns the user RequireUser authenticated, or fallback on routes without it. credentials that
+// weren't checked are never used, so the recorded actor can't be forged
+func requestUser(c *gin.Context, fallback string) string {
+	if u := authenticatedUser(c); u != "" {
+		return u
+	}
+	return fallback
+}
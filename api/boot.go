@@ -0,0 +1,114 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+)
+
+// BootURLs are the signed per-host urls that are embedded into boot.cfg
+type BootURLs struct {
+	Kickstart string
+	Prefix    string
+}
+
+// SignBootURLs mints the signed urls for a host, any previously issued kickstart url is invalidated.
+// server is the address the installer can reach go-via on, e.g. 10.0.0.1:8080
+func SignBootURLs(host models.Host, scheme string, server string, key string, ttl time.Duration) (BootURLs, error) {
+	nonce := secrets.NewNonce()
+	if res := db.DB.Model(&models.Host{}).Where("id = ?", host.ID).Update("ks_nonce", nonce); res.Error != nil {
+		return BootURLs{}, res.Error
+	}
+
+	expires := time.Now().Add(ttl)
+	ks := secrets.SignToken(secrets.Token{Purpose: "ks", HostID: host.ID, Nonce: nonce, Expires: expires}, key)
+	boot := secrets.SignToken(secrets.Token{Purpose: "boot", HostID: host.ID, Expires: expires}, key)
+
+	return BootURLs{
+		Kickstart: scheme + "://" + server + "/ks/" + ks + "/ks.cfg",
+		Prefix:    scheme + "://" + server + "/boot/" + boot,
+	}, nil
+}
+
+// reportTTL is how long the installer of a host can report back to go-via
+const reportTTL = 24 * time.Hour
+
+// reportURL mints the url the installer of a host reports to, server is the address the installer reached go-via on.
+// the url carries the nonce of the kickstart, so it is only valid for the install that kickstart started
+func reportURL(host models.Host, nonce string, scheme string, server string, key string) string {
+	token := secrets.SignToken(secrets.Token{Purpose: "report", HostID: host.ID, Nonce: nonce, Expires: time.Now().Add(reportTTL)}, key)
+	return scheme + "://" + server + "/report/" + token
+}
+
+// verifyReportToken checks a report token and that it was issued for the current install of the host,
+// the urls of earlier installs stop working once the host is queued again
+func verifyReportToken(token string, key string) (secrets.Token, error) {
+	t, err := secrets.VerifyToken(token, "report", key)
+	if err != nil {
+		return t, err
+	}
+
+	var host models.Host
+	if res := db.DB.Select("id", "install_nonce").First(&host, t.HostID); res.Error != nil {
+		return t, fmt.Errorf("host %d: %w", t.HostID, res.Error)
+	}
+	if t.Nonce == "" || t.Nonce != host.InstallNonce {
+		return t, fmt.Errorf("the report url was issued for an earlier install")
+	}
+	return t, nil
+}
+
+// BootFile serves the files of the image assigned to the host the signed url was issued for
+func BootFile(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		token, err := secrets.VerifyToken(c.Param("token"), "boot", key)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"remote": c.ClientIP(),
+				"err":    err,
+			}).Warn("boot")
+			Error(c, http.StatusForbidden, err) // 403
+			return
+		}
+
+		var item models.Host
+		if res := db.DB.Preload(clause.Associations).First(&item, token.HostID); res.Error != nil {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			return
+		}
+
+		var image models.Image
+		if res := db.DB.First(&image, "id = ?", item.Group.ImageID); res.Error != nil {
+			Error(c, http.StatusNotFound, fmt.Errorf("the group of the host has no image")) // 404
+			return
+		}
+
+		// path.Clean on a rooted path guarantees that the file stays inside the image
+		file := path.Clean("/" + c.Param("file"))
+		filename := filepath.Join(image.Path, file)
+		if _, err := os.Stat(filename); err != nil {
+			// images extracted from an iso may have upper case file names
+			dir, f := path.Split(file)
+			filename = filepath.Join(image.Path, dir, strings.ToUpper(f))
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"id":   item.ID,
+			"ip":   item.IP,
+			"file": filename,
+		}).Debug("boot")
+
+		c.File(filename)
+	}
+}
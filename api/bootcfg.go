@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/maxiepax/go-via/models"
+)
+
+// RenderBootCfg returns the boot.cfg of the image rewritten for the host. It has no side effects.
+// If urls.Prefix is empty the modules are loaded over tftp from the image folder.
+func RenderBootCfg(host models.Host, image models.Image, urls BootURLs) ([]byte, error) {
+	bc, err := os.ReadFile(image.Path + "/BOOT.CFG")
+	if err != nil {
+		return nil, err
+	}
+
+	// strip slashes from paths in file
+	re := regexp.MustCompile("/")
+	bc = re.ReplaceAllLiteral(bc, []byte(""))
+
+	// add the kickstart url to kernelopt
+	re = regexp.MustCompile("kernelopt=.*")
+	o := re.Find(bc)
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" ks="+urls.Kickstart)...))
+
+	// append the mac address of the hardware interface to ensure ks.cfg request comes from the right interface, along with ip, netmask and gateway.
+	nm := net.CIDRMask(host.Pool.Netmask, 32)
+	netmask := ipv4MaskString(nm)
+
+	re = regexp.MustCompile("kernelopt=.*")
+	o = re.Find(bc)
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" netdevice="+host.Mac+" ip="+host.IP+" netmask="+netmask+" gateway="+host.Pool.Gateway)...))
+
+	// if vlan is configured for the group, append the vlan to kernelopts
+	if host.Group.Vlan != "" {
+		re = regexp.MustCompile("kernelopt=.*")
+		o = re.Find(bc)
+		bc = re.ReplaceAllLiteral(bc, append(o, []byte(" vlanid="+host.Group.Vlan)...))
+	}
+
+	// load options from the group
+	options := models.GroupOptions{}
+	if err := json.Unmarshal(host.Group.Options, &options); err != nil {
+		return nil, fmt.Errorf("could not unmarshal group options: %w", err)
+	}
+
+	// if autopart is configured for the group, append autopart to kernelopt - https://kb.vmware.com/s/article/77009
+	/*
+		if options.AutoPart {
+			re = regexp.MustCompile("kernelopt=.*")
+			o = re.Find(bc)
+			bc = re.ReplaceAllLiteral(bc, append(o, []byte(" autoPartitionOnlyOnceAndSkipSsd=true")...))
+		}*/
+
+	// add allowLegacyCPU=true to kernelopt
+	if options.AllowLegacyCPU {
+		re = regexp.MustCompile("kernelopt=.*")
+		o = re.Find(bc)
+		bc = re.ReplaceAllLiteral(bc, append(o, []byte(" allowLegacyCPU=true")...))
+	}
+
+	// replace prefix with prefix=foldername, or the url of the image when the modules are fetched over http
+	prefix := urls.Prefix
+	if prefix == "" {
+		if p := strings.Split(image.Path, "/"); len(p) > 1 {
+			prefix = p[1]
+		}
+	}
+	re = regexp.MustCompile("prefix=")
+	o = re.Find(bc)
+	bc = re.ReplaceAllLiteral(bc, append(o, []byte(prefix)...))
+
+	return bc, nil
+}
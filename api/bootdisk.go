@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+)
+
+// the %pre script writes the install command for the selected disk to this file, templates %include it
+const bootDiskInclude = "/tmp/bootdisk.cfg"
+
+var bootDiskPicks = []string{"", "first", "smallest", "largest"}
+
+var bootDiskTransports = []string{"", "usb", "sata", "sas", "pcie", "fc", "iscsi"}
+
+// bootDiskScript selects the disk with the rules of the group. RULES, FLAGS and REPORT are set by bootDiskPre.
+// If no rule matches, no install command is written and the installation stops instead of guessing a disk.
+const bootDiskScript = `
+def localcli(*args):
+    out = subprocess.check_output(["localcli", "--formatter=json"] + list(args))
+    # the keys are the field names of the text output, e.g. "Is SSD"
+    return [dict((k.replace(" ", "").lower(), v) for k, v in d.items()) for d in json.loads(out.decode())]
+
+def truthy(v):
+    return v is True or str(v).lower() == "true"
+
+def size_mb(d):
+    try:
+        return int(d.get("size", 0))
+    except ValueError:
+        return 0
+
+def matches(rule, d):
+    if rule.get("vendor") and not re.search(rule["vendor"], str(d.get("vendor", "")).strip()):
+        return False
+    if rule.get("model") and not re.search(rule["model"], str(d.get("model", "")).strip()):
+        return False
+    if rule.get("min_size_gb") and size_mb(d) < rule["min_size_gb"] * 1024:
+        return False
+    if rule.get("max_size_gb") and size_mb(d) > rule["max_size_gb"] * 1024:
+        return False
+    if rule.get("transport") and d["transport"] != rule["transport"]:
+        return False
+    if rule.get("ssd") is not None and truthy(d.get("isssd")) != rule["ssd"]:
+        return False
+    return True
+
+def report(result):
+    if not REPORT:
+        return
+    try:
+        req = urllib.request.Request(REPORT, data=json.dumps(result).encode(), headers={"Content-Type": "application/json"})
+        urllib.request.urlopen(req, timeout=10, context=ssl._create_unverified_context())
+    except Exception as e:
+        print("could not report the boot disk: %s" % e)
+
+result = {"disk": "", "vendor": "", "model": "", "size_mb": 0, "rule": 0, "error": ""}
+try:
+    transports = {}
+    for p in localcli("storage", "core", "path", "list"):
+        transports.setdefault(p.get("device"), str(p.get("transport", "")).lower())
+    disks = []
+    for d in localcli("storage", "core", "device", "list"):
+        if d.get("devicetype", "Direct-Access") != "Direct-Access":
+            continue
+        d["transport"] = transports.get(d.get("device"), "")
+        disks.append(d)
+
+    for i, rule in enumerate(RULES):
+        found = [d for d in disks if matches(rule, d)]
+        if not found:
+            continue
+        if rule.get("pick") == "smallest":
+            found.sort(key=size_mb)
+        elif rule.get("pick") == "largest":
+            found.sort(key=size_mb, reverse=True)
+        d = found[0]
+        result.update(disk=d["device"], vendor=str(d.get("vendor", "")).strip(), model=str(d.get("model", "")).strip(), size_mb=size_mb(d), rule=i + 1)
+        break
+    else:
+        result["error"] = "no disk matched the boot disk rules"
+except Exception as e:
+    result["error"] = str(e)
+
+with open(INCLUDE, "w") as f:
+    if result["disk"]:
+        f.write("install --disk=%s %s\n" % (result["disk"], FLAGS))
+    else:
+        f.write("# %s\n" % result["error"])
+print("boot disk: %s" % json.dumps(result))
+report(result)
+`
+
+// ReportBootDisk Receives the boot disk the installer selected
+// @Summary Receives the boot disk the installer selected
+// @Description Called by the %pre script that is generated from the boot disk rules of the group, protected by a signed url.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  token path string true "Signed report token"
+// @Param  item body models.BootDiskReport true "The selected disk"
+// @Success 204
+// @Failure 400 {object} models.APIError
+// @Failure 403 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /report/{token}/bootdisk [post]
+func ReportBootDisk(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		token, err := verifyReportToken(c.Param("token"), key)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"remote": c.ClientIP(),
+				"err":    err,
+			}).Warn("report")
+			Error(c, http.StatusForbidden, err) // 403
+			return
+		}
+
+		var form models.BootDiskReport
+		if err := c.ShouldBindJSON(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if form.Error != "" {
+			logrus.WithFields(logrus.Fields{
+				"id":  token.HostID,
+				"err": form.Error,
+			}).Error("bootdisk: no boot disk was selected")
+		} else {
+			logrus.WithFields(logrus.Fields{
+				"id":     token.HostID,
+				"disk":   form.Disk,
+				"vendor": form.Vendor,
+				"model":  form.Model,
+				"size":   form.SizeMB,
+				"rule":   form.Rule,
+			}).Info("bootdisk")
+		}
+
+		if res := db.DB.Model(&models.Host{}).Where("id = ?", token.HostID).Update("installed_boot_disk", form.Disk); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		c.JSON(http.StatusNoContent, gin.H{}) //204
+	}
+}
+
+func decodeBootDiskRules(m datatypes.JSON) ([]models.BootDiskRule, error) {
+	var rules []models.BootDiskRule
+	if len(m) == 0 || string(m) == "null" {
+		return rules, nil
+	}
+	if err := json.Unmarshal(m, &rules); err != nil {
+		return nil, fmt.Errorf("bootdisk_rules must be a list of rules: %w", err)
+	}
+	return rules, nil
+}
+
+// validateBootDiskRules checks the rules before they end up in a script that only fails at install time
+func validateBootDiskRules(m datatypes.JSON) error {
+	rules, err := decodeBootDiskRules(m)
+	if err != nil {
+		return err
+	}
+	for i, r := range rules {
+		for _, re := range []string{r.Vendor, r.Model} {
+			if _, err := regexp.Compile(re); err != nil {
+				return fmt.Errorf("bootdisk rule %d: %w", i+1, err)
+			}
+		}
+		if r.MinSizeGB < 0 || r.MaxSizeGB < 0 || (r.MaxSizeGB > 0 && r.MinSizeGB > r.MaxSizeGB) {
+			return fmt.Errorf("bootdisk rule %d: invalid size range", i+1)
+		}
+		if !containsString(bootDiskTransports, r.Transport) {
+			return fmt.Errorf("bootdisk rule %d: transport must be one of usb, sata, sas, pcie, fc or iscsi", i+1)
+		}
+		if !containsString(bootDiskPicks, r.Pick) {
+			return fmt.Errorf("bootdisk rule %d: pick must be first, smallest or largest", i+1)
+		}
+	}
+	return nil
+}
+
+// bootDiskPre generates the %pre section that selects the boot disk with the rules of the group
+func bootDiskPre(item models.Host, data map[string]interface{}) ([]byte, error) {
+	rules, err := decodeBootDiskRules(item.Group.BootDiskRules)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+	options, err := groupOptions(item.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same flags the default template installs with
+	flags := "--overwritevmfs"
+	if !options.CreateVMFS {
+		flags += " --novmfsondisk"
+	}
+	if version, _ := data["esxi_version"].(string); options.AllowLegacyCPU && versionAtLeast(version, "8.0") {
+		flags += " --forceunsupportedinstall"
+	}
+
+	report, _ := data["report_url"].(string)
+	if report != "" {
+		report += "/bootdisk"
+	}
+
+	r, err := json.Marshal(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("\n# boot disk selection, generated from the boot disk rules of the group\n%pre --interpreter=python\n")
+	buf.WriteString("import json, re, ssl, subprocess, urllib.request\n\n")
+	fmt.Fprintf(&buf, "RULES = json.loads(%s)\n", pythonString(string(r)))
+	fmt.Fprintf(&buf, "FLAGS = %s\n", pythonString(flags))
+	fmt.Fprintf(&buf, "INCLUDE = %s\n", pythonString(bootDiskInclude))
+	fmt.Fprintf(&buf, "REPORT = %s\n", pythonString(report))
+	buf.WriteString(bootDiskScript)
+	return buf.Bytes(), nil
+}
+
+// pythonString quotes s as a python string literal, json strings are valid python
+func pythonString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/gin-gonic/gin"
+	ca "github.com/maxiepax/go-via/crypto"
+	"github.com/maxiepax/go-via/esxi"
+	"github.com/maxiepax/go-via/models"
+)
+
+// the directory of the CA, the certificate of the web server and an uploaded intermediate
+var certDir = "cert"
+
+const (
+	deliverFirstboot  = "firstboot"
+	deliverPostconfig = "postconfig"
+)
+
+// GetCACertificate Get the CA that issues the host certificates
+// @Summary Get the CA that issues the host certificates
+// @Description Returns the PEM encoded chain of the issuer of the host certificates, the issuer first. Add the last certificate to the trusted roots of vCenter and VCF.
+// @Tags certificates
+// @Produce  plain
+// @Success 200 {string} string
+// @Failure 500 {object} models.APIError
+// @Router /certificates/ca [get]
+func GetCACertificate(c *gin.Context) {
+	issuer, err := ca.LoadIssuer(certDir)
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-pem-file", []byte(issuer.Chain()))
+}
+
+// UploadIntermediate Issue the host certificates from an intermediate CA
+// @Summary Issue the host certificates from an intermediate CA
+// @Description Replaces the CA of go-via as issuer of the host certificates, e.g. with an intermediate of the enterprise CA. Hosts keep their certificate until they are reimaged. Requires basic auth, the change is recorded in the audit log.
+// @Tags certificates
+// @Accept  json
+// @Produce  plain
+// @Param  item body models.IntermediateForm true "The intermediate and its key"
+// @Success 200 {string} string
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /certificates/intermediate [put]
+func UploadIntermediate(c *gin.Context) {
+	var form models.IntermediateForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	if form.Certificate == "" || form.Key == "" {
+		Error(c, http.StatusBadRequest, fmt.Errorf("certificate and key are required")) // 400
+		return
+	}
+
+	if _, err := ca.NewIssuer([]byte(form.Certificate), []byte(form.Key)); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	// every host issued from now on trusts whoever holds the key, record who changed it
+	if err := audit(c, "upload intermediate", "certificate", 0); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+	issuer, err := ca.SaveIntermediate(certDir, []byte(form.Certificate), []byte(form.Key))
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.Data(http.StatusOK, "application/x-pem-file", []byte(issuer.Chain()))
+}
+
+// DeleteIntermediate Issue the host certificates from the CA of go-via again
+// @Summary Issue the host certificates from the CA of go-via again
+// @Description Requires basic auth, the change is recorded in the audit log.
+// @Tags certificates
+// @Produce  json
+// @Success 204
+// @Failure 401 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /certificates/intermediate [delete]
+func DeleteIntermediate(c *gin.Context) {
+	if err := audit(c, "remove intermediate", "certificate", 0); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+	if err := ca.RemoveIntermediate(certDir); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// validateCertificateDelivery checks how the certificates of a group get to its hosts
+func validateCertificateDelivery(options models.GroupOptions) error {
+	switch options.CertificateDelivery {
+	case "", deliverFirstboot, deliverPostconfig:
+		return nil
+	}
+	return fmt.Errorf("certificatedelivery must be firstboot or postconfig")
+}
+
+// certificateDelivery returns how the certificate of a host is delivered, empty if the host keeps a self-signed one
+func certificateDelivery(options models.GroupOptions) string {
+	if !options.Certificate {
+		return ""
+	}
+	if options.CertificateDelivery == "" {
+		return deliverFirstboot
+	}
+	return options.CertificateDelivery
+}
+
+// certificateNames returns the name and addresses the certificate of a host is issued for
+func certificateNames(item models.Host) (string, []net.IP) {
+	fqdn := item.Hostname
+	if item.Domain != "" {
+		fqdn += "." + item.Domain
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(item.IP); ip != nil {
+		ips = append(ips, ip)
+	}
+	return fqdn, ips
+}
+
+// issueHostCertificate issues a certificate and key for a host that gets them from its kickstart
+func issueHostCertificate(item models.Host) (*ca.HostCertificate, error) {
+	issuer, err := ca.LoadIssuer(certDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not load the CA: %w", err)
+	}
+	fqdn, ips := certificateNames(item)
+	return issuer.IssueHostCertificate(fqdn, ips)
+}
+
+// hostCertificate makes sure the host presents a certificate issued by go-via. With firstboot the kickstart
+// installed it, with postconfig the host generates a key and gets a certificate for it.
+func hostCertificate(ctx context.Context, host *esxi.Host, u *url.URL, item models.Host, delivery string) error {
+	if delivery == "" {
+		return nil
+	}
+	issuer, err := ca.LoadIssuer(certDir)
+	if err != nil {
+		return fmt.Errorf("could not load the CA: %w", err)
+	}
+
+	if delivery == deliverFirstboot {
+		if !issuer.Issued(host.Certificate()) {
+			return fmt.Errorf("the host presents a certificate issued by %s instead of the CA of go-via", host.Certificate().Issuer)
+		}
+		return nil
+	}
+
+	// a host that is configured again may already have its certificate
+	fqdn, ips := certificateNames(item)
+	if issuer.Issued(host.Certificate()) && host.Certificate().VerifyHostname(fqdn) == nil {
+		return nil
+	}
+	csr, err := host.CertificateSigningRequest(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get a certificate signing request from the host: %w", err)
+	}
+	cert, err := issuer.SignHostRequest(csr, fqdn, ips)
+	if err != nil {
+		return err
+	}
+	return host.InstallCertificate(ctx, u, cert.Certificate, cert.CA)
+}
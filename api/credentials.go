@@ -0,0 +1,132 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// GetHostCredentials Get the root passwords generated for a host
+// @Summary Get the root passwords generated for a host
+// @Description Returns the current and all previous root passwords generated for the host. It requires the basic auth credentials of a user of go-via, every call is recorded in the audit log.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Success 200 {object} models.HostCredentials
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/credentials [get]
+func GetHostCredentials(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Host
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		var creds []models.HostCredential
+		if res := db.DB.Where("host_id = ?", item.ID).Order("id desc").Find(&creds); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		resp := models.HostCredentials{HostID: item.ID, History: []models.RevealedCredential{}}
+		for _, cred := range creds {
+			password, err := secrets.TryDecrypt(cred.Password, key)
+			if err != nil {
+				Error(c, http.StatusInternalServerError, fmt.Errorf("password %d can't be decrypted: %w", cred.ID, err)) // 500
+				return
+			}
+			r := models.RevealedCredential{
+				ID:        cred.ID,
+				Password:  password,
+				CreatedAt: cred.CreatedAt,
+				RetiredAt: cred.RetiredAt,
+			}
+			if cred.RetiredAt == nil {
+				resp.Password = r.Password
+			}
+			resp.History = append(resp.History, r)
+		}
+
+		if err := audit(c, "reveal host credentials", "host", item.ID); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, resp) // 200
+	}
+}
+
+// newHostCredential generates a root password that follows the same rules as the group passwords, it is not stored yet
+func newHostCredential(host models.Host, key string) models.HostCredential {
+	encrypted, hash := secrets.GeneratePassword(key, verifyPassword)
+	return models.HostCredential{HostID: host.ID, Password: encrypted, PasswordHash: hash}
+}
+
+// storeHostCredential makes cred the current password of the host, the previous one is kept as history
+func storeHostCredential(tx *gorm.DB, cred *models.HostCredential) error {
+	now := time.Now()
+	if res := tx.Model(&models.HostCredential{}).Where("host_id = ? AND retired_at IS NULL", cred.HostID).Update("retired_at", &now); res.Error != nil {
+		return res.Error
+	}
+	return tx.Create(cred).Error
+}
+
+// hostPasswordHash returns the hash of the root password the host currently has, or is going to get
+func hostPasswordHash(host models.Host, key string) (string, error) {
+	options, _ := groupOptions(host.Group)
+	if options.PerHostPassword {
+		var cred models.HostCredential
+		if res := db.DB.Where("host_id = ? AND retired_at IS NULL", host.ID).Order("id desc").Limit(1).Find(&cred); res.Error == nil && res.RowsAffected > 0 {
+			return cred.PasswordHash, nil
+		}
+	}
+	return rootPasswordHash(host.Group, key)
+}
+
+// hostPassword returns the root password the host currently has, or is going to get
+func hostPassword(host models.Host, key string) (string, error) {
+	options, _ := groupOptions(host.Group)
+	if options.PerHostPassword {
+		var cred models.HostCredential
+		if res := db.DB.Where("host_id = ? AND retired_at IS NULL", host.ID).Order("id desc").Limit(1).Find(&cred); res.Error == nil && res.RowsAffected > 0 {
+			password, err := secrets.TryDecrypt(cred.Password, key)
+			if err != nil {
+				return "", fmt.Errorf("the root password of the host can't be decrypted: %w", err)
+			}
+			return password, nil
+		}
+	}
+	if host.Group.Password == "" {
+		return "", nil
+	}
+	password, err := secrets.TryDecrypt(host.Group.Password, key)
+	if err != nil {
+		return "", fmt.Errorf("the root password of group %s can't be decrypted: %w", host.Group.Name, err)
+	}
+	return password, nil
+}
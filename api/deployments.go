@@ -0,0 +1,231 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/deployments"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+)
+
+// ListDeployments Get a list of all deployments
+// @Summary Get all deployments
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Deployment
+// @Failure 500 {object} models.APIError
+// @Router /deployments [get]
+func ListDeployments(c *gin.Context) {
+	var items []models.Deployment
+	if res := db.DB.Order("id desc").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetDeployment Get an existing deployment
+// @Summary Get an existing deployment
+// @Description With the progress of each host.
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Deployment ID"
+// @Success 200 {object} models.Deployment
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /deployments/{id} [get]
+func GetDeployment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, ok := loadDeployment(c, id)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateDeployment Reimage a set of hosts
+// @Summary Reimage a set of hosts
+// @Description The hosts are queued for reimaging and power cycled through their BMC, wave by wave. A host is done once it is ready or failed, the deployment halts when more than maxfailures hosts failed.
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Param item body models.DeploymentForm true "The hosts, or a group, and the limits"
+// @Success 200 {object} models.Deployment
+// @Failure 400 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /deployments [post]
+func CreateDeployment(c *gin.Context) {
+	var form models.DeploymentForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if form.WaveSize < 0 || form.MaxConcurrency < 0 || form.MaxFailures < 0 {
+		Error(c, http.StatusBadRequest, fmt.Errorf("wavesize, maxconcurrency and maxfailures can't be negative")) // 400
+		return
+	}
+
+	hosts, err := deployments.Hosts(form)
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, err := deployments.Create(form, hosts, requestUser(c, "anonymous"))
+	if err != nil {
+		if errors.Is(err, deployments.ErrHostBusy) {
+			Error(c, http.StatusConflict, err) // 409
+		} else {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// PauseDeployment Pause a deployment
+// @Summary Pause a deployment
+// @Description No more hosts are started, the hosts that are being reimaged continue.
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Deployment ID"
+// @Success 200 {object} models.Deployment
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Router /deployments/{id}/pause [post]
+func PauseDeployment(c *gin.Context) {
+	controlDeployment(c, deployments.Pause)
+}
+
+// ResumeDeployment Resume a deployment
+// @Summary Resume a paused or halted deployment
+// @Description The hosts that failed before a deployment is resumed no longer count against maxfailures.
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Deployment ID"
+// @Success 200 {object} models.Deployment
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Router /deployments/{id}/resume [post]
+func ResumeDeployment(c *gin.Context) {
+	controlDeployment(c, deployments.Resume)
+}
+
+// CancelDeployment Cancel a deployment
+// @Summary Cancel a deployment
+// @Description Hosts that haven't booted the installer are no longer queued for reimaging, hosts that are installing continue.
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Deployment ID"
+// @Success 200 {object} models.Deployment
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Router /deployments/{id}/cancel [post]
+func CancelDeployment(c *gin.Context) {
+	controlDeployment(c, func(id int) (models.Deployment, error) {
+		return deployments.Cancel(id, requestUser(c, "anonymous"))
+	})
+}
+
+// DeleteDeployment Remove a finished deployment
+// @Summary Remove a finished deployment
+// @Tags deployments
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Deployment ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /deployments/{id} [delete]
+func DeleteDeployment(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, ok := loadDeployment(c, id)
+	if !ok {
+		return
+	}
+	if item.Status != deployments.Completed && item.Status != deployments.Cancelled {
+		Error(c, http.StatusConflict, fmt.Errorf("the deployment is %s, cancel it first", item.Status)) // 409
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("deployment_id = ?", item.ID).Delete(&models.DeploymentHost{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// controlDeployment pauses, resumes or cancels a deployment
+func controlDeployment(c *gin.Context, control func(id int) (models.Deployment, error)) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if _, err := control(id); err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else if errors.Is(err, deployments.ErrInvalidStatus) {
+			Error(c, http.StatusConflict, err) // 409
+		} else {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
+		return
+	}
+
+	item, ok := loadDeployment(c, id)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, item) // 200
+}
+
+func loadDeployment(c *gin.Context, id int) (models.Deployment, bool) {
+	var item models.Deployment
+	if res := db.DB.Preload("Hosts", func(tx *gorm.DB) *gorm.DB { return tx.Order("wave, id") }).First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return item, false
+	}
+	return item, true
+}
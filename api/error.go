@@ -11,3 +11,11 @@ func Error(c *gin.Context, status int, err error) {
 		ErrorMessage: err.Error(),
 	})
 }
+
+func KickstartError(c *gin.Context, status int, issues []models.KickstartIssue) {
+	c.JSON(status, models.KickstartValidationError{
+		ErrorStatus:  status,
+		ErrorMessage: "the kickstart template is invalid",
+		Issues:       issues,
+	})
+}
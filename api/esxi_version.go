@@ -0,0 +1,92 @@
+package api
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// build=8.0.2-0.0.22380479 in boot.cfg of ESXi 7.0 and later
+var bootCfgBuildRe = regexp.MustCompile(`^build=(\d+\.\d+\.\d+)-(?:[\d.]*\.)?(\d+)\s*$`)
+
+// VMware-VMvisor-Installer-8.0U2-22380479.x86_64.iso or VMware-VMvisor-Installer-7.0.0-15843807.x86_64.iso
+var isoVersionRe = regexp.MustCompile(`(\d+)\.(\d+)(?:\.(\d+)|U(\d+))?[a-z]?-(\d+)`)
+
+// detectESXiVersion reads the ESXi version and build of an extracted image
+func detectESXiVersion(dir string, isoName string) (version string, build string) {
+	for _, name := range []string{"BOOT.CFG", "boot.cfg"} {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if m := bootCfgBuildRe.FindStringSubmatch(scanner.Text()); m != nil {
+				f.Close()
+				return m[1], m[2]
+			}
+		}
+		f.Close()
+	}
+
+	if m := isoVersionRe.FindStringSubmatch(isoName); m != nil {
+		update := m[3]
+		if update == "" {
+			update = m[4]
+		}
+		if update == "" {
+			update = "0"
+		}
+		return m[1] + "." + m[2] + "." + update, m[5]
+	}
+
+	return "", ""
+}
+
+// versionAtLeast compares dotted versions, "8.0.2" is at least "8" and "8.0". An unknown version is
+// treated as the latest so templates keep working for images that were added before versions were detected.
+func versionAtLeast(version string, min string) bool {
+	if version == "" {
+		return true
+	}
+	v, m := versionParts(version), versionParts(min)
+	for i := range m {
+		var p int
+		if i < len(v) {
+			p = v[i]
+		}
+		if p != m[i] {
+			return p > m[i]
+		}
+	}
+	return true
+}
+
+// versionMatches reports if version is prefix, component wise. 8.0 matches 8.0.2 but not 8.1.0
+func versionMatches(version string, prefix string) bool {
+	v, p := versionParts(version), versionParts(prefix)
+	if len(p) == 0 || len(p) > len(v) {
+		return false
+	}
+	for i := range p {
+		if v[i] != p[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func versionParts(version string) []int {
+	var parts []int
+	for _, s := range strings.Split(strings.TrimSpace(version), ".") {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+	}
+	return parts
+}
@@ -13,7 +13,9 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/imdario/mergo"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/esxi"
 	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
 	"github.com/maxiepax/go-via/secrets"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
@@ -77,6 +79,7 @@ func GetGroup(c *gin.Context) {
 // @Param item body models.GroupForm true "Add ip group"
 // @Success 200 {object} models.Group
 // @Failure 400 {object} models.APIError
+// @Failure 422 {object} models.KickstartValidationError
 // @Failure 500 {object} models.APIError
 // @Router /groups [post]
 func CreateGroup(key string) func(c *gin.Context) {
@@ -88,6 +91,11 @@ func CreateGroup(key string) func(c *gin.Context) {
 			return
 		}
 
+		if _, err := decodeMetadata(form.Metadata); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
 		item := models.Group{GroupForm: form}
 
 		//remove whitespaces surrounding comma kickstart file breaks otherwise
@@ -101,6 +109,36 @@ func CreateGroup(key string) func(c *gin.Context) {
 			return
 		}
 		item.Password = secrets.Encrypt(item.Password, key)
+		item.PasswordHash = secrets.HashPassword(form.Password)
+		if item.IloPassword != "" {
+			item.IloPassword = secrets.Encrypt(item.IloPassword, key)
+		}
+
+		if err := validateKickstartTemplateRef(item.KickstartTemplateID, item.KickstartTemplateVersion); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateScriptIDs(item.ScriptIDs); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateBootDiskRules(item.BootDiskRules); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateGroupOptions(item); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateVCenterRef(item); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if issues := append(validateGroupKickstart(item), validateKickstartVariants(item)...); hasKickstartErrors(issues) {
+			KickstartError(c, http.StatusUnprocessableEntity, issues) // 422
+			return
+		}
 
 		if res := db.DB.Create(&item); res.Error != nil {
 			Error(c, http.StatusInternalServerError, res.Error) // 500
@@ -135,6 +173,7 @@ func CreateGroup(key string) func(c *gin.Context) {
 // @Success 200 {object} models.Group
 // @Failure 400 {object} models.APIError
 // @Failure 404 {object} models.APIError
+// @Failure 422 {object} models.KickstartValidationError
 // @Failure 500 {object} models.APIError
 // @Router /groups/{id} [patch]
 func UpdateGroup(key string) func(c *gin.Context) {
@@ -152,6 +191,11 @@ func UpdateGroup(key string) func(c *gin.Context) {
 			return
 		}
 
+		if _, err := decodeMetadata(form.Metadata); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
 		// Load the item
 		var item models.Group
 		if res := db.DB.First(&item, id); res.Error != nil {
@@ -182,6 +226,12 @@ func UpdateGroup(key string) func(c *gin.Context) {
 			}
 
 			item.Password = secrets.Encrypt(item.Password, key)
+			item.PasswordHash = secrets.HashPassword(form.Password)
+		}
+
+		// the BMC password is kept unless a new one has been supplied
+		if form.IloPassword != "" {
+			item.IloPassword = secrets.Encrypt(form.IloPassword, key)
 		}
 
 		//mergo wont overwrite values with empty space. To enable removal of ntp, dns, syslog, vlan, always overwrite.
@@ -190,6 +240,41 @@ func UpdateGroup(key string) func(c *gin.Context) {
 		item.NTP = form.NTP
 		item.Syslog = form.Syslog
 		item.BootDisk = form.BootDisk
+		item.KickstartTemplateID = form.KickstartTemplateID
+		item.KickstartTemplateVersion = form.KickstartTemplateVersion
+		item.ScriptIDs = form.ScriptIDs
+		item.KickstartVariants = form.KickstartVariants
+		item.BootDiskRules = form.BootDiskRules
+		item.VCenterID = form.VCenterID
+		item.Datacenter = form.Datacenter
+		item.Cluster = form.Cluster
+		item.MaintenanceMode = form.MaintenanceMode
+
+		if err := validateKickstartTemplateRef(item.KickstartTemplateID, item.KickstartTemplateVersion); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateScriptIDs(item.ScriptIDs); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateBootDiskRules(item.BootDiskRules); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateGroupOptions(item); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateVCenterRef(item); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if issues := append(validateGroupKickstart(item), validateKickstartVariants(item)...); hasKickstartErrors(issues) {
+			KickstartError(c, http.StatusUnprocessableEntity, issues) // 422
+			return
+		}
 
 		// Save it
 		if res := db.DB.Preload("Pool").Save(&item); res.Error != nil {
@@ -279,3 +364,93 @@ func verifyPassword(s string) error {
 
 	return nil
 }
+
+func validateGroupOptions(group models.Group) error {
+	options, err := groupOptions(group)
+	if err != nil {
+		return err
+	}
+	if options.TimeoutRetries < 0 {
+		return fmt.Errorf("timeoutretries can't be negative")
+	}
+	if options.PostConfig != nil {
+		if err := esxi.Validate(*options.PostConfig); err != nil {
+			return err
+		}
+	}
+	if err := validateCertificateDelivery(options); err != nil {
+		return err
+	}
+	if err := validateReadiness(options); err != nil {
+		return err
+	}
+	return provisioning.ValidateTimeouts(options.StageTimeouts)
+}
+
+// RevealGroupPassword Reveal the root password of a group
+// @Summary Reveal the root password of a group
+// @Description The kickstart only contains a hash of the password, this is the only way to get the password back. It requires the basic auth credentials of a user of go-via, every call is recorded in the audit log.
+// @Tags groups
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Group ID"
+// @Success 200 {object} map[string]string
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /groups/{id}/password [get]
+func RevealGroupPassword(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Group
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+		if item.Password == "" {
+			Error(c, http.StatusNotFound, fmt.Errorf("the group has no password")) // 404
+			return
+		}
+
+		password, err := secrets.TryDecrypt(item.Password, key)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, fmt.Errorf("the root password can't be decrypted: %w", err)) // 500
+			return
+		}
+
+		if err := audit(c, "reveal root password", "group", item.ID); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		c.Header("Cache-Control", "no-store")
+		c.JSON(http.StatusOK, gin.H{"password": password}) // 200
+	}
+}
+
+// rootPasswordHash returns the hash of the root password of the group, groups created before
+// hashes were stored get one derived from the encrypted password
+func rootPasswordHash(group models.Group, key string) (string, error) {
+	if group.PasswordHash != "" {
+		return group.PasswordHash, nil
+	}
+	if group.Password == "" {
+		return "", nil
+	}
+	hash, err := secrets.HashEncrypted(group.Password, key)
+	if err != nil {
+		return "", fmt.Errorf("the root password of group %s can't be decrypted: %w", group.Name, err)
+	}
+	return hash, nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+)
+
+// SyslogPort is the port of the built-in syslog receiver, 0 if it isn't running
+var SyslogPort int
+
+// SyslogDefault makes the built-in syslog receiver the syslog target of groups that don't set one
+var SyslogDefault bool
+
+// syslogServer returns the built-in syslog receiver as a loghost on the address the installer reached
+// go-via on, or an empty string if it isn't running
+func syslogServer(viaServer net.Addr) string {
+	if SyslogPort == 0 {
+		return ""
+	}
+	laddr, ok := viaServer.(*net.TCPAddr)
+	if !ok || laddr.IP == nil {
+		return ""
+	}
+	return "udp://" + net.JoinHostPort(laddr.IP.String(), strconv.Itoa(SyslogPort))
+}
+
+// ListHostLogs Get the syslog messages of a host
+// @Summary Get the syslog messages of a host
+// @Description The messages the installer and ESXi sent to the built-in syslog receiver, the latest last. At most limit messages are returned.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Param  since query string false "Only messages received after this time, RFC 3339"
+// @Param  severity query int false "Only messages of this severity or more severe, 0 (emergency) to 7 (debug)"
+// @Param  q query string false "Only messages containing this text"
+// @Param  limit query int false "The number of messages, default 500, at most 5000"
+// @Success 200 {array} models.HostLog
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/logs [get]
+func ListHostLogs(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var host models.Host
+	if res := db.DB.First(&host, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	limit := 500
+	if v := c.Query("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > 5000 {
+			Error(c, http.StatusBadRequest, fmt.Errorf("limit must be between 1 and 5000")) // 400
+			return
+		}
+	}
+
+	query := db.DB.Where("host_id = ?", host.ID).Order("id desc").Limit(limit)
+	if v := c.Query("since"); v != "" {
+		since, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, fmt.Errorf("since must be a RFC 3339 time: %w", err)) // 400
+			return
+		}
+		query = query.Where("created_at > ?", since)
+	}
+	if v := c.Query("severity"); v != "" {
+		severity, err := strconv.Atoi(v)
+		if err != nil || severity < 0 || severity > 7 {
+			Error(c, http.StatusBadRequest, fmt.Errorf("severity must be between 0 and 7")) // 400
+			return
+		}
+		query = query.Where("severity <= ?", severity)
+	}
+	if v := c.Query("q"); v != "" {
+		query = query.Where("message LIKE ?", "%"+v+"%")
+	}
+
+	var items []models.HostLog
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	// the latest messages were selected, return them oldest first
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
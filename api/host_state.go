@@ -0,0 +1,126 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ListHostTransitions Get the state history of a host
+// @Summary Get the state history of a host
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Success 200 {array} models.HostTransition
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/transitions [get]
+func ListHostTransitions(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Host
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	var items []models.HostTransition
+	if res := db.DB.Where("host_id = ?", item.ID).Order("id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// SetHostState Move a host to another state
+// @Summary Move a host to another state
+// @Description Moves the host to another provisioning state, e.g. to mark it failed or decommissioned. Only valid transitions are accepted.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Param  item body models.HostStateForm true "The new state"
+// @Success 200 {object} models.Host
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 422 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/state [post]
+func SetHostState(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var form models.HostStateForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	if !containsString(provisioning.States(), form.State) {
+		Error(c, http.StatusBadRequest, fmt.Errorf("unknown state %q", form.State)) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Host
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	if _, err := provisioning.Transition(item.ID, form.State, "api", requestUser(c, "anonymous"), form.Message); err != nil {
+		if errors.Is(err, provisioning.ErrInvalidTransition) {
+			Error(c, http.StatusConflict, err) // 409
+		} else if errors.Is(err, provisioning.ErrPreflightFailed) {
+			Error(c, http.StatusUnprocessableEntity, err) // 422
+		} else {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
+		return
+	}
+
+	// Load a new version with relations
+	if res := db.DB.Preload("Pool").First(&item, item.ID); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// transitionHost moves a host as a side effect of an api request, the request doesn't fail if it can't
+func transitionHost(c *gin.Context, item models.Host, state string, message string) {
+	if _, err := provisioning.Transition(item.ID, state, "api", requestUser(c, "anonymous"), message); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"id":  item.ID,
+			"err": err,
+		}).Warn("state")
+	}
+}
@@ -12,305 +12,322 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/imdario/mergo"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/deployments"
 	"github.com/maxiepax/go-via/ilomapi"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/maxiepax/go-via/secrets"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
 	"github.com/maxiepax/go-via/models"
 )
 
-func StartIloHost(c *gin.Context) {
-	// Log that the method has been called
-	logrus.Debug("Received start request")
-	// Extract query parameters and create API client
-	api, _, err := createAPIClientFromParams(c)
-	if err != nil {
-		return
-	}
-
-	err = api.StartServer()
+// StartIloHost Start a host through its BMC
+// @Summary Start a host through its BMC
+// @Tags ilohosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ilohosts/{id}/start [post]
+func StartIloHost(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		// Log that the method has been called
+		logrus.Debug("Received start request")
+		// Create the API client from the BMC of the host
+		api, err := createAPIClientFromHost(c, key)
+		if err != nil {
+			return
+		}
 
-	if err != nil {
+		err = api.StartServer()
+
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to start host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to start host",
+				"message": err.Error(),
+			})
+			return
+		}
+		// Log the host configuration
 		logrus.WithFields(logrus.Fields{
 			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to start host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to start host",
-			"message": err.Error(),
+		}).Info("Host has been scheduled to start successfully")
+		// Return the host configuration as JSON
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "Host configuration fetched successfully",
+
+			"endpoint":   api.GetEndpoint(),
+			"apiFlavour": api.GetFlavour(),
 		})
-		return
-	}
-	// Log the host configuration
-	logrus.WithFields(logrus.Fields{
-		"endpoint": api.GetEndpoint(),
-	}).Info("Host has been scheduled to start successfully")
-	// Return the host configuration as JSON
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "Host configuration fetched successfully",
-
-		"endpoint":   api.GetEndpoint(),
-		"apiFlavour": api.GetFlavour(),
-	})
-
-}
 
-func createAPIClientFromParams(c *gin.Context) (ilomapi.IlomApi, map[string]string, error) {
-	// Extract query parameters
-	var params map[string]string
-	var requestBody struct {
-		IloIpAddr  string `json:"iloIpAddr"`
-		Port       string `json:"port"`
-		ApiFlavour string `json:"apiFlavour"`
-		Username   string `json:"username"`
-		Password   string `json:"password"`
-		VlanID     int    `json:"vlanID"`
-	}
-
-	if err := c.ShouldBindJSON(&requestBody); err != nil {
-
-		fmt.Println(c.Request.PostForm)
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Invalid request body",
-			"message": err.Error(),
-		})
-		return nil, params, errors.New("Invalid request body: " + err.Error())
 	}
+}
 
-	iloIpAddr := requestBody.IloIpAddr
-	port := requestBody.Port
-	apiFlavour := requestBody.ApiFlavour
-	username := requestBody.Username
-	password := requestBody.Password
-
-	params = map[string]string{
-		"iloIpAddr":  requestBody.IloIpAddr,
-		"port":       requestBody.Port,
-		"apiFlavour": requestBody.ApiFlavour,
-		"username":   requestBody.Username,
-		"password":   requestBody.Password,
-		"vlanID":     fmt.Sprintf("%d", requestBody.VlanID),
+// createAPIClientFromHost returns the client of the BMC of the host in the path, the response is sent if it fails
+func createAPIClientFromHost(c *gin.Context, key string) (ilomapi.IlomApi, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return nil, err
 	}
 
-	var api ilomapi.IlomApi
-
-	// Validate parameters
-	if iloIpAddr == "" || port == "" || apiFlavour == "" || username == "" || password == "" {
-		if len(password) > 0 {
-			password = "*****" // Mask password for security
+	// Load the item
+	var item models.Host
+	if res := db.DB.Preload("Group").First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
 		}
-		logrus.WithFields(logrus.Fields{
-			"iloIpAddr":  iloIpAddr,
-			"port":       port,
-			"apiFlavour": apiFlavour,
-			"username":   username,
-			"password":   password, // Mask password for security
-		}).Warn("Missing required parameters")
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error": "iloIpAddr, apiFlavour, port, username, and password are required parameters",
-		})
-		return nil, params, errors.New("Missing required parameters: iloIpAddr:" + iloIpAddr +
-			" port:" + port +
-			" apiFlavour:" + apiFlavour +
-			" username:" + username +
-			" password:" + password)
+		return nil, res.Error
 	}
 
-	// Get the IP and mac for every Network Interface
-
-	switch apiFlavour {
-
-	case "redfish":
-		// Call the Redfish API to get the host configuration
-		api = ilomapi.NewRedFishApi(iloIpAddr, port, username, password)
+	api, err := deployments.BMC(item, key)
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return nil, err
 	}
-	// return the API client
-	return api, params, nil
+	return api, nil
 }
 
-func ShutdownIloHost(c *gin.Context) {
-
-	// Log that the method has been called
-	logrus.Debug("Received shutdown request")
+// ShutdownIloHost Shut down a host through its BMC
+// @Summary Shut down a host through its BMC
+// @Tags ilohosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ilohosts/{id}/shutdown [post]
+func ShutdownIloHost(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
 
-	// Extract query parameters and create API client
-	api, _, err := createAPIClientFromParams(c)
-	if err != nil {
-		return
-	}
+		// Log that the method has been called
+		logrus.Debug("Received shutdown request")
 
-	err = api.StopServer()
+		// Create the API client from the BMC of the host
+		api, err := createAPIClientFromHost(c, key)
+		if err != nil {
+			return
+		}
 
-	if err != nil {
+		err = api.StopServer()
+
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to shutdown host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to shutdown host",
+				"message": err.Error(),
+			})
+			return
+		}
+		// Log the host configuration
 		logrus.WithFields(logrus.Fields{
 			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to shutdown host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to shutdown host",
-			"message": err.Error(),
+		}).Debug("Host has been shut down successfully")
+		// Return the host configuration as JSON
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"message": "Host configuration fetched successfully",
+
+			"endpoint":   api.GetEndpoint(),
+			"apiFlavour": api.GetFlavour(),
 		})
-		return
-	}
-	// Log the host configuration
-	logrus.WithFields(logrus.Fields{
-		"endpoint": api.GetEndpoint(),
-	}).Debug("Host has been shut down successfully")
-	// Return the host configuration as JSON
-	c.JSON(http.StatusOK, gin.H{
-		"success": true,
-		"message": "Host configuration fetched successfully",
-
-		"endpoint":   api.GetEndpoint(),
-		"apiFlavour": api.GetFlavour(),
-	})
 
+	}
 }
 
-func RebootIloHost(c *gin.Context) {
-	// Log that the method has been called
-	logrus.Debug("Received reboot request")
-	// Extract query parameters and create API client
-	api, _, err := createAPIClientFromParams(c)
-	if err != nil {
-		return
-	}
+// RebootIloHost Reboot a host through its BMC
+// @Summary Reboot a host through its BMC
+// @Tags ilohosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ilohosts/{id}/reboot [post]
+func RebootIloHost(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		// Log that the method has been called
+		logrus.Debug("Received reboot request")
+		// Create the API client from the BMC of the host
+		api, err := createAPIClientFromHost(c, key)
+		if err != nil {
+			return
+		}
 
-	err = api.RebootServer()
-	if err != nil {
+		err = api.RebootServer()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to reboot host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to reboot host",
+				"message": err.Error(),
+			})
+			return
+		}
+
+		// Log success and return response
 		logrus.WithFields(logrus.Fields{
 			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to reboot host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to reboot host",
-			"message": err.Error(),
+		}).Info("Host has been rebooted successfully")
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"message":    "Host rebooted successfully",
+			"endpoint":   api.GetEndpoint(),
+			"apiFlavour": api.GetFlavour(),
 		})
-		return
 	}
-
-	// Log success and return response
-	logrus.WithFields(logrus.Fields{
-		"endpoint": api.GetEndpoint(),
-	}).Info("Host has been rebooted successfully")
-	c.JSON(http.StatusOK, gin.H{
-		"success":    true,
-		"message":    "Host rebooted successfully",
-		"endpoint":   api.GetEndpoint(),
-		"apiFlavour": api.GetFlavour(),
-	})
 }
 
-func OneTimeBoot(c *gin.Context) {
+// OneTimeBoot Boot a host from the network once
+// @Summary Boot a host from the network once
+// @Tags ilohosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ilohosts/{id}/onetimeboot [post]
+func OneTimeBoot(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+
+		// Log that the method has been called
+		logrus.Info("Received reboot request")
+		// Create the API client from the BMC of the host
+		api, err := createAPIClientFromHost(c, key)
+		if err != nil {
+			return
+		}
 
-	// Log that the method has been called
-	logrus.Info("Received reboot request")
-	// Extract query parameters and create API client
-	api, _, err := createAPIClientFromParams(c)
-	if err != nil {
-		return
-	}
+		err = api.SetOneTimeHTTPBoot()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to reboot host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to reboot host",
+				"message": err.Error(),
+			})
+			return
+		}
 
-	err = api.SetOneTimeHTTPBoot()
-	if err != nil {
+		// Log success and return response
 		logrus.WithFields(logrus.Fields{
 			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to reboot host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to reboot host",
-			"message": err.Error(),
+		}).Info("Host has been rebooted successfully")
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"message":    "Host rebooted successfully",
+			"endpoint":   api.GetEndpoint(),
+			"apiFlavour": api.GetFlavour(),
 		})
-		return
 	}
-
-	// Log success and return response
-	logrus.WithFields(logrus.Fields{
-		"endpoint": api.GetEndpoint(),
-	}).Info("Host has been rebooted successfully")
-	c.JSON(http.StatusOK, gin.H{
-		"success":    true,
-		"message":    "Host rebooted successfully",
-		"endpoint":   api.GetEndpoint(),
-		"apiFlavour": api.GetFlavour(),
-	})
 }
 
-func SetVLANID(c *gin.Context) {
-	// Log that the method has been called
-	logrus.Debug("Received set VLANID request")
-
-	// Extract query parameters and create API client
-	api, params, err := createAPIClientFromParams(c)
-	if err != nil {
-		return
-	}
+// SetVLANID Set the VLAN of a host and reboot it into the installer
+// @Summary Set the VLAN of a host and reboot it into the installer
+// @Tags ilohosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Param  item body object true "{\"vlanID\": 12}"
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /ilohosts/{id}/setvlanID [post]
+func SetVLANID(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		// Log that the method has been called
+		logrus.Debug("Received set VLANID request")
+
+		// the BMC is the one of the host, only the vlan is in the body
+		var requestBody struct {
+			VlanID int `json:"vlanID"`
+		}
+		if err := c.ShouldBindJSON(&requestBody); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error":   "Invalid request body",
+				"message": err.Error(),
+			})
+			return
+		}
+		vlanID := requestBody.VlanID
 
-	vlanID, err := strconv.Atoi(params["vlanID"])
+		api, err := createAPIClientFromHost(c, key)
+		if err != nil {
+			return
+		}
 
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to parse VLAN ID")
-		c.JSON(http.StatusBadRequest, gin.H{
-			"error":   "Failed to parse VLAN ID",
-			"message": err.Error(),
-		})
-		return
-	}
-	// Set VLAN ID
-	err = api.SetVLANID(vlanID)
+		// Set VLAN ID
+		err = api.SetVLANID(vlanID)
+
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to reboot host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to reboot host",
+				"message": err.Error(),
+			})
+			return
+		}
 
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to reboot host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to reboot host",
-			"message": err.Error(),
-		})
-		return
-	}
+		err = api.SetOneTimeHTTPBoot()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to set one Time Boot host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to set one Time Boot host",
+				"message": err.Error(),
+			})
+			return
+		}
 
-	err = api.SetOneTimeHTTPBoot()
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to set one Time Boot host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to set one Time Boot host",
-			"message": err.Error(),
-		})
-		return
-	}
+		err = api.RebootServer()
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"endpoint": api.GetEndpoint(),
+				"error":    err.Error(),
+			}).Error("Failed to trigger reboot host")
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"error":   "Failed to trigger reboot host",
+				"message": err.Error(),
+			})
+			return
+		}
 
-	err = api.RebootServer()
-	if err != nil {
+		// Log success and return response
 		logrus.WithFields(logrus.Fields{
 			"endpoint": api.GetEndpoint(),
-			"error":    err.Error(),
-		}).Error("Failed to trigger reboot host")
-		c.JSON(http.StatusInternalServerError, gin.H{
-			"error":   "Failed to trigger reboot host",
-			"message": err.Error(),
+		}).Info("Host has been configured with VLANID " + strconv.Itoa(vlanID) + " successfully")
+		c.JSON(http.StatusOK, gin.H{
+			"success":    true,
+			"message":    "Host has been configured with VLANID " + strconv.Itoa(vlanID) + " successfully",
+			"endpoint":   api.GetEndpoint(),
+			"apiFlavour": api.GetFlavour(),
 		})
-		return
 	}
-
-	// Log success and return response
-	logrus.WithFields(logrus.Fields{
-		"endpoint": api.GetEndpoint(),
-	}).Info("Host has been configured with VLANID " + params["vlanID"] + " successfully")
-	c.JSON(http.StatusOK, gin.H{
-		"success":    true,
-		"message":    "Host has been configured with VLANID " + params["vlanID"] + " successfully",
-		"endpoint":   api.GetEndpoint(),
-		"apiFlavour": api.GetFlavour(),
-	})
 }
 
 // ListHosts Get a list of all hosts
@@ -403,90 +420,120 @@ func SearchHost(c *gin.Context) {
 
 // CreateHost Create a new host
 // @Summary Create a new host
+// @Description A host created with reimage set runs the preflight checks first, it isn't created if one of them fails.
 // @Tags hosts
 // @Accept  json
 // @Produce  json
 // @Param item body models.HostForm true "Add a host"
 // @Success 200 {object} models.Host
 // @Failure 400 {object} models.APIError
+// @Failure 422 {object} models.PreflightError
 // @Failure 500 {object} models.APIError
 // @Router /hosts [post]
-func CreateHost(c *gin.Context) {
-	var form models.HostForm
+func CreateHost(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.HostForm
 
-	if err := c.ShouldBind(&form); err != nil {
-		Error(c, http.StatusBadRequest, err) // 400
-		return
-	}
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
 
-	item := models.Host{HostForm: form}
+		if _, err := decodeMetadata(form.Metadata); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
 
-	// get the pool network info to verify if this ip should be added to the pool.
-	var pool models.Pool
-	db.DB.First(&pool, "id = ?", form.PoolID)
+		item := models.Host{HostForm: form}
+		if item.IloPassword != "" {
+			item.IloPassword = secrets.Encrypt(item.IloPassword, key)
+		}
 
-	// first check if the address is even in the network.
-	ip, err := netip.ParseAddr(item.IP)
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-		}).Error("CreateHost")
-	}
+		// get the pool network info to verify if this ip should be added to the pool.
+		var pool models.Pool
+		db.DB.First(&pool, "id = ?", form.PoolID)
 
-	network, err := netip.ParsePrefix(pool.NetAddress + "/" + strconv.Itoa(pool.Netmask))
-	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"error": err,
-		}).Error("CreateHost")
-	}
+		// first check if the address is even in the network.
+		ip, err := netip.ParseAddr(item.IP)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("CreateHost")
+		}
 
-	if network.Contains(ip) {
-		logrus.WithFields(logrus.Fields{
-			"ip":      ip,
-			"network": network,
-		}).Debug("ip validation successful")
-	} else {
-		Error(c, http.StatusBadRequest, fmt.Errorf("the ip address is not in the scope of the dhcp pool associated with the group")) // 400
-		return
-	}
+		network, err := netip.ParsePrefix(pool.NetAddress + "/" + strconv.Itoa(pool.Netmask))
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Error("CreateHost")
+		}
 
-	// ensure the mac address is properly formated.
-	mac, _ := net.ParseMAC(item.Mac)
-	item.Mac = mac.String()
+		if network.Contains(ip) {
+			logrus.WithFields(logrus.Fields{
+				"ip":      ip,
+				"network": network,
+			}).Debug("ip validation successful")
+		} else {
+			Error(c, http.StatusBadRequest, fmt.Errorf("the ip address is not in the scope of the dhcp pool associated with the group")) // 400
+			return
+		}
 
-	// if ip address checks pass, continue to commit.
-	if item.ID != 0 { // Save if its an existing item
-		if res := db.DB.Save(&item); res.Error != nil {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
+		if err := validateKickstartTemplateRef(item.KickstartTemplateID, item.KickstartTemplateVersion); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
 			return
 		}
-	} else { // Create a new item
-		if res := db.DB.Create(&item); res.Error != nil {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
+		if err := validateScriptIDs(item.ScriptIDs); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
 			return
 		}
-	}
 
-	// Load a new version with relations
-	if res := db.DB.Preload("Pool").First(&item); res.Error != nil {
-		Error(c, http.StatusInternalServerError, res.Error) // 500
-		return
-	}
+		// ensure the mac address is properly formated.
+		mac, _ := net.ParseMAC(item.Mac)
+		item.Mac = mac.String()
 
-	c.JSON(http.StatusOK, item) // 200
+		// a host that fails the preflight checks isn't reimaged
+		if item.Reimage && !checkReimage(c, item, key) {
+			return
+		}
+
+		// if ip address checks pass, continue to commit.
+		if item.ID != 0 { // Save if its an existing item
+			if res := db.DB.Save(&item); res.Error != nil {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+				return
+			}
+		} else { // Create a new item
+			if res := db.DB.Create(&item); res.Error != nil {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+				return
+			}
+		}
+		if item.Reimage {
+			transitionHost(c, item, provisioning.Queued, "reimage requested")
+		}
 
-	logrus.WithFields(logrus.Fields{
-		"Hostname": item.Hostname,
-		"Domain":   item.Domain,
-		"IP":       item.IP,
-		"MAC":      item.Mac,
-		"Pool ID":  item.PoolID,
-		"Group ID": item.GroupID,
-	}).Debug("host")
+		// Load a new version with relations
+		if res := db.DB.Preload("Pool").First(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		c.JSON(http.StatusOK, item) // 200
+
+		logrus.WithFields(logrus.Fields{
+			"Hostname": item.Hostname,
+			"Domain":   item.Domain,
+			"IP":       item.IP,
+			"MAC":      item.Mac,
+			"Pool ID":  item.PoolID,
+			"Group ID": item.GroupID,
+		}).Debug("host")
+	}
 }
 
 // UpdateHost Update an existing host
 // @Summary Update an existing host
+// @Description Setting reimage runs the preflight checks first, the host isn't reimaged if one of them fails.
 // @Tags hosts
 // @Accept  json
 // @Produce  json
@@ -495,55 +542,98 @@ func CreateHost(c *gin.Context) {
 // @Success 200 {object} models.Host
 // @Failure 400 {object} models.APIError
 // @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 422 {object} models.PreflightError
 // @Failure 500 {object} models.APIError
 // @Router /hosts/{id} [patch]
-func UpdateHost(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
-	if err != nil {
-		Error(c, http.StatusBadRequest, err) // 400
-		return
-	}
+func UpdateHost(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
 
-	// Load the form data
-	var form models.HostForm
-	if err := c.ShouldBind(&form); err != nil {
-		Error(c, http.StatusBadRequest, err) // 400
-		return
-	}
+		// Load the form data
+		var form models.HostForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
 
-	// Load the item
-	var item models.Host
-	if res := db.DB.First(&item, id); res.Error != nil {
-		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
-			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
-		} else {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
+		if _, err := decodeMetadata(form.Metadata); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
 		}
-		return
-	}
 
-	// Merge the item and the form data
-	if err := mergo.Merge(&item, models.Host{HostForm: form}, mergo.WithOverride); err != nil {
-		Error(c, http.StatusInternalServerError, err) // 500
-	}
+		// Load the item
+		var item models.Host
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
 
-	// Mergo doesn't overwrite 0 or false values, force set
-	item.Reimage = form.Reimage
-	item.Progress = form.Progress
+		reimage := item.Reimage
 
-	// Save it
-	if res := db.DB.Save(&item); res.Error != nil {
-		Error(c, http.StatusInternalServerError, res.Error) // 500
-		return
-	}
+		// Merge the item and the form data
+		if err := mergo.Merge(&item, models.Host{HostForm: form}, mergo.WithOverride); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
 
-	// Load a new version with relations
-	if res := db.DB.Preload("Pool").First(&item); res.Error != nil {
-		Error(c, http.StatusInternalServerError, res.Error) // 500
-		return
-	}
+		// the BMC password is kept unless a new one has been supplied
+		if form.IloPassword != "" {
+			item.IloPassword = secrets.Encrypt(form.IloPassword, key)
+		}
 
-	c.JSON(http.StatusOK, item) // 200
+		// Mergo doesn't overwrite 0 or false values, force set
+		item.Reimage = form.Reimage
+		item.KickstartTemplateID = form.KickstartTemplateID
+		item.KickstartTemplateVersion = form.KickstartTemplateVersion
+		item.ScriptIDs = form.ScriptIDs
+
+		if err := validateKickstartTemplateRef(item.KickstartTemplateID, item.KickstartTemplateVersion); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if err := validateScriptIDs(item.ScriptIDs); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if item.Reimage && !reimage && !provisioning.CanTransition(item.State, provisioning.Queued) {
+			Error(c, http.StatusConflict, fmt.Errorf("a %s host can't be reimaged", item.State)) // 409
+			return
+		}
+
+		// a host that fails the preflight checks isn't reimaged
+		if item.Reimage && !reimage && !checkReimage(c, item, key) {
+			return
+		}
+
+		// Save it, the state and progress are only changed by the state machine
+		if res := db.DB.Omit("state", "state_changed_at", "progress", "progresstext").Save(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		switch {
+		case item.Reimage && !reimage:
+			transitionHost(c, item, provisioning.Queued, "reimage requested")
+		case !item.Reimage && reimage && (item.State == provisioning.Queued || item.State == provisioning.PXE || item.State == provisioning.BootCfg):
+			transitionHost(c, item, provisioning.Registered, "reimage cancelled")
+		}
+
+		// Load a new version with relations
+		if res := db.DB.Preload("Pool").First(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		c.JSON(http.StatusOK, item) // 200
+	}
 }
 
 // DeleteHost Remove an existing host
@@ -574,11 +664,42 @@ func DeleteHost(c *gin.Context) {
 		return
 	}
 
-	// delete it
-	if res := db.DB.Delete(&item); res.Error != nil {
-		Error(c, http.StatusInternalServerError, res.Error) // 500
+	// delete it, together with the passwords generated for it and the reports of its installations
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("host_id = ?", item.ID).Delete(&models.HostCredential{}); res.Error != nil {
+			return res.Error
+		}
+		if res := tx.Where("host_id = ?", item.ID).Delete(&models.InstallReport{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
 		return
 	}
 
 	c.JSON(http.StatusNoContent, gin.H{}) //204
 }
+
+// EncryptBMCPasswords encrypts the BMC passwords of the hosts that were stored before they were encrypted
+func EncryptBMCPasswords(key string) {
+	var items []models.Host
+	if res := db.DB.Where("ilo_password <> ''").Find(&items); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("could not load the BMC passwords")
+		return
+	}
+	for _, item := range items {
+		if _, err := secrets.TryDecrypt(item.IloPassword, key); err == nil {
+			continue
+		}
+		if res := db.DB.Model(&item).UpdateColumn("ilo_password", secrets.Encrypt(item.IloPassword, key)); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  item.ID,
+				"err": res.Error,
+			}).Warn("could not encrypt the BMC password")
+		}
+	}
+}
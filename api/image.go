@@ -21,6 +21,7 @@ import (
 	"github.com/kdomanski/iso9660/util"
 	"github.com/maxiepax/go-via/db"
 	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/webhooks"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 )
@@ -199,6 +200,12 @@ func CreateImage(c *gin.Context) {
 
 		item.Size = size
 
+		// the esxi version allows templates to branch on it, it can be overridden when it can't be detected
+		item.Version, item.Build = detectESXiVersion(fp, item.ISOImage)
+		if v := c.PostForm("version"); v != "" {
+			item.Version = v
+		}
+
 		/*
 			mime, err := mimetype.DetectFile(item.StoragePath)
 			if err != nil {
@@ -219,7 +226,14 @@ func CreateImage(c *gin.Context) {
 			"path":        item.Path,
 			"size":        item.Size,
 			"description": item.Description,
+			"version":     item.Version,
 		}).Info("image")
+		if err := webhooks.Publish(db.DB, webhooks.ImageAdded, item); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  item.ID,
+				"err": err,
+			}).Warn("webhooks: could not queue the event")
+		}
 		c.JSON(http.StatusOK, item) // 200
 	}
 }
@@ -422,3 +436,18 @@ func dirSize(path string) (int64, error) {
 	size = size / 1024 / 1024
 	return size, err
 }
+
+// MbootPath returns the path of the boot loader in an image, the name differs between builds
+func MbootPath(imagePath string) (string, error) {
+	//check these paths if the file exists.
+	paths := []string{"/EFI/BOOT/BOOTX64.EFI", "/EFI/BOOT/BOOTAA64.EFI", "/MBOOT.EFI", "/mboot.efi", "/efi/boot/bootx64.efi", "/efi/boot/bootaa64.efi"}
+
+	for _, v := range paths {
+		if _, err := os.Stat(imagePath + v); err == nil {
+			return imagePath + v, nil
+		}
+	}
+	//couldn't find the file
+	return "", fmt.Errorf("could not locate a mboot.efi")
+
+}
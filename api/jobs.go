@@ -0,0 +1,140 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/jobs"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+)
+
+// ListJobs Get the background jobs
+// @Summary Get the background jobs
+// @Description The latest jobs first, at most 500.
+// @Tags jobs
+// @Accept  json
+// @Produce  json
+// @Param  status query string false "queued, running, succeeded, failed or cancelled"
+// @Param  type query string false "Only jobs of this type, e.g. postconfig"
+// @Param  host_id query int false "Only the jobs of this host"
+// @Success 200 {array} models.Job
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /jobs [get]
+func ListJobs(c *gin.Context) {
+	query := db.DB.Order("id desc").Limit(500)
+	if v := c.Query("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+	if v := c.Query("type"); v != "" {
+		query = query.Where("type = ?", v)
+	}
+	if v := c.Query("host_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		query = query.Where("host_id = ?", id)
+	}
+
+	var items []models.Job
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetJob Get a background job
+// @Summary Get a background job
+// @Tags jobs
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Job ID"
+// @Success 200 {object} models.Job
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /jobs/{id} [get]
+func GetJob(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Job
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CancelJob Cancel a background job
+// @Summary Cancel a queued or running job
+// @Tags jobs
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Job ID"
+// @Success 200 {object} models.Job
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /jobs/{id}/cancel [post]
+func CancelJob(c *gin.Context) {
+	controlJob(c, jobs.Cancel)
+}
+
+// RetryJob Run a background job again
+// @Summary Queue a failed or cancelled job again
+// @Tags jobs
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Job ID"
+// @Success 200 {object} models.Job
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /jobs/{id}/retry [post]
+func RetryJob(c *gin.Context) {
+	controlJob(c, jobs.Retry)
+}
+
+// controlJob cancels or retries a job
+func controlJob(c *gin.Context, control func(id int) (models.Job, error)) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item, err := control(id)
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else if errors.Is(err, jobs.ErrInvalidStatus) {
+			Error(c, http.StatusConflict, err) // 409
+		} else {
+			Error(c, http.StatusInternalServerError, err) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
@@ -0,0 +1,633 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	esxikickstart "github.com/maxiepax/go-via/esxi-kickstart"
+	"github.com/maxiepax/go-via/models"
+	"github.com/pmezard/go-difflib/difflib"
+	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// the built-in template used by groups and hosts without a template
+const defaultKickstartTemplate = "default"
+
+// ListKickstartTemplates Get a list of all kickstart templates
+// @Summary Get all kickstart templates
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.KickstartTemplate
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates [get]
+func ListKickstartTemplates(c *gin.Context) {
+	var items []models.KickstartTemplate
+	if res := db.DB.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetKickstartTemplate Get an existing kickstart template with all its versions
+// @Summary Get an existing kickstart template
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Kickstart template ID"
+// @Success 200 {object} models.KickstartTemplate
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates/{id} [get]
+func GetKickstartTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.KickstartTemplate
+	if res := db.DB.Preload("Versions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("version")
+	}).First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateKickstartTemplate Create a new kickstart template
+// @Summary Create a new kickstart template, the first version is approved right away
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Param item body models.KickstartTemplateForm true "Add a kickstart template"
+// @Success 200 {object} models.KickstartTemplate
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 422 {object} models.KickstartValidationError
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates [post]
+func CreateKickstartTemplate(c *gin.Context) {
+	var form models.KickstartTemplateForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if form.Name == "" || form.Content == "" {
+		Error(c, http.StatusBadRequest, fmt.Errorf("name and content are required")) // 400
+		return
+	}
+
+	if issues := validateKickstart(form.Content, sampleHost(models.Group{})); hasKickstartErrors(issues) {
+		KickstartError(c, http.StatusUnprocessableEntity, issues) // 422
+		return
+	}
+
+	item := models.KickstartTemplate{KickstartTemplateForm: form}
+	author := authenticatedUser(c)
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Create(&item); res.Error != nil {
+			return res.Error
+		}
+		_, err := addKickstartTemplateVersion(tx, &item, form.Content, author, form.Comment, true)
+		return err
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+
+	logrus.WithFields(logrus.Fields{
+		"id":     item.ID,
+		"name":   item.Name,
+		"author": author,
+	}).Info("kickstart template created")
+}
+
+// UpdateKickstartTemplate Update an existing kickstart template
+// @Summary Update an existing kickstart template, new content is stored as a version that has to be approved
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Kickstart template ID"
+// @Param  item body models.KickstartTemplateForm true "Update a kickstart template"
+// @Success 200 {object} models.KickstartTemplate
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 422 {object} models.KickstartValidationError
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates/{id} [patch]
+func UpdateKickstartTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the form data
+	var form models.KickstartTemplateForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.KickstartTemplate
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	if form.Name != "" {
+		item.Name = form.Name
+	}
+	if form.Description != "" {
+		item.Description = form.Description
+	}
+
+	if form.Content != "" {
+		if issues := validateKickstart(form.Content, sampleHost(models.Group{})); hasKickstartErrors(issues) {
+			KickstartError(c, http.StatusUnprocessableEntity, issues) // 422
+			return
+		}
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if form.Content != "" {
+			_, err := addKickstartTemplateVersion(tx, &item, form.Content, authenticatedUser(c), form.Comment, false)
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Save(&item).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteKickstartTemplate Remove an existing kickstart template
+// @Summary Remove an existing kickstart template
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Kickstart template ID"
+// @Success 204
+// @Failure 401 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates/{id} [delete]
+func DeleteKickstartTemplate(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.KickstartTemplate
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// groups and hosts without a template use the default one
+	if item.BuiltIn && item.Name == defaultKickstartTemplate {
+		Error(c, http.StatusConflict, fmt.Errorf("the %s template is used by all groups and hosts without a template", defaultKickstartTemplate)) // 409
+		return
+	}
+
+	// check if any group or host is using the template
+	var groups, hosts int64
+	db.DB.Model(&models.Group{}).Where("kickstart_template_id = ?", item.ID).Count(&groups)
+	db.DB.Model(&models.Host{}).Where("kickstart_template_id = ?", item.ID).Count(&hosts)
+	if groups > 0 || hosts > 0 {
+		Error(c, http.StatusConflict, fmt.Errorf("the template is used by %d groups and %d hosts, please re-assign them first", groups, hosts)) // 409
+		return
+	}
+
+	err = db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("template_id = ?", item.ID).Delete(&models.KickstartTemplateVersion{}); res.Error != nil {
+			return res.Error
+		}
+		return tx.Delete(&item).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// GetKickstartTemplateVersion Get a single version of a kickstart template
+// @Summary Get a version of a kickstart template including its diff
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Kickstart template ID"
+// @Param  version path int true "Version"
+// @Success 200 {object} models.KickstartTemplateVersion
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates/{id}/versions/{version} [get]
+func GetKickstartTemplateVersion(c *gin.Context) {
+	item, ok := loadKickstartTemplateVersion(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// ApproveKickstartTemplateVersion Approve a version of a kickstart template
+// @Summary Approve a version, it is used for the next reimage of all groups and hosts that don't pin a version
+// @Tags kickstart_templates
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Kickstart template ID"
+// @Param  version path int true "Version"
+// @Description The version is approved by the user of the basic auth credentials, it can't be approved by its author.
+// @Success 200 {object} models.KickstartTemplateVersion
+// @Failure 400 {object} models.APIError
+// @Failure 401 {object} models.APIError
+// @Failure 403 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /kickstart_templates/{id}/versions/{version}/approve [post]
+func ApproveKickstartTemplateVersion(c *gin.Context) {
+	item, ok := loadKickstartTemplateVersion(c)
+	if !ok {
+		return
+	}
+
+	// a change is reviewed by someone else than its author
+	approver := authenticatedUser(c)
+	if approver == item.Author {
+		Error(c, http.StatusForbidden, fmt.Errorf("version %d was written by %s, it has to be approved by another user", item.Version, item.Author)) // 403
+		return
+	}
+
+	now := time.Now()
+	item.Approved = true
+	item.ApprovedBy = approver
+	item.ApprovedAt = &now
+
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Save(&item); res.Error != nil {
+			return res.Error
+		}
+		return tx.Model(&models.KickstartTemplate{}).Where("id = ?", item.TemplateID).Update("current_version", item.Version).Error
+	})
+	if err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"template": item.TemplateID,
+		"version":  item.Version,
+		"approver": item.ApprovedBy,
+	}).Info("kickstart template version approved")
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+func loadKickstartTemplateVersion(c *gin.Context) (models.KickstartTemplateVersion, bool) {
+	var item models.KickstartTemplateVersion
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return item, false
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return item, false
+	}
+
+	if res := db.DB.Where("template_id = ? AND version = ?", id, version).First(&item); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return item, false
+	}
+
+	return item, true
+}
+
+// addKickstartTemplateVersion stores content as the next version of the template, unchanged content is not stored again.
+func addKickstartTemplateVersion(tx *gorm.DB, item *models.KickstartTemplate, content string, author string, comment string, approve bool) (*models.KickstartTemplateVersion, error) {
+	var current models.KickstartTemplateVersion
+	if item.CurrentVersion > 0 {
+		if res := tx.Where("template_id = ? AND version = ?", item.ID, item.CurrentVersion).First(&current); res.Error != nil {
+			return nil, res.Error
+		}
+		if current.Content == content {
+			return &current, nil
+		}
+	}
+
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(current.Content),
+		B:        difflib.SplitLines(content),
+		FromFile: fmt.Sprintf("%s v%d", item.Name, current.Version),
+		ToFile:   fmt.Sprintf("%s v%d", item.Name, item.LatestVersion+1),
+		Context:  3,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	version := models.KickstartTemplateVersion{
+		TemplateID: item.ID,
+		Version:    item.LatestVersion + 1,
+		Content:    content,
+		Author:     author,
+		Comment:    comment,
+		Diff:       diff,
+	}
+	if approve {
+		now := time.Now()
+		version.Approved = true
+		version.ApprovedBy = author
+		version.ApprovedAt = &now
+	}
+	if res := tx.Create(&version); res.Error != nil {
+		return nil, res.Error
+	}
+
+	item.LatestVersion = version.Version
+	if approve {
+		item.CurrentVersion = version.Version
+	}
+	if res := tx.Model(item).Updates(map[string]interface{}{"latest_version": item.LatestVersion, "current_version": item.CurrentVersion}); res.Error != nil {
+		return nil, res.Error
+	}
+
+	return &version, nil
+}
+
+// kickstartTemplateContent returns the content of the pinned version, or the current version if version is 0. only
+// approved versions are returned.
+func kickstartTemplateContent(id int, version int) (string, error) {
+	var item models.KickstartTemplate
+	if res := db.DB.First(&item, id); res.Error != nil {
+		return "", fmt.Errorf("kickstart template %d: %w", id, res.Error)
+	}
+	if version == 0 {
+		version = item.CurrentVersion
+	}
+
+	var v models.KickstartTemplateVersion
+	if res := db.DB.Where("template_id = ? AND version = ?", id, version).First(&v); res.Error != nil {
+		return "", fmt.Errorf("kickstart template %s version %d: %w", item.Name, version, res.Error)
+	}
+	// pinning a version doesn't skip its review
+	if !v.Approved {
+		return "", fmt.Errorf("kickstart template %s version %d has not been approved", item.Name, version)
+	}
+	return v.Content, nil
+}
+
+// validateKickstartTemplateRef checks that a referenced template exists, and the pinned version exists and is approved
+func validateKickstartTemplateRef(id models.NullInt32, version int) error {
+	if !id.Valid {
+		if version != 0 {
+			return fmt.Errorf("kickstart_template_version requires a kickstart_template_id")
+		}
+		return nil
+	}
+	_, err := kickstartTemplateContent(int(id.Int32), version)
+	return err
+}
+
+// resolveKickstart returns the kickstart template for a host, host settings take precedence over the group.
+// the group variant for the esxi version of the image takes precedence over the other group settings.
+func resolveKickstart(item models.Host) (string, error) {
+	switch {
+	case item.KickstartTemplateID.Valid:
+		return kickstartTemplateContent(int(item.KickstartTemplateID.Int32), item.KickstartTemplateVersion)
+	case item.Ks != "":
+		dec, err := base64.StdEncoding.DecodeString(item.Ks)
+		return string(dec), err
+	}
+
+	variant, ok, err := groupKickstartVariant(item.Group)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return kickstartTemplateContent(variant.KickstartTemplateID, variant.KickstartTemplateVersion)
+	}
+
+	switch {
+	case item.Group.KickstartTemplateID.Valid:
+		return kickstartTemplateContent(int(item.Group.KickstartTemplateID.Int32), item.Group.KickstartTemplateVersion)
+	case item.Group.Ks != "":
+		dec, err := base64.StdEncoding.DecodeString(item.Group.Ks)
+		return string(dec), err
+	}
+	return defaultKickstartTemplateContent()
+}
+
+// defaultKickstartTemplateContent returns the approved version of the built-in default template, changes to it
+// are reviewed like those to any other template
+func defaultKickstartTemplateContent() (string, error) {
+	var item models.KickstartTemplate
+	if res := db.DB.Where("name = ? AND built_in", defaultKickstartTemplate).First(&item); res.Error != nil {
+		return "", fmt.Errorf("kickstart template %s: %w", defaultKickstartTemplate, res.Error)
+	}
+	return kickstartTemplateContent(item.ID, 0)
+}
+
+// groupKickstartVariant returns the variant of the group that matches the esxi version of its image best
+func groupKickstartVariant(group models.Group) (models.KickstartVariant, bool, error) {
+	var best models.KickstartVariant
+	variants, err := decodeKickstartVariants(group.KickstartVariants)
+	if err != nil || len(variants) == 0 || group.ImageID == 0 {
+		return best, false, err
+	}
+
+	var image models.Image
+	if res := db.DB.First(&image, group.ImageID); res.Error != nil || image.Version == "" {
+		return best, false, nil
+	}
+
+	found := false
+	for _, v := range variants {
+		if versionMatches(image.Version, v.Version) && (!found || len(versionParts(v.Version)) > len(versionParts(best.Version))) {
+			best, found = v, true
+		}
+	}
+	return best, found, nil
+}
+
+func decodeKickstartVariants(m datatypes.JSON) ([]models.KickstartVariant, error) {
+	var variants []models.KickstartVariant
+	if len(m) == 0 || string(m) == "null" {
+		return variants, nil
+	}
+	if err := json.Unmarshal(m, &variants); err != nil {
+		return nil, fmt.Errorf("kickstart_variants must be a list of variants: %w", err)
+	}
+	return variants, nil
+}
+
+// validateKickstartVariants checks the versions and templates of the variants of a group
+func validateKickstartVariants(group models.Group) []models.KickstartIssue {
+	variants, err := decodeKickstartVariants(group.KickstartVariants)
+	if err != nil {
+		return []models.KickstartIssue{{Severity: severityError, Message: err.Error()}}
+	}
+
+	var issues []models.KickstartIssue
+	seen := map[string]bool{}
+	for _, v := range variants {
+		prefix := "variant " + v.Version + ": "
+		if len(versionParts(v.Version)) == 0 {
+			issues = append(issues, models.KickstartIssue{Severity: severityError, Message: fmt.Sprintf("variant %q: version must look like 8, 8.0 or 8.0.2", v.Version)})
+			continue
+		}
+		if seen[v.Version] {
+			issues = append(issues, models.KickstartIssue{Severity: severityError, Message: prefix + "specified more than once"})
+			continue
+		}
+		seen[v.Version] = true
+
+		content, err := kickstartTemplateContent(v.KickstartTemplateID, v.KickstartTemplateVersion)
+		if err != nil {
+			issues = append(issues, models.KickstartIssue{Severity: severityError, Message: prefix + err.Error()})
+			continue
+		}
+		for _, i := range validateKickstart(content, sampleHost(group)) {
+			i.Message = prefix + i.Message
+			issues = append(issues, i)
+		}
+	}
+	return issues
+}
+
+// SeedKickstartTemplates creates the built-in templates if they don't exist yet
+func SeedKickstartTemplates() {
+	seeds := map[string]string{defaultKickstartTemplate: defaultks}
+
+	files, err := fs.ReadDir(esxikickstart.Files, ".")
+	if err != nil {
+		logrus.Warning(err)
+	}
+	for _, f := range files {
+		b, err := fs.ReadFile(esxikickstart.Files, f.Name())
+		if err != nil {
+			logrus.Warning(err)
+			continue
+		}
+		seeds[strings.TrimSuffix(f.Name(), ".cfg")] = string(b)
+	}
+
+	for name, content := range seeds {
+		var n int64
+		if db.DB.Model(&models.KickstartTemplate{}).Where("name = ?", name).Count(&n); n > 0 {
+			updateBuiltInKickstartTemplate(name, content)
+			continue
+		}
+
+		item := models.KickstartTemplate{
+			KickstartTemplateForm: models.KickstartTemplateForm{
+				Name:        name,
+				Description: "shipped with go-via",
+			},
+			BuiltIn: true,
+		}
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			if res := tx.Create(&item); res.Error != nil {
+				return res.Error
+			}
+			_, err := addKickstartTemplateVersion(tx, &item, content, "go-via", "seeded", true)
+			return err
+		})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"name": name,
+				"err":  err,
+			}).Warning("could not seed kickstart template")
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"name": name,
+		}).Info("seeded kickstart template")
+	}
+}
+
+// updateBuiltInKickstartTemplate proposes the template shipped with this release as a new version,
+// it has to be approved like any other change
+func updateBuiltInKickstartTemplate(name string, content string) {
+	var item models.KickstartTemplate
+	if res := db.DB.Where("name = ? AND built_in", name).Limit(1).Find(&item); res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	var n int64
+	if db.DB.Model(&models.KickstartTemplateVersion{}).Where("template_id = ? AND content = ?", item.ID, content).Count(&n); n > 0 {
+		return
+	}
+
+	var version *models.KickstartTemplateVersion
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		version, err = addKickstartTemplateVersion(tx, &item, content, "go-via", "updated with go-via", false)
+		return err
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"name": name,
+			"err":  err,
+		}).Warning("could not update kickstart template")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"name":    name,
+		"version": version.Version,
+	}).Info("kickstart template updated with go-via, approve the new version to use it")
+}
@@ -1,41 +1,50 @@
 package api
 
 import (
-	"encoding/base64"
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strings"
 
-	"text/template"
-
 	"github.com/gin-gonic/gin"
+	ca "github.com/maxiepax/go-via/crypto"
 	"github.com/maxiepax/go-via/db"
 
 	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
 	"github.com/maxiepax/go-via/secrets"
 	"github.com/sirupsen/logrus"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
 	"gorm.io/gorm/clause"
 	//"github.com/davecgh/go-spew/spew"
 )
 
+var errKsUsed = errors.New("the kickstart url has already been used")
+
 var defaultks = `
 # Accept the VMware End User License Agreement
 vmaccepteula
 
 # Set the root password for the DCUI and Tech Support Mode
-rootpw {{ .password }}
+rootpw --iscrypted {{ .password }}
 
 {{ if .erasedisks }}
 # Remove ALL partitions
 clearpart --overwritevmfs --alldrives {{ end }}
 
-{{ if .bootdisk }}
-install --disk=/vmfs/devices/disks/{{.bootdisk}} --overwritevmfs --novmfsondisk {{ if not .legacycpu }} --forceunsupportedinstall {{ end }}
+{{ if .bootdisk_rules }}
+# Install on the disk selected by the boot disk rules of the group
+%include /tmp/bootdisk.cfg
+{{ else if .bootdisk }}
+install --disk=/vmfs/devices/disks/{{.bootdisk}} --overwritevmfs --novmfsondisk {{ if and .legacycpu (versionAtLeast .esxi_version "8.0") }} --forceunsupportedinstall {{ end }}
 {{ else }}
 # Install on the first local disk available on machine
-install --overwritevmfs {{ if not .createvmfs }} --novmfsondisk {{ end }} --firstdisk="localesx,usb,ahci,vmw_ahci,VMware" --forceunsupportedinstall
+install --overwritevmfs {{ if not .createvmfs }} --novmfsondisk {{ end }} --firstdisk="localesx,usb,ahci,vmw_ahci,VMware" {{ if and .legacycpu (versionAtLeast .esxi_version "8.0") }} --forceunsupportedinstall {{ end }}
 {{ end }}
 
 # Set the network to static on the first network adapter
@@ -43,11 +52,23 @@ network --bootproto=static --ip={{ .ip }} --gateway={{ .gateway }} --netmask={{
 
 reboot
 
+%pre --interpreter=busybox
+{{ .phonehome }} pre started
+{{ if .syslog_server }}
+# Send the installer log to go-via
+esxcli system syslog config set --loghost={{ .syslog_server }}
+esxcli system syslog reload
+{{ end }}
+
+%post --interpreter=busybox
+{{ .phonehome }} post finished 0
+
 %firstboot --interpreter=busybox
+{{ .phonehome }} firstboot started
 
 # Configure NTP
-{{ if .ntp }}
-esxcli system ntp set -e true -s {{ .ntp }}
+{{ if .group.NTP }}
+{{ join " " .ntp }} --enabled true
 {{ end }}
 
 
@@ -63,7 +84,7 @@ esxcli system hostname set --fqdn {{ .fqdn }}
 {{ if .ssh }}
 vim-cmd hostsvc/enable_ssh
 vim-cmd hostsvc/start_ssh
-system settings advanced set -o /UserVars/SuppressShellWarning -i 1
+esxcli system settings advanced set -o /UserVars/SuppressShellWarning -i 1
 {{ end }}
 
 # Syslog
@@ -79,34 +100,49 @@ esxcli network firewall refresh
 esxcli network vswitch standard portgroup set --vlan-id {{.vlan}}
 {{ end }}
 
+{{ if .certificate }}
+# Install the certificate issued by go-via for this host
+cat > /etc/vmware/ssl/rui.crt << 'VIA_EOF'
+{{ .certificate_pem }}VIA_EOF
+cat > /etc/vmware/ssl/rui.key << 'VIA_EOF'
+{{ .certificate_key }}VIA_EOF
+chmod 400 /etc/vmware/ssl/rui.key
+cat >> /etc/vmware/ssl/castore.pem << 'VIA_EOF'
+{{ .certificate_ca }}VIA_EOF
+{{ else }}
 # Ensure TLS certificate matches ESXi FQDN
 /sbin/generate-certificates
+{{ end }}
 /etc/init.d/hostd restart && /etc/init.d/vpxa restart && /etc/init.d/rhttpproxy restart
 `
 
-// func Ks(c *gin.Context) {
+// firstbootFinished is the last section of every kickstart that reports back to go-via. ESXi runs the %firstboot
+// sections in order, so the host is only completed once the scripts of its group and itself ran too
+const firstbootFinished = `
+# Report back to go-via, the host is completed once firstboot finished
+%%firstboot --interpreter=busybox
+%s firstboot finished 0
+`
+
+// Ks serves the kickstart of the host the signed url was issued for, every url can only be used once.
 func Ks(key string) func(c *gin.Context) {
 	return func(c *gin.Context) {
-		var item models.Host
-		host, _, _ := net.SplitHostPort(c.Request.RemoteAddr)
-
-		if res := db.DB.Preload(clause.Associations).Where("ip = ?", host).First(&item); res.Error != nil {
-			Error(c, http.StatusInternalServerError, res.Error) // 500
-			return
+		token, err := secrets.VerifyToken(c.Param("token"), "ks", key)
+		if err == nil && token.Nonce == "" {
+			err = fmt.Errorf("token is not single use")
 		}
-
-		options := models.GroupOptions{}
-		err := json.Unmarshal(item.Group.Options, &options)
-
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
-				"postconfig": "couldn't unmarshal group options",
-			}).Debug(item.IP)
+				"remote": c.ClientIP(),
+				"err":    err,
+			}).Warn("ks")
+			Error(c, http.StatusForbidden, err) // 403
 			return
 		}
 
-		if reimage := db.DB.Model(&item).Where("ip = ?", host).Update("reimage", false); reimage.Error != nil {
-			Error(c, http.StatusInternalServerError, reimage.Error) // 500
+		var item models.Host
+		if res := db.DB.Preload(clause.Associations).First(&item, token.HostID); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
 			return
 		}
 
@@ -117,70 +153,103 @@ func Ks(key string) func(c *gin.Context) {
 			}).Debug("ks")
 		}
 
-		logrus.Info("Disabling re-imaging for host to avoid re-install looping")
+		// hosts in groups with per host passwords get a new password on every reimage
+		password, err := rootPasswordHash(item.Group, key)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  item.ID,
+				"err": err,
+			}).Warn("ks")
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+		var cred *models.HostCredential
+		options, _ := groupOptions(item.Group)
+		if options.PerHostPassword {
+			newCred := newHostCredential(item, key)
+			cred = &newCred
+			password = cred.PasswordHash
+		}
 
-		//convert netmask from bit to long format.
-		nm := net.CIDRMask(item.Pool.Netmask, 32)
-		netmask := ipv4MaskString(nm)
-
-		//decrypt the password
-		decryptedPassword := secrets.Decrypt(item.Group.Password, key)
-
-		//split NTP
-		ntp := strings.Fields("esxcli system ntp set")
-		for _, k := range strings.Split(item.Group.NTP, ",") {
-			ntp = append(ntp, "--server", string(k))
-		}
-
-		//cleanup data to allow easier custom templating
-		data := map[string]interface{}{
-			"password":   decryptedPassword,
-			"ip":         item.IP,
-			"mac":        item.Mac,
-			"gateway":    item.Pool.Gateway,
-			"dns":        item.Group.DNS,
-			"ntp":        ntp,
-			"hostname":   item.Hostname,
-			"domain":     item.Domain,
-			"fqdn":       item.Hostname + "." + item.Domain,
-			"netmask":    netmask,
-			"via_server": laddrport,
-			"erasedisks": options.EraseDisks,
-			"ssh":        options.SSH,
-			"syslog":     item.Group.Syslog,
-			"bootdisk":   item.Group.BootDisk,
-			"vlan":       item.Group.Vlan,
-			"createvmfs": options.CreateVMFS,
-			"legacycpu":  options.AllowLegacyCPU,
-		}
-
-		ks := defaultks
-
-		// check if default ks has been overridden.
-		if item.Ks != "" {
-			dec, _ := base64.StdEncoding.DecodeString(item.Ks)
-			ks = string(dec)
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		report := reportURL(item, token.Nonce, scheme, c.Request.Host, key)
+
+		// the key of the host is only ever in this kickstart
+		var cert *ca.HostCertificate
+		if certificateDelivery(options) == deliverFirstboot {
+			if cert, err = issueHostCertificate(item); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":  item.ID,
+					"err": err,
+				}).Warn("ks")
+				Error(c, http.StatusInternalServerError, err) // 500
+				return
+			}
+		}
+
+		ks, err := renderKickstart(item, password, laddrport, report, cert)
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
-				"custom host ks": ks,
-			}).Debug("ks")
-		} else if item.Group.Ks != "" {
-			dec, _ := base64.StdEncoding.DecodeString(item.Group.Ks)
-			ks = string(dec)
+				"id":  item.ID,
+				"err": err,
+			}).Warn("ks")
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		// refuse to serve a kickstart the installer would choke on, the url stays valid until the template is fixed
+		issues := lintKickstart(ks)
+		for _, i := range issues {
 			logrus.WithFields(logrus.Fields{
-				"custom group ks": ks,
-			}).Debug("ks")
+				"id":       item.ID,
+				"line":     i.Line,
+				"severity": i.Severity,
+			}).Warn("ks: " + i.Message)
+		}
+		if hasKickstartErrors(issues) {
+			KickstartError(c, http.StatusInternalServerError, issues) // 500
+			return
 		}
 
-		t, err := template.New("").Parse(ks)
-		if err != nil {
-			logrus.Info(err)
+		// invalidate the url, only the first request gets the kickstart. a generated password is stored
+		// in the same transaction so the installer never gets a password that can't be retrieved
+		err = db.DB.Transaction(func(tx *gorm.DB) error {
+			used := tx.Model(&models.Host{}).Where("id = ? AND ks_nonce = ?", item.ID, token.Nonce).Updates(map[string]interface{}{"ks_nonce": "", "install_nonce": token.Nonce, "reimage": false})
+			if used.Error != nil {
+				return used.Error
+			}
+			if used.RowsAffected == 0 {
+				return errKsUsed
+			}
+			if cred != nil {
+				return storeHostCredential(tx, cred)
+			}
+			return nil
+		})
+		if errors.Is(err, errKsUsed) {
+			logrus.WithFields(logrus.Fields{
+				"id":     item.ID,
+				"remote": c.ClientIP(),
+			}).Warn("ks: refused already used kickstart url")
+			Error(c, http.StatusForbidden, err) // 403
 			return
 		}
-		err = t.Execute(c.Writer, data)
 		if err != nil {
-			logrus.Info(err)
+			Error(c, http.StatusInternalServerError, err) // 500
 			return
 		}
+		item.KsNonce = ""
+		item.InstallNonce = token.Nonce
+		item.Reimage = false
+		logrus.Info("Disabling re-imaging for host to avoid re-install looping")
+
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", ks)
+
+		// templates that phone home complete the host once firstboot finished, the others are completed right away
+		phonesHome := bytes.Contains(ks, []byte(report+"/stage"))
 
 		//debug ks.cfg output
 		//spew.Dump(t.Execute(os.Stdout, data))
@@ -192,19 +261,217 @@ func Ks(key string) func(c *gin.Context) {
 			"host":    item.Hostname,
 			"message": "served ks.cfg file",
 		}).Info("ks")
-		logrus.WithFields(logrus.Fields{
-			"id":           item.ID,
-			"percentage":   50,
-			"progresstext": "kickstart",
-		}).Info("progress")
-		item.Progress = 50
-		item.Progresstext = "kickstart"
-		db.DB.Save(&item)
+		if host, err := provisioning.Transition(item.ID, provisioning.Installing, "kickstart", c.ClientIP(), ""); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  item.ID,
+				"err": err,
+			}).Warn("ks")
+		} else {
+			item.State = host.State
+			item.Progress = host.Progress
+			item.Progresstext = host.Progresstext
+		}
+
+		if !phonesHome {
+			queuePostConfig(item)
+		}
+	}
+}
+
+// renderKickstart renders the kickstart of the host with the given root password. The installer reports
+// back to reportURL, which may be empty. Without cert, placeholders take the place of the certificate. It has
+// no side effects.
+func renderKickstart(item models.Host, password string, viaServer net.Addr, reportURL string, cert *ca.HostCertificate) ([]byte, error) {
+	data, err := kickstartData(item, password, viaServer, reportURL)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		data["certificate_pem"] = cert.Certificate
+		data["certificate_key"] = cert.Key
+		data["certificate_ca"] = cert.CA
+	}
+
+	ks, err := resolveKickstart(item)
+	if err != nil {
+		return nil, err
+	}
+
+	return completeKickstart(ks, item, data)
+}
+
+// completeKickstart renders the template and appends the generated boot disk selection, the scripts of the host
+// and the final report of firstboot
+func completeKickstart(ks string, item models.Host, data map[string]interface{}) ([]byte, error) {
+	out, err := executeKickstart(ks, data)
+	if err != nil {
+		return nil, err
+	}
+
+	pre, err := bootDiskPre(item, data)
+	if err != nil {
+		return nil, err
+	}
+	out = append(out, pre...)
+
+	scripts, err := kickstartScripts(item)
+	if err != nil {
+		return nil, err
+	}
+	out, err = spliceScripts(out, scripts, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if report, _ := data["report_url"].(string); report != "" && bytes.Contains(out, []byte(report+"/stage")) {
+		if len(out) > 0 && out[len(out)-1] != '\n' {
+			out = append(out, '\n')
+		}
+		out = append(out, fmt.Sprintf(firstbootFinished, data["phonehome"])...)
+	}
+	return out, nil
+}
+
+// kickstartData returns the values that are available to kickstart templates
+func kickstartData(item models.Host, password string, viaServer net.Addr, reportURL string) (map[string]interface{}, error) {
+	options, err := groupOptions(item.Group)
+	if err != nil {
+		return nil, err
+	}
+
+	//convert netmask from bit to long format.
+	nm := net.CIDRMask(item.Pool.Netmask, 32)
+	netmask := ipv4MaskString(nm)
+
+	//split NTP
+	ntp := strings.Fields("esxcli system ntp set")
+	for _, k := range strings.Split(item.Group.NTP, ",") {
+		ntp = append(ntp, "--server", string(k))
+	}
+
+	//cleanup data to allow easier custom templating
+	data := map[string]interface{}{
+		"password":   password,
+		"ip":         item.IP,
+		"mac":        item.Mac,
+		"gateway":    item.Pool.Gateway,
+		"dns":        item.Group.DNS,
+		"ntp":        ntp,
+		"hostname":   item.Hostname,
+		"domain":     item.Domain,
+		"fqdn":       item.Hostname + "." + item.Domain,
+		"netmask":    netmask,
+		"via_server": viaServer,
+		"erasedisks": options.EraseDisks,
+		"ssh":        options.SSH,
+		"syslog":     item.Group.Syslog,
+		"bootdisk":   item.Group.BootDisk,
+		"vlan":       item.Group.Vlan,
+		"createvmfs": options.CreateVMFS,
+		"legacycpu":  options.AllowLegacyCPU,
+		"report_url": reportURL,
+	}
+
+	// with boot disk rules the install command is written to /tmp/bootdisk.cfg by a generated %pre script
+	rules, err := decodeBootDiskRules(item.Group.BootDiskRules)
+	if err != nil {
+		return nil, err
+	}
+	data["bootdisk_rules"] = len(rules) > 0
 
-		go ProvisioningWorker(item, key)
+	// the command to report the progress of the installation, e.g. {{ .phonehome }} firstboot started. the
+	// final report of firstboot is appended by completeKickstart
+	data["phonehome"] = phoneHome(reportURL)
 
-		logrus.Info("Started worker")
+	// the built-in syslog receiver, the default syslog target if the group has none
+	data["syslog_server"] = syslogServer(viaServer)
+	if item.Group.Syslog == "" && SyslogDefault {
+		data["syslog"] = data["syslog_server"]
 	}
+
+	// the certificate is issued when the installer fetches the kickstart, see renderKickstart
+	data["certificate"] = certificateDelivery(options) == deliverFirstboot
+	data["certificate_pem"] = "# certificate issued by go-via\n"
+	data["certificate_key"] = "# key issued by go-via\n"
+	data["certificate_ca"] = "# CA of go-via\n"
+
+	// site specific values, the host overrides the group which overrides the pool
+	metadata := map[string]interface{}{}
+	for _, m := range []datatypes.JSON{item.Pool.Metadata, item.Group.Metadata, item.Metadata} {
+		values, err := decodeMetadata(m)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range values {
+			metadata[k] = v
+		}
+	}
+	data["metadata"] = metadata
+
+	// the full objects, without credentials
+	var image models.Image
+	if item.Group.ImageID != 0 {
+		db.DB.First(&image, item.Group.ImageID)
+	}
+	group := item.Group
+	group.Password = ""
+	group.IloPassword = ""
+	host := item
+	host.Group = group
+	host.IloPassword = ""
+	host.KsNonce = ""
+	host.InstallNonce = ""
+	data["host"] = host
+	data["group"] = group
+	data["pool"] = item.Pool
+	data["image"] = image
+	data["esxi_version"] = image.Version
+	data["esxi_build"] = image.Build
+
+	return data, nil
+}
+
+func groupOptions(group models.Group) (models.GroupOptions, error) {
+	options := models.GroupOptions{}
+	if len(group.Options) > 0 {
+		if err := json.Unmarshal(group.Options, &options); err != nil {
+			return options, fmt.Errorf("could not unmarshal group options: %w", err)
+		}
+	}
+	return options, nil
+}
+
+// decodeMetadata returns the values of a metadata field, which has to be a json object
+func decodeMetadata(m datatypes.JSON) (map[string]interface{}, error) {
+	values := map[string]interface{}{}
+	if len(m) == 0 || string(m) == "null" {
+		return values, nil
+	}
+	if err := json.Unmarshal(m, &values); err != nil {
+		return nil, fmt.Errorf("metadata must be a json object: %w", err)
+	}
+	return values, nil
+}
+
+func executeKickstart(ks string, data map[string]interface{}) ([]byte, error) {
+	t, err := parseKickstart(ks)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return cryptRootpw(buf.Bytes()), nil
+}
+
+var rootpwRe = regexp.MustCompile(`(?m)^(\s*rootpw\s+)(\$[156]\$\S+\s*)$`)
+
+// cryptRootpw adds --iscrypted to rootpw in templates written before the password was hashed,
+// otherwise the hash would become the password
+func cryptRootpw(ks []byte) []byte {
+	return rootpwRe.ReplaceAll(ks, []byte("${1}--iscrypted ${2}"))
 }
 
 func ipv4MaskString(m []byte) string {
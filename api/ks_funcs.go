@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// kickstartFuncs are the helper functions available to kickstart templates
+var kickstartFuncs = template.FuncMap{
+	"split":     func(sep string, s string) []string { return strings.Split(s, sep) },
+	"join":      ksJoin,
+	"default":   ksDefault,
+	"lower":     strings.ToLower,
+	"upper":     strings.ToUpper,
+	"trim":      strings.TrimSpace,
+	"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64dec":    ksB64dec,
+	"ipadd":     ksIPAdd,
+	"netmask":   ksNetmask,
+	"network":   ksNetwork,
+	"broadcast": ksBroadcast,
+	"cidrhost":  ksCidrHost,
+	// versionAtLeast .esxi_version "8.0"
+	"versionAtLeast": versionAtLeast,
+}
+
+func parseKickstart(ks string) (*template.Template, error) {
+	return template.New("").Funcs(kickstartFuncs).Parse(ks)
+}
+
+// join "," .list, works for string lists as well as lists from metadata
+func ksJoin(sep string, list interface{}) string {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Sprint(list)
+	}
+	s := make([]string, v.Len())
+	for i := range s {
+		s[i] = fmt.Sprint(v.Index(i).Interface())
+	}
+	return strings.Join(s, sep)
+}
+
+// .value | default "fallback", returns the fallback if value is missing or empty
+func ksDefault(def interface{}, value ...interface{}) interface{} {
+	if len(value) == 0 || value[0] == nil {
+		return def
+	}
+	v := reflect.ValueOf(value[0])
+	if v.IsZero() {
+		return def
+	}
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		if v.Len() == 0 {
+			return def
+		}
+	}
+	return value[0]
+}
+
+func ksB64dec(s string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	return string(b), err
+}
+
+// ipadd "10.0.0.10" 2 returns 10.0.0.12
+func ksIPAdd(ip string, n interface{}) (string, error) {
+	i, err := ksInt(n)
+	if err != nil {
+		return "", err
+	}
+	v, err := ipv4ToInt(ip)
+	if err != nil {
+		return "", err
+	}
+	return intToIPv4(uint32(int64(v) + int64(i))), nil
+}
+
+// netmask 24 returns 255.255.255.0
+func ksNetmask(prefix interface{}) (string, error) {
+	p, err := ksInt(prefix)
+	if err != nil {
+		return "", err
+	}
+	if p < 0 || p > 32 {
+		return "", fmt.Errorf("invalid prefix length %d", p)
+	}
+	return ipv4MaskString(net.CIDRMask(p, 32)), nil
+}
+
+// network "10.0.0.10" 24 returns 10.0.0.0
+func ksNetwork(ip string, prefix interface{}) (string, error) {
+	n, err := ksIPNet(ip, prefix)
+	if err != nil {
+		return "", err
+	}
+	return n.IP.String(), nil
+}
+
+// broadcast "10.0.0.10" 24 returns 10.0.0.255
+func ksBroadcast(ip string, prefix interface{}) (string, error) {
+	n, err := ksIPNet(ip, prefix)
+	if err != nil {
+		return "", err
+	}
+	return intToIPv4(binary.BigEndian.Uint32(n.IP.To4()) | ^binary.BigEndian.Uint32(n.Mask)), nil
+}
+
+// cidrhost "10.0.0.0/24" 5 returns 10.0.0.5, negative numbers count from the end of the network
+func ksCidrHost(cidr string, n interface{}) (string, error) {
+	i, err := ksInt(n)
+	if err != nil {
+		return "", err
+	}
+	_, ipnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return "", err
+	}
+	if ipnet.IP.To4() == nil {
+		return "", fmt.Errorf("%s is not an ipv4 network", cidr)
+	}
+	ones, bits := ipnet.Mask.Size()
+	size := int64(1) << uint(bits-ones)
+	if i < 0 {
+		i += int(size)
+	}
+	if i < 0 || int64(i) >= size {
+		return "", fmt.Errorf("host %d is outside of %s", n, cidr)
+	}
+	return intToIPv4(binary.BigEndian.Uint32(ipnet.IP.To4()) + uint32(i)), nil
+}
+
+func ksIPNet(ip string, prefix interface{}) (*net.IPNet, error) {
+	p, err := ksInt(prefix)
+	if err != nil {
+		return nil, err
+	}
+	_, n, err := net.ParseCIDR(ip + "/" + strconv.Itoa(p))
+	if err != nil {
+		return nil, err
+	}
+	if n.IP.To4() == nil {
+		return nil, fmt.Errorf("%s is not an ipv4 address", ip)
+	}
+	return n, nil
+}
+
+// ksInt accepts the numbers from templates, metadata and form values
+func ksInt(n interface{}) (int, error) {
+	switch v := n.(type) {
+	case int:
+		return v, nil
+	case int32:
+		return int(v), nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	case json.Number:
+		i, err := v.Int64()
+		return int(i), err
+	case string:
+		return strconv.Atoi(v)
+	}
+	return 0, fmt.Errorf("%v is not a number", n)
+}
+
+func ipv4ToInt(ip string) (uint32, error) {
+	v := net.ParseIP(ip).To4()
+	if v == nil {
+		return 0, fmt.Errorf("%s is not an ipv4 address", ip)
+	}
+	return binary.BigEndian.Uint32(v), nil
+}
+
+func intToIPv4(v uint32) string {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, v)
+	return ip.String()
+}
@@ -0,0 +1,392 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+)
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// the commands the ESXi installer understands and the flags they accept
+var ksCommands = map[string][]string{
+	"accepteula":       {},
+	"vmaccepteula":     {},
+	"clearpart":        {"--drives", "--alldrives", "--ignoredrives", "--overwritevmfs", "--firstdisk"},
+	"dryrun":           {},
+	"install":          {"--disk", "--drive", "--firstdisk", "--ignoressd", "--overwritevsan", "--overwritevmfs", "--preservevmfs", "--novmfsondisk", "--forceunsupportedinstall"},
+	"installorupgrade": {"--disk", "--drive", "--firstdisk", "--ignoressd", "--overwritevsan", "--overwritevmfs", "--forcemigrate", "--forceunsupportedinstall"},
+	"upgrade":          {"--disk", "--drive", "--firstdisk", "--deletecosvmdk", "--forceunsupportedinstall"},
+	"include":          {},
+	"keyboard":         {},
+	"serialnum":        {"--esx"},
+	"vmserialnum":      {"--esx"},
+	"network":          {"--bootproto", "--device", "--ip", "--gateway", "--nameserver", "--netmask", "--hostname", "--vlanid", "--addvmportgroup"},
+	"paranoid":         {},
+	"part":             {"--ondisk", "--ondrive", "--onfirstdisk"},
+	"partition":        {"--ondisk", "--ondrive", "--onfirstdisk"},
+	"reboot":           {"--noeject"},
+	"rootpw":           {"--iscrypted"},
+}
+
+// commands that may be given more than once
+var ksRepeatable = map[string]bool{
+	"part":      true,
+	"partition": true,
+	"include":   true,
+}
+
+// the sections that contain scripts instead of commands
+var ksSections = map[string][]string{
+	"%pre":       {"--interpreter", "--ignorefailure"},
+	"%post":      {"--interpreter", "--ignorefailure", "--timeout"},
+	"%firstboot": {"--interpreter"},
+}
+
+// esxcli namespaces, a script line starting with one of them is most likely missing esxcli
+var esxcliNamespaces = map[string]bool{
+	"device":   true,
+	"hardware": true,
+	"iscsi":    true,
+	"network":  true,
+	"software": true,
+	"storage":  true,
+	"system":   true,
+	"vsan":     true,
+}
+
+var ksInstallCommands = []string{"install", "installorupgrade", "upgrade"}
+
+// templates are test-rendered with the hash of a sample password
+var samplePasswordHash = secrets.HashPassword("sample")
+
+// the report url templates are test-rendered with
+const sampleReportURL = "https://192.0.2.1:8443/report/" + previewToken
+
+// template: :12: function "foo" not defined
+var templateLineRe = regexp.MustCompile(`template: [^:]*:(\d+)`)
+
+// validateKickstart parses the template, test-renders it for the host and lints the output
+func validateKickstart(ks string, item models.Host) []models.KickstartIssue {
+	data, err := kickstartData(item, samplePasswordHash, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 8443}, sampleReportURL)
+	if err != nil {
+		return []models.KickstartIssue{{Severity: severityError, Message: err.Error()}}
+	}
+
+	out, err := completeKickstart(ks, item, data)
+	if err != nil {
+		return []models.KickstartIssue{templateIssue(err)}
+	}
+
+	issues := lintKickstart(out)
+	if data["bootdisk_rules"] == true && !bytes.Contains(out, []byte("include "+bootDiskInclude)) {
+		issues = append(issues, models.KickstartIssue{Severity: severityError, Message: "the group has boot disk rules, the kickstart has to %include " + bootDiskInclude})
+	}
+	return issues
+}
+
+// validateGroupKickstart validates the kickstart a host in the group would get
+func validateGroupKickstart(group models.Group) []models.KickstartIssue {
+	host := sampleHost(group)
+	// values from the metadata of the pool are available to the template as well
+	var pool models.Pool
+	if group.PoolID != 0 && db.DB.First(&pool, group.PoolID).Error == nil {
+		host.Pool.Metadata = pool.Metadata
+	}
+	ks, err := resolveKickstart(host)
+	if err != nil {
+		return []models.KickstartIssue{{Severity: severityError, Message: err.Error()}}
+	}
+	return validateKickstart(ks, host)
+}
+
+// sampleHost is the host templates are test-rendered for when they are saved
+func sampleHost(group models.Group) models.Host {
+	return models.Host{
+		HostForm: models.HostForm{
+			IP:       "192.0.2.10",
+			Mac:      "00:50:56:00:00:01",
+			Hostname: "esx01",
+			Domain:   "example.com",
+		},
+		Pool: models.Pool{
+			PoolForm: models.PoolForm{
+				Netmask: 24,
+				Gateway: "192.0.2.1",
+			},
+		},
+		Group: group,
+	}
+}
+
+func templateIssue(err error) models.KickstartIssue {
+	issue := models.KickstartIssue{Severity: severityError, Message: err.Error()}
+	if m := templateLineRe.FindStringSubmatch(err.Error()); m != nil {
+		issue.Line, _ = strconv.Atoi(m[1])
+	}
+	return issue
+}
+
+// lintKickstart checks a rendered kickstart for commands and flags the ESXi installer doesn't accept,
+// and for missing or conflicting directives
+func lintKickstart(ks []byte) []models.KickstartIssue {
+	var issues []models.KickstartIssue
+	add := func(line int, severity string, format string, a ...interface{}) {
+		issues = append(issues, models.KickstartIssue{Line: line, Severity: severity, Message: fmt.Sprintf(format, a...)})
+	}
+
+	seen := map[string]int{}
+	section := ""
+	// commands can come from an included file, e.g. the install command of the boot disk rules
+	included := false
+	n := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(ks))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.Contains(line, "<no value>") {
+			add(n, severityError, "the template references a value that doesn't exist")
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := splitKickstartLine(line)
+		name := fields[0]
+
+		if strings.HasPrefix(name, "%") {
+			switch {
+			case name == "%end":
+				section = ""
+			case name == "%include":
+				included = true
+			case ksSections[name] != nil:
+				section = name
+				lintFlags(name, fields[1:], ksSections[name], n, add)
+				for _, f := range fields[1:] {
+					if k, v, _ := strings.Cut(f, "="); k == "--interpreter" && v != "busybox" && v != "python" {
+						add(n, severityError, "%s: unsupported interpreter %q, use busybox or python", name, v)
+					}
+				}
+			default:
+				add(n, severityError, "unknown section %s", name)
+			}
+			continue
+		}
+
+		// everything in a section is part of the script
+		if section != "" {
+			if esxcliNamespaces[name] && len(fields) > 2 {
+				add(n, severityWarning, "%s: %q looks like an esxcli command without the esxcli prefix", section, name+" "+fields[1])
+			}
+			continue
+		}
+
+		flags, ok := ksCommands[name]
+		if !ok {
+			add(n, severityError, "unknown command %q", name)
+			continue
+		}
+		if prev, ok := seen[name]; ok && !ksRepeatable[name] {
+			add(n, severityError, "%s is already specified on line %d", name, prev)
+			continue
+		}
+		seen[name] = n
+		if name == "include" {
+			included = true
+		}
+
+		lintFlags(name, fields[1:], flags, n, add)
+		lintCommand(name, fields[1:], n, add)
+	}
+	if err := scanner.Err(); err != nil {
+		add(n, severityError, "%s", err)
+	}
+
+	if n == 0 || len(seen) == 0 {
+		add(0, severityError, "the kickstart is empty")
+		return issues
+	}
+
+	if _, ok := seen["vmaccepteula"]; !ok {
+		if _, ok := seen["accepteula"]; !ok {
+			add(0, severityError, "vmaccepteula is required")
+		}
+	}
+	if _, ok := seen["rootpw"]; !ok {
+		add(0, severityError, "rootpw is required")
+	}
+	var install []string
+	for _, c := range ksInstallCommands {
+		if _, ok := seen[c]; ok {
+			install = append(install, c)
+		}
+	}
+	switch {
+	case len(install) == 0 && !included:
+		add(0, severityError, "one of install, installorupgrade or upgrade is required")
+	case len(install) > 1:
+		add(seen[install[1]], severityError, "%s conflicts with %s", install[1], install[0])
+	}
+	if _, ok := seen["network"]; !ok {
+		add(0, severityWarning, "no network command, the host will use dhcp on the first adapter")
+	}
+	if _, ok := seen["reboot"]; !ok {
+		add(0, severityWarning, "no reboot command, the installer will wait for confirmation")
+	}
+
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Line < issues[j].Line })
+	return issues
+}
+
+func lintFlags(name string, args []string, allowed []string, line int, add func(int, string, string, ...interface{})) {
+	for _, a := range args {
+		if !strings.HasPrefix(a, "--") {
+			continue
+		}
+		k, v, hasValue := strings.Cut(a, "=")
+		if !containsString(allowed, k) {
+			add(line, severityWarning, "%s: unknown flag %s", name, k)
+			continue
+		}
+		if hasValue && v == "" {
+			add(line, severityWarning, "%s: %s has an empty value", name, k)
+		}
+	}
+}
+
+func lintCommand(name string, args []string, line int, add func(int, string, string, ...interface{})) {
+	flags := map[string]string{}
+	var positional []string
+	for _, a := range args {
+		if strings.HasPrefix(a, "--") {
+			k, v, _ := strings.Cut(a, "=")
+			flags[k] = v
+		} else {
+			positional = append(positional, a)
+		}
+	}
+	has := func(k string) bool {
+		_, ok := flags[k]
+		return ok
+	}
+
+	switch name {
+	case "rootpw":
+		if len(positional) == 0 {
+			add(line, severityError, "rootpw: a password is required")
+		} else if has("--iscrypted") && !secrets.IsCrypted(positional[0]) {
+			add(line, severityError, "rootpw: --iscrypted expects a crypt hash")
+		}
+	case "install", "installorupgrade", "upgrade":
+		targets := 0
+		for _, k := range []string{"--disk", "--drive", "--firstdisk"} {
+			if has(k) {
+				targets++
+			}
+		}
+		if targets == 0 {
+			add(line, severityError, "%s: one of --disk, --drive or --firstdisk is required", name)
+		}
+		if targets > 1 {
+			add(line, severityError, "%s: --disk, --drive and --firstdisk are mutually exclusive", name)
+		}
+		if has("--overwritevmfs") && has("--preservevmfs") {
+			add(line, severityError, "%s: --overwritevmfs conflicts with --preservevmfs", name)
+		}
+	case "network":
+		bootproto, ok := flags["--bootproto"]
+		if !ok {
+			bootproto = "dhcp"
+		}
+		switch bootproto {
+		case "dhcp":
+		case "static":
+			for _, k := range []string{"--ip", "--netmask"} {
+				if flags[k] == "" {
+					add(line, severityError, "network: %s is required with --bootproto=static", k)
+				}
+			}
+		default:
+			add(line, severityError, "network: unsupported --bootproto %q, use dhcp or static", bootproto)
+		}
+		for _, k := range []string{"--ip", "--gateway", "--netmask"} {
+			if v := flags[k]; v != "" && net.ParseIP(v).To4() == nil {
+				add(line, severityError, "network: %s %q is not an ipv4 address", k, v)
+			}
+		}
+		if v := flags["--vlanid"]; v != "" {
+			if id, err := strconv.Atoi(v); err != nil || id < 0 || id > 4095 {
+				add(line, severityError, "network: --vlanid %q must be between 0 and 4095", v)
+			}
+		}
+	}
+}
+
+// splitKickstartLine splits a line into fields, respecting quoted values
+func splitKickstartLine(line string) []string {
+	var fields []string
+	var cur strings.Builder
+	var quote rune
+	inField := false
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inField = true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, cur.String())
+				cur.Reset()
+				inField = false
+			}
+		default:
+			cur.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, cur.String())
+	}
+	return fields
+}
+
+func containsString(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+func hasKickstartErrors(issues []models.KickstartIssue) bool {
+	for _, i := range issues {
+		if i.Severity == severityError {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,222 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/scheduling"
+	"gorm.io/gorm"
+)
+
+// ListMaintenanceWindows Get a list of all maintenance windows
+// @Summary Get all maintenance windows
+// @Description With if they are open, and the next times they open.
+// @Tags maintenance_windows
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.MaintenanceWindow
+// @Failure 500 {object} models.APIError
+// @Router /maintenance_windows [get]
+func ListMaintenanceWindows(c *gin.Context) {
+	var items []models.MaintenanceWindow
+	if res := db.DB.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	for i := range items {
+		scheduling.WindowUpcoming(&items[i])
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetMaintenanceWindow Get an existing maintenance window
+// @Summary Get an existing maintenance window
+// @Tags maintenance_windows
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Maintenance window ID"
+// @Success 200 {object} models.MaintenanceWindow
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /maintenance_windows/{id} [get]
+func GetMaintenanceWindow(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.MaintenanceWindow
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	scheduling.WindowUpcoming(&item)
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateMaintenanceWindow Create a new maintenance window
+// @Summary Create a new maintenance window
+// @Description Once a group, or all groups, have a window its hosts are only served DHCP and PXE to reimage while one of the windows is open.
+// @Tags maintenance_windows
+// @Accept  json
+// @Produce  json
+// @Param item body models.MaintenanceWindowForm true "Add a maintenance window"
+// @Success 200 {object} models.MaintenanceWindow
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /maintenance_windows [post]
+func CreateMaintenanceWindow(c *gin.Context) {
+	var form models.MaintenanceWindowForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if form.Name == "" {
+		Error(c, http.StatusBadRequest, fmt.Errorf("name is required")) // 400
+		return
+	}
+	if err := validateMaintenanceWindow(form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.MaintenanceWindow{MaintenanceWindowForm: form}
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	scheduling.WindowUpcoming(&item)
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// UpdateMaintenanceWindow Update an existing maintenance window
+// @Summary Update an existing maintenance window
+// @Tags maintenance_windows
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Maintenance window ID"
+// @Param  item body models.MaintenanceWindowForm true "Update a maintenance window"
+// @Success 200 {object} models.MaintenanceWindow
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /maintenance_windows/{id} [patch]
+func UpdateMaintenanceWindow(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the form data
+	var form models.MaintenanceWindowForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.MaintenanceWindow
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Merge the item and the form data
+	if err := mergo.Merge(&item, models.MaintenanceWindow{MaintenanceWindowForm: form}, mergo.WithOverride); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	if err := validateMaintenanceWindow(item.MaintenanceWindowForm); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Save it
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	scheduling.WindowUpcoming(&item)
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteMaintenanceWindow Remove an existing maintenance window
+// @Summary Remove an existing maintenance window
+// @Tags maintenance_windows
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Maintenance window ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /maintenance_windows/{id} [delete]
+func DeleteMaintenanceWindow(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.MaintenanceWindow
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+func validateMaintenanceWindow(form models.MaintenanceWindowForm) error {
+	if form.GroupID.Valid {
+		if res := db.DB.First(&models.Group{}, form.GroupID.Int32); res.Error != nil {
+			return fmt.Errorf("group %d not found", form.GroupID.Int32)
+		}
+	}
+	if form.Cron == "" {
+		return fmt.Errorf("cron is required")
+	}
+	if _, err := scheduling.Parse(form.Cron, form.Timezone); err != nil {
+		return err
+	}
+	if form.Duration <= 0 {
+		return fmt.Errorf("duration must be at least a minute")
+	}
+	return nil
+}
@@ -120,6 +120,11 @@ func CreatePool(c *gin.Context) {
 		return
 	}
 
+	if _, err := decodeMetadata(form.Metadata); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	item := models.Pool{PoolForm: form}
 
 	if res := db.DB.Create(&item); res.Error != nil {
@@ -256,6 +261,11 @@ func UpdatePool(c *gin.Context) {
 		return
 	}
 
+	if _, err := decodeMetadata(form.Metadata); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
 	// Load the item
 	var item models.Pool
 	if res := db.DB.First(&item, id); res.Error != nil {
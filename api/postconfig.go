@@ -1,19 +1,21 @@
 package api
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"net"
 	"net/http"
-
-	//"net/url"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/esxi"
+	"github.com/maxiepax/go-via/jobs"
 	"github.com/maxiepax/go-via/models"
-
-	//"github.com/maxiepax/go-via/secrets"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/maxiepax/go-via/webhooks"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm/clause"
 )
@@ -32,7 +34,7 @@ func PostConfig(key string) func(c *gin.Context) {
 
 		logrus.Info("ks config done!")
 
-		go ProvisioningWorker(item, key)
+		queuePostConfig(item)
 	}
 }
 
@@ -55,101 +57,80 @@ func PostConfigID(key string) func(c *gin.Context) {
 
 		logrus.Info("Manual PostConfig of host" + item.Hostname + "started!")
 
-		go ProvisioningWorker(item, key)
+		queuePostConfig(item)
 	}
 }
 
-func ProvisioningWorker(item models.Host, key string) {
+// the interval at which the worker tries to reach the vSphere API of a host that is still booting
+var postConfigRetry = 10 * time.Second
+
+// JobPostConfig is the job that completes a host once ESXi is up
+const JobPostConfig = "postconfig"
+
+// RegisterJobs registers the handlers of the jobs of the api
+func RegisterJobs(key string) {
+	jobs.Register(JobPostConfig, func(ctx context.Context, job models.Job) error {
+		var item models.Host
+		if res := db.DB.Preload(clause.Associations).First(&item, job.HostID.Int32); res.Error != nil {
+			return jobs.Permanent(res.Error)
+		}
+		return ProvisioningWorker(ctx, item, key, jobs.LastAttempt(job))
+	}, jobs.Options{MaxAttempts: 3, Backoff: time.Minute})
+}
+
+// queuePostConfig queues the post-config of a host, a host that is already queued isn't queued twice
+func queuePostConfig(item models.Host) {
+	job, err := jobs.Enqueue(nil, JobPostConfig, item.ID, nil)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"id":  item.ID,
+			"err": err,
+		}).Error("postconfig")
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"id":  item.ID,
+		"job": job.ID,
+	}).Debug("postconfig queued")
+}
+
+// ProvisioningWorker completes a host. The host is failed when the last attempt fails, earlier attempts are retried.
+func ProvisioningWorker(ctx context.Context, item models.Host, key string, lastAttempt bool) error {
 
 	//create empty model and load it with the json content from database
-	options := models.GroupOptions{}
-	err := json.Unmarshal(item.Group.Options, &options)
+	options, err := groupOptions(item.Group)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"postconfig": "couldn't unmarshal group options",
 		}).Debug(item.IP)
-		return
+		return jobs.Permanent(err)
 	}
 	logrus.WithFields(logrus.Fields{
 		"Started worker for ": item.Hostname,
 	}).Debug("host")
 
-	// decrypt login password
-	//decryptedPassword := secrets.Decrypt(item.Group.Password, key)
+	if err := workerTransition(&item, provisioning.Postconfig); err != nil {
+		return jobs.Permanent(err)
+	}
 
-	// connection info
-	/*
-		url := &url.URL{
-			Scheme: "https",
-			Host:   item.IP,
-			Path:   "sdk",
-			User:   url.UserPassword("root", decryptedPassword),
+	if err := postConfigure(ctx, item, options, key); err != nil {
+		// interrupted by a shutdown or cancelled, the host is left as it is
+		if ctx.Err() != nil {
+			return err
 		}
-	*/
 
-	logrus.WithFields(logrus.Fields{
-		"id":           item.ID,
-		"percentage":   75,
-		"progresstext": "customization",
-	}).Info("progress")
-	item.Progress = 75
-	item.Progresstext = "customization"
-	db.DB.Save(&item)
-
-	// ensure that host has enough time to boot, and for SOAP API to respond
-	/*
-		var c *govmomi.Client
-
-		ctx := context.Background()
-		i := 1
-		timeout := 360
-
-		for {
-			if i > timeout {
-				logrus.WithFields(logrus.Fields{
-					"IP":     item.IP,
-					"status": "timeout exceeded, failing postconfig",
-				}).Info("postconfig")
-				return
-			}
-
-			if res := db.DB.First(&item, item.ID); res.Error != nil {
-				logrus.WithFields(logrus.Fields{
-					"IP":  item.IP,
-					"err": res.Error,
-				}).Error("postconfig failed to read state")
-				return
-			}
-
-			if item.Progress == 0 {
-				logrus.WithFields(logrus.Fields{
-					"IP": item.IP,
-				}).Error("postconfig terminated")
-				return
-			}
-
-			c, err = govmomi.NewClient(ctx, url, true)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"IP":        item.IP,
-					"status":    "Hosts SOAP API not ready yet, retrying",
-					"retry":     i,
-					"retry max": timeout,
-				}).Info("postconfig")
-				logrus.WithFields(logrus.Fields{
-					"IP":        item.IP,
-					"status":    "Hosts SOAP API not ready yet, retrying",
-					"retry":     i,
-					"retry max": timeout,
-					"err":       err,
-				}).Debug("postconfig")
-				i += 1
-				<-time.After(time.Second * 10)
-				continue
-			}
-			break
+		logrus.WithFields(logrus.Fields{
+			"IP":  item.IP,
+			"err": err,
+		}).Error("postconfig")
+
+		// the watchdog may already have failed or requeued the host
+		var current models.Host
+		if res := db.DB.First(&current, item.ID); res.Error == nil && current.State == provisioning.Postconfig && lastAttempt {
+			provisioning.Transition(item.ID, provisioning.Failed, "postconfig", "go-via", err.Error())
 		}
-	*/
+		return err
+	}
 
 	//postconfig completed
 	logrus.WithFields(logrus.Fields{
@@ -157,14 +138,9 @@ func ProvisioningWorker(item models.Host, key string) {
 		"postconfig": "postconfig completed",
 	}).Info("postconfig")
 
-	logrus.WithFields(logrus.Fields{
-		"id":           item.ID,
-		"percentage":   100,
-		"progresstext": "completed",
-	}).Info("progress")
-	item.Progress = 100
-	item.Progresstext = "completed"
-	db.DB.Save(&item)
+	if err := workerTransition(&item, provisioning.Ready); err != nil {
+		return jobs.Permanent(err)
+	}
 
 	//send callback if set
 	if item.Group.CallbackURL != "" {
@@ -173,44 +149,113 @@ func ProvisioningWorker(item models.Host, key string) {
 			logrus.WithFields(logrus.Fields{
 				"postconfig": err,
 			}).Info("")
-			return
 		}
 	}
-
+	return nil
 }
 
-func callback(url string, data models.Host) error {
-	//remove password
-	data.Group.Password = ""
-	//convert model to json
-	json_data, err := json.Marshal(data)
+// postConfigure waits for the vSphere API of the host, verifies what the kickstart configured, applies
+// the post-config of the group, makes sure the host has its certificate, runs the readiness checks and adds the host to its vCenter. It gives up when the postconfig stage times out.
+func postConfigure(ctx context.Context, item models.Host, options models.GroupOptions, key string) error {
+	timeout := provisioning.Timeout(options, provisioning.Postconfig)
+	if timeout == 0 {
+		timeout = time.Duration(provisioning.DefaultTimeouts[provisioning.Postconfig]) * time.Minute
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	password, err := hostPassword(item, key)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"postconfig": err,
-		}).Info("")
 		return err
 	}
-	//convert json string to io.reader
-	reader := bytes.NewReader(json_data)
-
-	client := &http.Client{}
-	req, err := http.NewRequest(http.MethodPost, url, reader)
+	u := &url.URL{
+		Scheme: "https",
+		Host:   item.IP,
+		Path:   "sdk",
+		User:   url.UserPassword("root", password),
+	}
+	host, err := esxi.Connect(ctx, u, postConfigRetry)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"postconfig": err,
-		}).Info("")
 		return err
 	}
-	_, err = client.Do(req)
+	defer host.Logout(context.Background())
+
+	expected := esxi.Expected{
+		Hostname: item.Hostname,
+		Domain:   item.Domain,
+		Syslog:   item.Group.Syslog,
+	}
+	for _, dns := range strings.Split(item.Group.DNS, ",") {
+		if dns = strings.TrimSpace(dns); dns != "" {
+			expected.DNS = append(expected.DNS, dns)
+		}
+	}
+	for _, ntp := range strings.Split(item.Group.NTP, ",") {
+		if ntp = strings.TrimSpace(ntp); ntp != "" {
+			expected.NTP = append(expected.NTP, ntp)
+		}
+	}
+	if err := host.Verify(ctx, expected); err != nil {
+		return err
+	}
+
+	if options.PostConfig != nil {
+		if err := host.Apply(ctx, *options.PostConfig); err != nil {
+			return err
+		}
+	}
+
+	// vCenter is given the thumbprint of the certificate the host ends up with
+	if err := hostCertificate(ctx, host, u, item, certificateDelivery(options)); err != nil {
+		return err
+	}
+
+	// the host isn't handed over before it is reachable like vCenter and VCF expect it
+	if options.Readiness != nil {
+		if err := checkReadiness(ctx, item, *options.Readiness); err != nil {
+			return err
+		}
+	}
+
+	if item.Group.VCenterID.Valid {
+		if err := addToVCenter(ctx, item, host.Thumbprint(), password, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workerTransition moves the host to the next state, the worker stops if the host has been moved elsewhere
+func workerTransition(item *models.Host, state string) error {
+	host, err := provisioning.Transition(item.ID, state, "postconfig", "go-via", "")
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
-			"postconfig": err,
-		}).Info("")
+			"id":  item.ID,
+			"err": err,
+		}).Warn("postconfig")
+		return err
+	}
+	item.State = host.State
+	item.StateChangedAt = host.StateChangedAt
+	item.Progress = host.Progress
+	item.Progresstext = host.Progresstext
+	return nil
+}
+
+// callback queues the host for the callback url of its group, the delivery is retried like the webhooks
+func callback(url string, data models.Host) error {
+	//remove password
+	data.Group.Password = ""
+	data.Group.IloPassword = ""
+	data.IloPassword = ""
+	data.KsNonce = ""
+	data.InstallNonce = ""
+	if err := webhooks.Callback(db.DB, url, data); err != nil {
 		return err
 	}
 	logrus.WithFields(logrus.Fields{
 		"IP":       data.IP,
-		"callback": data.Group.CallbackURL,
+		"callback": url,
 	}).Info("progress")
 	return nil
 }
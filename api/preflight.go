@@ -0,0 +1,209 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/deployments"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/readiness"
+	"github.com/maxiepax/go-via/secrets"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// the status of a preflight check, from best to worst
+const (
+	preflightPass = "pass"
+	preflightWarn = "warn"
+	preflightFail = "fail"
+)
+
+// Preflight Check a host before it is reimaged
+// @Summary Check a host before it is reimaged
+// @Description Checks the image files, the pool, the kickstart, the root password, the dns records and the BMC of the host. They run as well whenever the host is queued for reimaging, a host that fails a check isn't queued.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Success 200 {object} models.PreflightReport
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/preflight [post]
+func Preflight(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Host
+		if res := db.DB.Preload(clause.Associations).First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		c.JSON(http.StatusOK, preflight(c.Request.Context(), item, key, true)) // 200
+	}
+}
+
+// QueuePreflight returns the preflight check of the provisioning package, it fails the hosts that can't be
+// reimaged before they are queued
+func QueuePreflight(key string) func(host models.Host) error {
+	return func(host models.Host) error {
+		report := preflight(context.Background(), host, key, false)
+		if report.Status != preflightFail {
+			return nil
+		}
+		var failed []string
+		for _, check := range report.Checks {
+			if check.Status == preflightFail {
+				failed = append(failed, check.Name+": "+check.Message)
+			}
+		}
+		return errors.New(strings.Join(failed, "; "))
+	}
+}
+
+// checkReimage runs the preflight checks for a host that is about to be reimaged, with the group and pool it
+// ends up in. a host that fails them gets a 422 with the report.
+func checkReimage(c *gin.Context, item models.Host, key string) bool {
+	check := item
+	check.Group, check.Pool = models.Group{}, models.Pool{}
+	if item.GroupID.Valid {
+		db.DB.First(&check.Group, item.GroupID.Int32)
+	}
+	if item.PoolID.Valid {
+		db.DB.First(&check.Pool, item.PoolID.Int32)
+	}
+	if report := preflight(c.Request.Context(), check, key, true); report.Status == preflightFail {
+		c.JSON(http.StatusUnprocessableEntity, models.PreflightError{
+			ErrorStatus:  http.StatusUnprocessableEntity,
+			ErrorMessage: "the host failed the preflight checks",
+			Report:       report,
+		}) // 422
+		return false
+	}
+	return true
+}
+
+// preflight checks what the host needs to be reimaged. Problems that stop the installer fail, problems that
+// only show up later or can be worked around by hand warn. The dns and BMC checks only warn and need the
+// network, they are skipped unless network is set.
+func preflight(ctx context.Context, item models.Host, key string, network bool) models.PreflightReport {
+	report := models.PreflightReport{HostID: item.ID, Status: preflightPass, Checks: []models.PreflightCheck{}}
+	add := func(name string, status string, format string, args ...interface{}) {
+		report.Checks = append(report.Checks, models.PreflightCheck{Name: name, Status: status, Message: fmt.Sprintf(format, args...)})
+		if status == preflightFail || (status == preflightWarn && report.Status == preflightPass) {
+			report.Status = status
+		}
+	}
+
+	if !item.GroupID.Valid {
+		add("image", preflightFail, "the host has no group")
+	} else {
+		var image models.Image
+		if res := db.DB.First(&image, "id = ?", item.Group.ImageID); res.Error != nil {
+			add("image", preflightFail, "the group of the host has no image")
+		} else if _, err := MbootPath(image.Path); err != nil {
+			add("image", preflightFail, "%s: %s", image.ISOImage, err)
+		} else {
+			add("image", preflightPass, "%s", image.ISOImage)
+		}
+	}
+
+	ip := net.ParseIP(item.IP)
+	if pool, err := FindPool(item.IP); err != nil {
+		add("pool", preflightFail, "%s is not in a pool", item.IP)
+	} else if item.PoolID.Valid && int(item.PoolID.Int32) != pool.ID {
+		add("pool", preflightFail, "%s is in pool %s, the host is in pool %d", item.IP, pool.Name, item.PoolID.Int32)
+	} else if err := pool.IsAvailableExcept(ip, item.Mac); err != nil {
+		add("pool", preflightFail, "%s %s", item.IP, err)
+	} else {
+		add("pool", preflightPass, "%s is in pool %s", item.IP, pool.Name)
+	}
+
+	if ks, err := resolveKickstart(item); err != nil {
+		add("kickstart", preflightFail, "%s", err)
+	} else {
+		var errs, warnings []string
+		for _, issue := range validateKickstart(ks, item) {
+			message := issue.Message
+			if issue.Line > 0 {
+				message = fmt.Sprintf("line %d: %s", issue.Line, issue.Message)
+			}
+			if issue.Severity == severityError {
+				errs = append(errs, message)
+			} else {
+				warnings = append(warnings, message)
+			}
+		}
+		switch {
+		case len(errs) > 0:
+			add("kickstart", preflightFail, "%s", strings.Join(errs, "; "))
+		case len(warnings) > 0:
+			add("kickstart", preflightWarn, "%s", strings.Join(warnings, "; "))
+		default:
+			add("kickstart", preflightPass, "the kickstart renders")
+		}
+	}
+
+	options, _ := groupOptions(item.Group)
+	switch {
+	case options.PerHostPassword:
+		add("password", preflightPass, "a password is generated for the host")
+	case item.Group.Password == "":
+		add("password", preflightFail, "the group has no root password")
+	default:
+		if _, err := secrets.TryDecrypt(item.Group.Password, key); err != nil {
+			add("password", preflightFail, "the root password of the group can't be decrypted with the key of go-via")
+		} else {
+			add("password", preflightPass, "the root password of the group can be decrypted")
+		}
+	}
+
+	if !network {
+		return report
+	}
+
+	// the records are only needed once the host is installed
+	target := readinessTarget(item)
+	if err := readiness.Lookup(ctx, target); err != nil {
+		add("dns", preflightWarn, "%s", err)
+	} else {
+		add("dns", preflightPass, "%s resolves to %s and back", target.FQDN, target.IP)
+	}
+
+	// without a BMC the host is booted by hand
+	if item.IloIP == "" {
+		add("bmc", preflightWarn, "the host has no BMC")
+	} else if _, err := deployments.BMC(item, key); err != nil {
+		add("bmc", preflightWarn, "%s", err)
+	} else {
+		port := 443
+		if item.IloPort != "" {
+			port, _ = strconv.Atoi(item.IloPort)
+		}
+		if err := readiness.Dial(ctx, item.IloIP, port); err != nil {
+			add("bmc", preflightWarn, "the BMC is not reachable: %s", err)
+		} else {
+			add("bmc", preflightPass, "the BMC is reachable")
+		}
+	}
+
+	return report
+}
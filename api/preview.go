@@ -0,0 +1,136 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// the previews show where the signed token goes without minting one
+const previewToken = "<token>"
+
+// PreviewKs Preview the kickstart of a Host
+// @Summary Preview the kickstart of a Host
+// @Description Renders the kickstart exactly as the host would receive it, without consuming a kickstart url or changing the host. The root password is only included as a hash.
+// @Tags hosts
+// @Produce  plain
+// @Param  id path int true "Host ID"
+// @Success 200 {string} string
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 422 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/preview/ks [get]
+func PreviewKs(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		item, ok := loadPreviewHost(c)
+		if !ok {
+			return
+		}
+
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		report := scheme + "://" + c.Request.Host + "/report/" + previewToken
+
+		password, err := hostPasswordHash(item, key)
+		if err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		ks, err := renderKickstart(item, password, localAddr(c), report, nil)
+		if err != nil {
+			Error(c, http.StatusUnprocessableEntity, err) // 422
+			return
+		}
+
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", ks)
+	}
+}
+
+// PreviewBootCfg Preview the boot.cfg of a Host
+// @Summary Preview the boot.cfg of a Host
+// @Description Renders the boot.cfg the host would receive over tftp, without signing urls or changing the host. The signed tokens are shown as <token>.
+// @Tags hosts
+// @Produce  plain
+// @Param  id path int true "Host ID"
+// @Success 200 {string} string
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 422 {object} models.APIError
+// @Router /hosts/{id}/preview/bootcfg [get]
+func PreviewBootCfg(scheme string, port int) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		item, ok := loadPreviewHost(c)
+		if !ok {
+			return
+		}
+
+		var image models.Image
+		if res := db.DB.First(&image, "id = ?", item.Group.ImageID); res.Error != nil {
+			Error(c, http.StatusNotFound, fmt.Errorf("the group of the host has no image")) // 404
+			return
+		}
+
+		// tftp answers from the address the host reached us on, the closest match is the address of this request
+		ip, _, err := net.SplitHostPort(c.Request.Host)
+		if err != nil {
+			ip = c.Request.Host
+		}
+		if laddr, ok := localAddr(c).(*net.TCPAddr); ok {
+			ip = laddr.IP.String()
+		}
+		server := net.JoinHostPort(ip, strconv.Itoa(port))
+		urls := BootURLs{
+			Kickstart: scheme + "://" + server + "/ks/" + previewToken + "/ks.cfg",
+		}
+		// the modules are only fetched from the signed prefix over plain http
+		if scheme == "http" {
+			urls.Prefix = scheme + "://" + server + "/boot/" + previewToken
+		}
+
+		bc, err := RenderBootCfg(item, image, urls)
+		if err != nil {
+			Error(c, http.StatusUnprocessableEntity, err) // 422
+			return
+		}
+
+		c.Data(http.StatusOK, "text/plain; charset=utf-8", bc)
+	}
+}
+
+func loadPreviewHost(c *gin.Context) (models.Host, bool) {
+	var item models.Host
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return item, false
+	}
+
+	if res := db.DB.Preload(clause.Associations).First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return item, false
+	}
+
+	return item, true
+}
+
+func localAddr(c *gin.Context) net.Addr {
+	laddr, _ := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return laddr
+}
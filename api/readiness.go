@@ -0,0 +1,127 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/readiness"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ListHostReadiness Get the readiness checks of a host
+// @Summary Get the readiness checks of a host
+// @Description The results of the last run of the readiness checks of the group, they run after the post-config.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Success 200 {array} models.ReadinessResult
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/readiness [get]
+func ListHostReadiness(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Host
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	var items []models.ReadinessResult
+	if res := db.DB.Where("host_id = ?", item.ID).Order("id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// the interval at which failed readiness checks are run again
+var readinessRetry = 15 * time.Second
+
+// checkReadiness runs the readiness checks of the group until they all pass or the context is done
+func checkReadiness(ctx context.Context, item models.Host, config models.ReadinessConfig) error {
+	target := readinessTarget(item)
+	for {
+		results := readiness.Run(ctx, target, config)
+		if err := storeReadiness(item.ID, results); err != nil {
+			return err
+		}
+		failed := readiness.Failed(results)
+		if len(failed) == 0 {
+			return nil
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"id":     item.ID,
+			"failed": strings.Join(failed, ", "),
+		}).Debug("readiness")
+
+		select {
+		case <-time.After(readinessRetry):
+		case <-ctx.Done():
+			return fmt.Errorf("readiness checks failed: %s", strings.Join(failed, ", "))
+		}
+	}
+}
+
+// readinessTarget returns the address and name of a host, and the dns servers of its group
+func readinessTarget(item models.Host) readiness.Target {
+	fqdn, _ := certificateNames(item)
+	target := readiness.Target{IP: item.IP, FQDN: fqdn}
+	for _, dns := range strings.Split(item.Group.DNS, ",") {
+		if dns = strings.TrimSpace(dns); dns != "" {
+			target.DNS = append(target.DNS, dns)
+		}
+	}
+	return target
+}
+
+// storeReadiness replaces the readiness results of a host
+func storeReadiness(hostID int, results []models.ReadinessResult) error {
+	return db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.Where("host_id = ?", hostID).Delete(&models.ReadinessResult{}); res.Error != nil {
+			return res.Error
+		}
+		for i := range results {
+			results[i].HostID = hostID
+		}
+		if len(results) == 0 {
+			return nil
+		}
+		return tx.Create(&results).Error
+	})
+}
+
+// validateReadiness checks the readiness checks of a group
+func validateReadiness(options models.GroupOptions) error {
+	if options.Readiness == nil {
+		return nil
+	}
+	for _, port := range options.Readiness.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("readiness port %d is not a valid port", port)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var reportStatuses = []string{"started", "finished", "failed"}
+
+// the progress of an installing host once a stage has reported
+var stageProgress = map[string]int{
+	"pre":  55,
+	"post": 60,
+}
+
+// phoneHomeScript posts a report, it never fails so a broken network can't break the installation.
+// usage: phonehome <stage> <status> [exit code] [message]
+const phoneHomeScript = `import sys, json, ssl, urllib.request
+a = sys.argv[1:] + ["", "", "", "", ""]
+try:
+    body = {"stage": a[1], "status": a[2], "exit_code": int(a[3]) if a[3] else None, "message": a[4]}
+    req = urllib.request.Request(a[0], data=json.dumps(body).encode(), headers={"Content-Type": "application/json"})
+    urllib.request.urlopen(req, timeout=10, context=ssl._create_unverified_context())
+except Exception as e:
+    print("could not phone home: %s" % e)`
+
+// phoneHome returns the command templates call to report a stage, e.g. {{ .phonehome }} post finished 0
+func phoneHome(reportURL string) string {
+	if reportURL == "" {
+		return "true"
+	}
+	return "python -c '" + phoneHomeScript + "' " + reportURL + "/stage"
+}
+
+// ReportStage Receives the progress of the installer
+// @Summary Receives the progress of the installer
+// @Description Called from the %pre, %post and %firstboot scripts of the kickstart, protected by a signed url. The host is completed once %firstboot finished.
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  token path string true "Signed report token"
+// @Param  item body models.InstallReportForm true "The stage and its status"
+// @Success 204
+// @Failure 400 {object} models.APIError
+// @Failure 403 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /report/{token}/stage [post]
+func ReportStage(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		token, err := verifyReportToken(c.Param("token"), key)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"remote": c.ClientIP(),
+				"err":    err,
+			}).Warn("report")
+			Error(c, http.StatusForbidden, err) // 403
+			return
+		}
+
+		var form models.InstallReportForm
+		if err := c.ShouldBindJSON(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		if !containsString(scriptStages, form.Stage) {
+			Error(c, http.StatusBadRequest, fmt.Errorf("stage must be one of pre, post or firstboot")) // 400
+			return
+		}
+		if !containsString(reportStatuses, form.Status) {
+			Error(c, http.StatusBadRequest, fmt.Errorf("status must be one of started, finished or failed")) // 400
+			return
+		}
+		// a non zero exit code fails the stage, whatever the script claims
+		if form.Status == "finished" && form.ExitCode != nil && *form.ExitCode != 0 {
+			form.Status = "failed"
+		}
+
+		var item models.Host
+		if res := db.DB.Preload(clause.Associations).First(&item, token.HostID); res.Error != nil {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			return
+		}
+
+		report := models.InstallReport{HostID: item.ID, InstallReportForm: form, Remote: c.ClientIP(), CreatedAt: time.Now()}
+
+		// the time since the stage started
+		if form.Status != "started" {
+			var started models.InstallReport
+			if res := db.DB.Where("host_id = ? AND stage = ? AND status = ?", item.ID, form.Stage, "started").Order("id desc").Limit(1).Find(&started); res.Error == nil && res.RowsAffected > 0 {
+				report.Duration = report.CreatedAt.Sub(started.CreatedAt).Seconds()
+			}
+		}
+
+		if res := db.DB.Create(&report); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		fields := logrus.Fields{
+			"id":     item.ID,
+			"stage":  form.Stage,
+			"status": form.Status,
+		}
+		if form.ExitCode != nil {
+			fields["exit_code"] = *form.ExitCode
+		}
+		if form.Message != "" {
+			fields["message"] = form.Message
+		}
+
+		var to string
+		switch {
+		case form.Status == "failed":
+			logrus.WithFields(fields).Error("report")
+			to = provisioning.Failed
+		case form.Stage == "firstboot" && form.Status == "started":
+			logrus.WithFields(fields).Info("report")
+			to = provisioning.Firstboot
+		case form.Stage == "firstboot" && form.Status == "finished":
+			logrus.WithFields(fields).Info("report")
+		default:
+			logrus.WithFields(fields).Info("report")
+			provisioning.SetProgress(item.ID, provisioning.Installing, stageProgress[form.Stage], form.Stage)
+		}
+
+		if to != "" {
+			message := ""
+			if to == provisioning.Failed {
+				message = form.Stage + " failed"
+				if form.Message != "" {
+					message += ": " + form.Message
+				}
+			}
+			if _, err := provisioning.Transition(item.ID, to, "installer", c.ClientIP(), message); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":  item.ID,
+					"err": err,
+				}).Warn("report")
+			}
+		}
+
+		// esxi is up, the worker completes the host
+		if form.Stage == "firstboot" && form.Status == "finished" {
+			queuePostConfig(item)
+		}
+
+		c.JSON(http.StatusNoContent, gin.H{}) //204
+	}
+}
+
+// ListHostReports Get the reports of the installations of a host
+// @Summary Get the reports of the installations of a host
+// @Tags hosts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Host ID"
+// @Success 200 {array} models.InstallReport
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /hosts/{id}/reports [get]
+func ListHostReports(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Host
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	var items []models.InstallReport
+	if res := db.DB.Where("host_id = ?", item.ID).Order("id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
@@ -0,0 +1,281 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/scheduling"
+	"gorm.io/gorm"
+)
+
+// ListSchedules Get a list of all schedules
+// @Summary Get all schedules
+// @Description With the next runs of every schedule.
+// @Tags schedules
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Schedule
+// @Failure 500 {object} models.APIError
+// @Router /schedules [get]
+func ListSchedules(c *gin.Context) {
+	var items []models.Schedule
+	if res := db.DB.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	for i := range items {
+		scheduling.Upcoming(&items[i])
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetSchedule Get an existing schedule
+// @Summary Get an existing schedule
+// @Tags schedules
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Schedule ID"
+// @Success 200 {object} models.Schedule
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /schedules/{id} [get]
+func GetSchedule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Schedule
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	scheduling.Upcoming(&item)
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateSchedule Create a new schedule
+// @Summary Create a new schedule
+// @Description Reimages a host, all hosts of a group, or runs a deployment again, once at a time or repeatedly with a cron expression. The hosts still only boot the installer within the maintenance windows of their group.
+// @Tags schedules
+// @Accept  json
+// @Produce  json
+// @Param item body models.ScheduleForm true "Add a schedule"
+// @Success 200 {object} models.Schedule
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /schedules [post]
+func CreateSchedule(c *gin.Context) {
+	var form models.ScheduleForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	if form.Name == "" {
+		Error(c, http.StatusBadRequest, fmt.Errorf("name is required")) // 400
+		return
+	}
+	if err := validateSchedule(form, form.At != nil); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.Schedule{ScheduleForm: form}
+	item.Actor = requestUser(c, "anonymous")
+	next, err := scheduling.Next(item, time.Now())
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	item.NextRunAt = next
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	scheduling.Upcoming(&item)
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// UpdateSchedule Update an existing schedule
+// @Summary Update an existing schedule
+// @Description The next run is computed again from the updated schedule.
+// @Tags schedules
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Schedule ID"
+// @Param  item body models.ScheduleForm true "Update a schedule"
+// @Success 200 {object} models.Schedule
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /schedules/{id} [patch]
+func UpdateSchedule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the form data
+	var form models.ScheduleForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Schedule
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// a new target or time replaces the previous one
+	if form.HostID.Valid || form.GroupID.Valid || form.DeploymentID.Valid {
+		item.HostID, item.GroupID, item.DeploymentID = models.NullInt32{}, models.NullInt32{}, models.NullInt32{}
+	}
+	if form.At != nil {
+		item.Cron = ""
+	}
+	if form.Cron != "" {
+		item.At = nil
+	}
+
+	// Merge the item and the form data
+	if err := mergo.Merge(&item, models.Schedule{ScheduleForm: form}, mergo.WithOverride); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	//mergo wont overwrite values with empty space. To disable a schedule, always overwrite.
+	item.Enabled = form.Enabled
+
+	if err := validateSchedule(item.ScheduleForm, form.At != nil); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	next, err := scheduling.Next(item, time.Now())
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	item.NextRunAt = next
+
+	// Save it
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	scheduling.Upcoming(&item)
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteSchedule Remove an existing schedule
+// @Summary Remove an existing schedule
+// @Tags schedules
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Schedule ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /schedules/{id} [delete]
+func DeleteSchedule(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Schedule
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// validateSchedule checks that a schedule has one target that exists, and either a time or a cron expression.
+// A new time can't be in the past.
+func validateSchedule(form models.ScheduleForm, newTime bool) error {
+	targets := 0
+	for _, id := range []models.NullInt32{form.HostID, form.GroupID, form.DeploymentID} {
+		if id.Valid {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("set one of host_id, group_id or deployment_id")
+	}
+
+	var res *gorm.DB
+	switch {
+	case form.HostID.Valid:
+		res = db.DB.First(&models.Host{}, form.HostID.Int32)
+	case form.GroupID.Valid:
+		res = db.DB.First(&models.Group{}, form.GroupID.Int32)
+	default:
+		res = db.DB.First(&models.Deployment{}, form.DeploymentID.Int32)
+	}
+	if res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("the host, group or deployment of the schedule doesn't exist")
+		}
+		return res.Error
+	}
+
+	if (form.At == nil) == (form.Cron == "") {
+		return fmt.Errorf("set either at or cron")
+	}
+	if _, err := scheduling.Location(form.Timezone); err != nil {
+		return err
+	}
+	if form.Cron != "" {
+		if _, err := scheduling.Parse(form.Cron, form.Timezone); err != nil {
+			return err
+		}
+	}
+	if newTime && form.At.Before(time.Now()) {
+		return fmt.Errorf("at is in the past")
+	}
+	return nil
+}
@@ -0,0 +1,367 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/datatypes"
+	"gorm.io/gorm"
+)
+
+// the order the stages are appended to the kickstart in
+var scriptStages = []string{"pre", "post", "firstboot"}
+
+// ListScripts Get a list of all scripts
+// @Summary Get all scripts
+// @Tags scripts
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Script
+// @Failure 500 {object} models.APIError
+// @Router /scripts [get]
+func ListScripts(c *gin.Context) {
+	var items []models.Script
+	if res := db.DB.Order("stage, priority, id").Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetScript Get an existing script
+// @Summary Get an existing script
+// @Tags scripts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Script ID"
+// @Success 200 {object} models.Script
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /scripts/{id} [get]
+func GetScript(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Script
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateScript Create a new script
+// @Summary Create a new script
+// @Tags scripts
+// @Accept  json
+// @Produce  json
+// @Param item body models.ScriptForm true "Add a script"
+// @Success 200 {object} models.Script
+// @Failure 400 {object} models.APIError
+// @Failure 422 {object} models.KickstartValidationError
+// @Failure 500 {object} models.APIError
+// @Router /scripts [post]
+func CreateScript(c *gin.Context) {
+	var form models.ScriptForm
+
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	item := models.Script{ScriptForm: form}
+	if item.Interpreter == "" {
+		item.Interpreter = "busybox"
+	}
+
+	if err := validateScriptForm(item.ScriptForm); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	if issues := validateScript(item); hasKickstartErrors(issues) {
+		KickstartError(c, http.StatusUnprocessableEntity, issues) // 422
+		return
+	}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// UpdateScript Update an existing script
+// @Summary Update an existing script
+// @Tags scripts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Script ID"
+// @Param  item body models.ScriptForm true "Update a script"
+// @Success 200 {object} models.Script
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 422 {object} models.KickstartValidationError
+// @Failure 500 {object} models.APIError
+// @Router /scripts/{id} [patch]
+func UpdateScript(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the form data
+	var form models.ScriptForm
+	if err := c.ShouldBind(&form); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Script
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Merge the item and the form data
+	if err := mergo.Merge(&item, models.Script{ScriptForm: form}, mergo.WithOverride); err != nil {
+		Error(c, http.StatusInternalServerError, err) // 500
+		return
+	}
+
+	//mergo wont overwrite values with empty space or zero. To enable moving a script to priority 0, always overwrite.
+	item.Priority = form.Priority
+	item.Description = form.Description
+
+	if err := validateScriptForm(item.ScriptForm); err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+	if issues := validateScript(item); hasKickstartErrors(issues) {
+		KickstartError(c, http.StatusUnprocessableEntity, issues) // 422
+		return
+	}
+
+	// Save it
+	if res := db.DB.Save(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// DeleteScript Remove an existing script
+// @Summary Remove an existing script
+// @Tags scripts
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Script ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /scripts/{id} [delete]
+func DeleteScript(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Script
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// check if any group or host is using the script
+	var groups []models.Group
+	var hosts []models.Host
+	db.DB.Select("id", "script_ids").Find(&groups)
+	db.DB.Select("id", "script_ids").Find(&hosts)
+	n := 0
+	for _, g := range groups {
+		if ids, _ := decodeScriptIDs(g.ScriptIDs); containsInt(ids, item.ID) {
+			n++
+		}
+	}
+	for _, h := range hosts {
+		if ids, _ := decodeScriptIDs(h.ScriptIDs); containsInt(ids, item.ID) {
+			n++
+		}
+	}
+	if n > 0 {
+		Error(c, http.StatusConflict, fmt.Errorf("the script is attached to %d groups or hosts", n)) // 409
+		return
+	}
+
+	// delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+func validateScriptForm(form models.ScriptForm) error {
+	if form.Name == "" || form.Content == "" {
+		return fmt.Errorf("name and content are required")
+	}
+	if !containsString(scriptStages, form.Stage) {
+		return fmt.Errorf("stage must be one of pre, post or firstboot")
+	}
+	if form.Interpreter != "busybox" && form.Interpreter != "python" {
+		return fmt.Errorf("interpreter must be busybox or python")
+	}
+	return nil
+}
+
+// validateScript test-renders the script like it would be appended to a kickstart
+func validateScript(item models.Script) []models.KickstartIssue {
+	data, err := kickstartData(sampleHost(models.Group{}), samplePasswordHash, nil, sampleReportURL)
+	if err != nil {
+		return []models.KickstartIssue{{Severity: severityError, Message: err.Error()}}
+	}
+	out, err := spliceScripts(nil, []models.Script{item}, data)
+	if err != nil {
+		return []models.KickstartIssue{templateIssue(err)}
+	}
+	var issues []models.KickstartIssue
+	for _, i := range lintKickstart(out) {
+		// a script on its own has none of the required commands
+		if i.Line > 0 {
+			issues = append(issues, i)
+		}
+	}
+	return issues
+}
+
+func decodeScriptIDs(m datatypes.JSON) ([]int, error) {
+	var ids []int
+	if len(m) == 0 || string(m) == "null" {
+		return ids, nil
+	}
+	if err := json.Unmarshal(m, &ids); err != nil {
+		return nil, fmt.Errorf("script_ids must be a list of script ids: %w", err)
+	}
+	return ids, nil
+}
+
+// validateScriptIDs checks that all attached scripts exist
+func validateScriptIDs(m datatypes.JSON) error {
+	ids, err := decodeScriptIDs(m)
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	var n int64
+	if res := db.DB.Model(&models.Script{}).Where("id IN ?", ids).Count(&n); res.Error != nil {
+		return res.Error
+	}
+	seen := map[int]bool{}
+	for _, id := range ids {
+		seen[id] = true
+	}
+	if int(n) != len(seen) {
+		return fmt.Errorf("script_ids contains scripts that don't exist")
+	}
+	return nil
+}
+
+// kickstartScripts returns the scripts of the group and the host, in the order they run
+func kickstartScripts(item models.Host) ([]models.Script, error) {
+	groupIDs, err := decodeScriptIDs(item.Group.ScriptIDs)
+	if err != nil {
+		return nil, err
+	}
+	hostIDs, err := decodeScriptIDs(item.ScriptIDs)
+	if err != nil {
+		return nil, err
+	}
+	ids := append(groupIDs, hostIDs...)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	var scripts []models.Script
+	if res := db.DB.Where("id IN ?", ids).Find(&scripts); res.Error != nil {
+		return nil, res.Error
+	}
+	sort.SliceStable(scripts, func(i, j int) bool {
+		if scripts[i].Priority != scripts[j].Priority {
+			return scripts[i].Priority < scripts[j].Priority
+		}
+		return scripts[i].ID < scripts[j].ID
+	})
+	return scripts, nil
+}
+
+// spliceScripts appends every script as its own section, so they work with any base template
+func spliceScripts(ks []byte, scripts []models.Script, data map[string]interface{}) ([]byte, error) {
+	if len(scripts) == 0 {
+		return ks, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Write(ks)
+	if len(ks) > 0 && ks[len(ks)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	for _, stage := range scriptStages {
+		for _, s := range scripts {
+			if s.Stage != stage {
+				continue
+			}
+			t, err := parseKickstart(s.Content)
+			if err != nil {
+				return nil, fmt.Errorf("script %s: %w", s.Name, err)
+			}
+			fmt.Fprintf(&buf, "\n# script: %s\n%%%s --interpreter=%s\n", s.Name, s.Stage, s.Interpreter)
+			if err := t.Execute(&buf, data); err != nil {
+				return nil, fmt.Errorf("script %s: %w", s.Name, err)
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func containsInt(s []int, v int) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
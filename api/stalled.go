@@ -0,0 +1,79 @@
+package api
+
+import (
+	"fmt"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/deployments"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/sirupsen/logrus"
+)
+
+// HandleStalledHost runs the timeout actions of the group for a host the watchdog has failed
+func HandleStalledHost(key string) func(host models.Host, stalled string) {
+	return func(host models.Host, stalled string) {
+		options, err := groupOptions(host.Group)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  host.ID,
+				"err": err,
+			}).Warn("watchdog")
+			return
+		}
+
+		if options.TimeoutNotify && host.Group.CallbackURL != "" {
+			if err := callback(host.Group.CallbackURL, host); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":  host.ID,
+					"err": err,
+				}).Warn("watchdog: could not notify the callback url")
+			}
+		}
+
+		if options.TimeoutRetries > 0 {
+			if err := retryStalledHost(host, stalled, options.TimeoutRetries, key); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":  host.ID,
+					"err": err,
+				}).Warn("watchdog: not retrying the installation")
+			}
+		}
+	}
+}
+
+// retryStalledHost requeues the host and power cycles it, unless it already stalled retries times in a row
+func retryStalledHost(host models.Host, stalled string, retries int, key string) error {
+	bmc, err := deployments.BMC(host, key)
+	if err != nil {
+		return err
+	}
+
+	// count the stalls since an operator last touched the host or it was last completed
+	var last models.HostTransition
+	db.DB.Where("host_id = ? AND (source = ? OR `to` = ?)", host.ID, "api", provisioning.Ready).Order("id desc").Limit(1).Find(&last)
+	var stalls int64
+	db.DB.Model(&models.HostTransition{}).Where("host_id = ? AND source = ? AND `to` = ? AND id > ?", host.ID, "watchdog", provisioning.Failed, last.ID).Count(&stalls)
+	if int(stalls) > retries {
+		return fmt.Errorf("the host stalled %d times in a row", stalls)
+	}
+
+	message := fmt.Sprintf("retry %d of %d after %s stalled", stalls, retries, stalled)
+	if _, err := provisioning.Transition(host.ID, provisioning.Queued, "watchdog", "go-via", message); err != nil {
+		return err
+	}
+
+	if err := bmc.RebootServer(); err != nil {
+		// it won't boot on its own, don't leave it waiting in the queue
+		provisioning.Transition(host.ID, provisioning.Failed, "watchdog", "go-via", "could not power cycle the host")
+		return fmt.Errorf("could not power cycle the host: %w", err)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id":      host.ID,
+		"stalled": stalled,
+		"retry":   stalls,
+		"retries": retries,
+	}).Info("watchdog: power cycled the host to retry the installation")
+	return nil
+}
@@ -0,0 +1,278 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/maxiepax/go-via/vcenter"
+	"gorm.io/gorm"
+)
+
+// ListVCenters Get a list of all vCenter servers
+// @Summary Get all vCenter servers
+// @Tags vcenters
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.VCenter
+// @Failure 500 {object} models.APIError
+// @Router /vcenters [get]
+func ListVCenters(c *gin.Context) {
+	var items []models.VCenter
+	if res := db.DB.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	//remove passwords
+	for i := range items {
+		items[i].Password = ""
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetVCenter Get an existing vCenter server
+// @Summary Get an existing vCenter server
+// @Tags vcenters
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "vCenter ID"
+// @Success 200 {object} models.VCenter
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /vcenters/{id} [get]
+func GetVCenter(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.VCenter
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	item.Password = ""
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateVCenter Create a new vCenter server
+// @Summary Create a new vCenter server
+// @Tags vcenters
+// @Accept  json
+// @Produce  json
+// @Param item body models.VCenterForm true "Add a vCenter server"
+// @Success 200 {object} models.VCenter
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /vcenters [post]
+func CreateVCenter(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.VCenterForm
+
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if form.Name == "" || form.Host == "" || form.Username == "" || form.Password == "" {
+			Error(c, http.StatusBadRequest, fmt.Errorf("name, host, username and password are required")) // 400
+			return
+		}
+
+		item := models.VCenter{VCenterForm: form}
+		item.Password = secrets.Encrypt(form.Password, key)
+
+		if res := db.DB.Create(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		item.Password = ""
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// UpdateVCenter Update an existing vCenter server
+// @Summary Update an existing vCenter server
+// @Description The password is only changed if a new one is supplied.
+// @Tags vcenters
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "vCenter ID"
+// @Param  item body models.VCenterForm true "Update a vCenter server"
+// @Success 200 {object} models.VCenter
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /vcenters/{id} [patch]
+func UpdateVCenter(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the form data
+		var form models.VCenterForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.VCenter
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		// Merge the item and the form data
+		if err := mergo.Merge(&item, models.VCenter{VCenterForm: form}, mergo.WithOverride); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		if form.Password != "" {
+			item.Password = secrets.Encrypt(form.Password, key)
+		}
+
+		//mergo wont overwrite values with empty space. To enable going back to a system trusted certificate, always overwrite.
+		item.Thumbprint = form.Thumbprint
+
+		// Save it
+		if res := db.DB.Save(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		item.Password = ""
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// DeleteVCenter Remove an existing vCenter server
+// @Summary Remove an existing vCenter server
+// @Tags vcenters
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "vCenter ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /vcenters/{id} [delete]
+func DeleteVCenter(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.VCenter
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// check if any group adds its hosts to the vCenter
+	var n int64
+	db.DB.Model(&models.Group{}).Where("v_center_id = ?", item.ID).Count(&n)
+	if n > 0 {
+		Error(c, http.StatusConflict, fmt.Errorf("the vCenter is used by %d groups", n)) // 409
+		return
+	}
+
+	// delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// validateVCenterRef checks the vCenter settings of a group
+func validateVCenterRef(group models.Group) error {
+	if !group.VCenterID.Valid {
+		return nil
+	}
+	var n int64
+	if res := db.DB.Model(&models.VCenter{}).Where("id = ?", group.VCenterID.Int32).Count(&n); res.Error != nil {
+		return res.Error
+	}
+	if n == 0 {
+		return fmt.Errorf("vcenter %d does not exist", group.VCenterID.Int32)
+	}
+	if group.Datacenter == "" || group.Cluster == "" {
+		return fmt.Errorf("a datacenter and a cluster are required to add the hosts to vcenter")
+	}
+	return nil
+}
+
+// addToVCenter adds a host that completed its post-config to the vCenter of its group
+func addToVCenter(ctx context.Context, item models.Host, thumbprint string, password string, key string) error {
+	var vc models.VCenter
+	if res := db.DB.First(&vc, item.Group.VCenterID.Int32); res.Error != nil {
+		return fmt.Errorf("could not load vcenter %d: %w", item.Group.VCenterID.Int32, res.Error)
+	}
+
+	vcPassword, err := secrets.TryDecrypt(vc.Password, key)
+	if err != nil {
+		return fmt.Errorf("the password of vcenter %s can't be decrypted: %w", vc.Name, err)
+	}
+	u := &url.URL{
+		Scheme: "https",
+		Host:   vc.Host,
+		Path:   "sdk",
+		User:   url.UserPassword(vc.Username, vcPassword),
+	}
+	client, err := vcenter.Connect(ctx, u, vc.Thumbprint)
+	if err != nil {
+		return err
+	}
+	defer client.Logout(context.Background())
+
+	// vCenter connects to the host by the name it is added with
+	name := item.IP
+	if item.Hostname != "" && item.Domain != "" {
+		name = item.Hostname + "." + item.Domain
+	}
+
+	return client.AddHost(ctx, vcenter.HostSpec{
+		Datacenter:      item.Group.Datacenter,
+		Cluster:         item.Group.Cluster,
+		Name:            name,
+		Username:        "root",
+		Password:        password,
+		Thumbprint:      thumbprint,
+		MaintenanceMode: item.Group.MaintenanceMode,
+	})
+}
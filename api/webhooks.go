@@ -0,0 +1,357 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/imdario/mergo"
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/maxiepax/go-via/webhooks"
+	"gorm.io/gorm"
+)
+
+// ListWebhooks Get a list of all webhooks
+// @Summary Get all webhooks
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Success 200 {array} models.Webhook
+// @Failure 500 {object} models.APIError
+// @Router /webhooks [get]
+func ListWebhooks(c *gin.Context) {
+	var items []models.Webhook
+	if res := db.DB.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	//remove secrets
+	for i := range items {
+		items[i].Secret = ""
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetWebhook Get an existing webhook
+// @Summary Get an existing webhook
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Webhook ID"
+// @Success 200 {object} models.Webhook
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /webhooks/{id} [get]
+func GetWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Webhook
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	item.Secret = ""
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// CreateWebhook Create a new webhook
+// @Summary Create a new webhook
+// @Description A secret is generated if none is given, it is only returned in this response.
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param item body models.WebhookForm true "Add a webhook"
+// @Success 200 {object} models.Webhook
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /webhooks [post]
+func CreateWebhook(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		var form models.WebhookForm
+
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		if form.Name == "" {
+			Error(c, http.StatusBadRequest, fmt.Errorf("name is required")) // 400
+			return
+		}
+		if err := validateWebhook(form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		secret := form.Secret
+		if secret == "" {
+			secret = secrets.NewNonce()
+		}
+		item := models.Webhook{WebhookForm: form}
+		item.Secret = secrets.Encrypt(secret, key)
+
+		if res := db.DB.Create(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		item.Secret = secret
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// UpdateWebhook Update an existing webhook
+// @Summary Update an existing webhook
+// @Description The secret is only changed if a new one is supplied.
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Webhook ID"
+// @Param  item body models.WebhookForm true "Update a webhook"
+// @Success 200 {object} models.Webhook
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /webhooks/{id} [patch]
+func UpdateWebhook(key string) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		id, err := strconv.Atoi(c.Param("id"))
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the form data
+		var form models.WebhookForm
+		if err := c.ShouldBind(&form); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		// Load the item
+		var item models.Webhook
+		if res := db.DB.First(&item, id); res.Error != nil {
+			if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+				Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+			} else {
+				Error(c, http.StatusInternalServerError, res.Error) // 500
+			}
+			return
+		}
+
+		currentSecret := item.Secret
+
+		// Merge the item and the form data
+		if err := mergo.Merge(&item, models.Webhook{WebhookForm: form}, mergo.WithOverride); err != nil {
+			Error(c, http.StatusInternalServerError, err) // 500
+			return
+		}
+
+		//mergo wont overwrite values with empty space. To disable a webhook, always overwrite. An empty list subscribes to all events.
+		item.Enabled = form.Enabled
+		if form.Events != nil {
+			item.Events = form.Events
+		}
+
+		if err := validateWebhook(item.WebhookForm); err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+
+		item.Secret = currentSecret
+		if form.Secret != "" {
+			item.Secret = secrets.Encrypt(form.Secret, key)
+		}
+
+		// Save it
+		if res := db.DB.Save(&item); res.Error != nil {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+			return
+		}
+
+		item.Secret = ""
+		c.JSON(http.StatusOK, item) // 200
+	}
+}
+
+// DeleteWebhook Remove an existing webhook
+// @Summary Remove an existing webhook
+// @Description Its pending deliveries are failed, the delivery log is kept.
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Webhook ID"
+// @Success 204
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /webhooks/{id} [delete]
+func DeleteWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.Webhook
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	// Delete it
+	if res := db.DB.Delete(&item); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusNoContent, gin.H{}) //204
+}
+
+// ListWebhookDeliveries Get the delivery log
+// @Summary Get the delivery log
+// @Description The latest deliveries first, at most 500.
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param  webhook_id query int false "Only the deliveries of this webhook"
+// @Param  status query string false "pending, delivered or failed"
+// @Param  event query string false "Only this event type"
+// @Success 200 {array} models.WebhookDelivery
+// @Failure 400 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /webhooks/deliveries [get]
+func ListWebhookDeliveries(c *gin.Context) {
+	query := db.DB.Order("id desc").Limit(500)
+	if v := c.Query("webhook_id"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			Error(c, http.StatusBadRequest, err) // 400
+			return
+		}
+		query = query.Where("webhook_id = ?", id)
+	}
+	if v := c.Query("status"); v != "" {
+		query = query.Where("status = ?", v)
+	}
+	if v := c.Query("event"); v != "" {
+		query = query.Where("event = ?", v)
+	}
+
+	var items []models.WebhookDelivery
+	if res := query.Find(&items); res.Error != nil {
+		Error(c, http.StatusInternalServerError, res.Error) // 500
+		return
+	}
+
+	c.JSON(http.StatusOK, items) // 200
+}
+
+// GetWebhookDelivery Get a delivery
+// @Summary Get a delivery
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Delivery ID"
+// @Success 200 {object} models.WebhookDelivery
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 500 {object} models.APIError
+// @Router /webhooks/deliveries/{id} [get]
+func GetWebhookDelivery(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	// Load the item
+	var item models.WebhookDelivery
+	if res := db.DB.First(&item, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// ReplayWebhookDelivery Send a delivery again
+// @Summary Send a delivery again
+// @Description Queues the event of the delivery again, to the current url of its webhook. The event keeps its id.
+// @Tags webhooks
+// @Accept  json
+// @Produce  json
+// @Param  id path int true "Delivery ID"
+// @Success 200 {object} models.WebhookDelivery
+// @Failure 400 {object} models.APIError
+// @Failure 404 {object} models.APIError
+// @Failure 409 {object} models.APIError
+// @Router /webhooks/deliveries/{id}/replay [post]
+func ReplayWebhookDelivery(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		Error(c, http.StatusBadRequest, err) // 400
+		return
+	}
+
+	var original models.WebhookDelivery
+	if res := db.DB.First(&original, id); res.Error != nil {
+		if errors.Is(res.Error, gorm.ErrRecordNotFound) {
+			Error(c, http.StatusNotFound, fmt.Errorf("not found")) // 404
+		} else {
+			Error(c, http.StatusInternalServerError, res.Error) // 500
+		}
+		return
+	}
+
+	item, err := webhooks.Replay(original.ID)
+	if err != nil {
+		Error(c, http.StatusConflict, err) // 409
+		return
+	}
+
+	c.JSON(http.StatusOK, item) // 200
+}
+
+// validateWebhook checks the url and event filter of a webhook
+func validateWebhook(form models.WebhookForm) error {
+	u, err := url.Parse(form.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be a http or https url")
+	}
+
+	var events []string
+	if len(form.Events) > 0 && string(form.Events) != "null" {
+		if err := json.Unmarshal(form.Events, &events); err != nil {
+			return fmt.Errorf("events must be a list of event types: %w", err)
+		}
+	}
+	return webhooks.ValidateEvents(events)
+}
@@ -10,11 +10,27 @@ import (
 )
 
 type Config struct {
-	Debug       bool
-	Port        int `default:"8443"`
-	File        string
-	Network     Network
-	DisableDhcp bool
+	Debug   bool
+	Port    int `default:"8443"`
+	File    string
+	Network Network
+	// serve dhcp on the network interfaces, requires CAP_NET_RAW. without it go-via relies on an existing dhcp
+	// server or IP-Helper pointing to it
+	EnableDhcp bool
+	// optional plain HTTP port for kickstart and boot artefacts, disabled if 0
+	HTTPPort int
+	// seconds a signed kickstart or boot url stays valid
+	TokenTTL int `default:"3600"`
+	// seconds to wait for in-flight transfers and requests on shutdown
+	ShutdownTimeout int `default:"30"`
+	// UDP and TCP port of the built-in syslog receiver, disabled if 0
+	SyslogPort int
+	// days syslog messages are kept
+	SyslogRetention int `default:"7"`
+	// syslog messages kept per host, the oldest are deleted first
+	SyslogMaxPerHost int `default:"10000"`
+	// send the syslog of hosts whose group sets none to the built-in receiver
+	SyslogDefault bool
 }
 
 type Network struct {
@@ -0,0 +1,201 @@
+package ca
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// host certificates are renewed by reimaging, two years stays below what browsers and vCenter accept
+const hostCertificateValidity = 2 * 365 * 24 * time.Hour
+
+// Issuer signs host certificates, either with the CA of go-via or with an uploaded intermediate
+type Issuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// the certificates between the issuer and the root, the issuer first
+	chain []*x509.Certificate
+}
+
+// HostCertificate is a certificate issued for a host, everything is PEM encoded
+type HostCertificate struct {
+	// the certificate followed by the chain of its issuer
+	Certificate string
+	Key         string
+	// the root of the chain, the host trusts it so it can verify its own certificate
+	CA string
+}
+
+// LoadIssuer loads the intermediate in dir if one was uploaded, otherwise the CA
+func LoadIssuer(dir string) (*Issuer, error) {
+	certFile, keyFile := filepath.Join(dir, "intermediate.crt"), filepath.Join(dir, "intermediate.key")
+	if _, err := os.Stat(certFile); os.IsNotExist(err) {
+		certFile, keyFile = filepath.Join(dir, "ca.crt"), filepath.Join(dir, "ca.key")
+	}
+
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return NewIssuer(certPEM, keyPEM)
+}
+
+// NewIssuer returns an issuer for a PEM encoded certificate chain, the issuer first, and its private key
+func NewIssuer(certPEM []byte, keyPEM []byte) (*Issuer, error) {
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("the certificate and the key don't belong together: %w", err)
+	}
+
+	var chain []*x509.Certificate
+	for _, der := range pair.Certificate {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if !chain[0].IsCA || chain[0].KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("%s is not allowed to sign certificates", chain[0].Subject)
+	}
+	for i := 1; i < len(chain); i++ {
+		if err := chain[i-1].CheckSignatureFrom(chain[i]); err != nil {
+			return nil, fmt.Errorf("%s is not signed by %s: %w", chain[i-1].Subject, chain[i].Subject, err)
+		}
+	}
+
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("keys of type %T are not supported", pair.PrivateKey)
+	}
+	return &Issuer{cert: chain[0], key: key, chain: chain}, nil
+}
+
+// SaveIntermediate validates an intermediate and stores it in dir, the next certificates are issued by it
+func SaveIntermediate(dir string, certPEM []byte, keyPEM []byte) (*Issuer, error) {
+	issuer, err := NewIssuer(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "intermediate.crt"), certPEM, 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "intermediate.key"), keyPEM, 0600); err != nil {
+		return nil, err
+	}
+	return issuer, nil
+}
+
+// RemoveIntermediate goes back to issuing certificates with the CA of go-via
+func RemoveIntermediate(dir string) error {
+	for _, name := range []string{"intermediate.crt", "intermediate.key"} {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chain returns the PEM encoded chain of the issuer, the issuer first
+func (i *Issuer) Chain() string {
+	var buf bytes.Buffer
+	for _, cert := range i.chain {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.String()
+}
+
+// Root returns the PEM encoded last certificate of the chain, which clients have to trust
+func (i *Issuer) Root() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: i.chain[len(i.chain)-1].Raw}))
+}
+
+// Issued reports if cert was signed by the issuer
+func (i *Issuer) Issued(cert *x509.Certificate) bool {
+	return cert.CheckSignatureFrom(i.cert) == nil
+}
+
+// IssueHostCertificate generates a key and a certificate for a host
+func (i *Issuer) IssueHostCertificate(fqdn string, ips []net.IP) (*HostCertificate, error) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := i.sign(&priv.PublicKey, fqdn, ips)
+	if err != nil {
+		return nil, err
+	}
+	return &HostCertificate{
+		Certificate: cert,
+		Key:         string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})),
+		CA:          i.Root(),
+	}, nil
+}
+
+// SignHostRequest signs a certificate signing request generated by a host, the key never leaves the host.
+// Only the public key of the request is used, the names come from go-via.
+func (i *Issuer) SignHostRequest(csrPEM string, fqdn string, ips []net.IP) (*HostCertificate, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return nil, fmt.Errorf("the certificate signing request is not PEM encoded")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("the certificate signing request has an invalid signature: %w", err)
+	}
+	cert, err := i.sign(csr.PublicKey, fqdn, ips)
+	if err != nil {
+		return nil, err
+	}
+	return &HostCertificate{Certificate: cert, CA: i.Root()}, nil
+}
+
+// sign returns the PEM encoded certificate for the public key followed by the chain of the issuer
+func (i *Issuer) sign(pub interface{}, fqdn string, ips []net.IP) (string, error) {
+	// serial numbers have to be unique per issuer, hosts refuse duplicates after a reimage
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+
+	cert := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			Organization: []string{"VMware ESX Server Default Certificate"},
+			CommonName:   fqdn,
+		},
+		NotBefore:   time.Now().Add(-5 * time.Minute),
+		NotAfter:    time.Now().Add(hostCertificateValidity),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		DNSNames:    []string{fqdn},
+		IPAddresses: ips,
+	}
+	if cert.NotAfter.After(i.cert.NotAfter) {
+		cert.NotAfter = i.cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, cert, i.cert, pub, i.key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) + i.Chain(), nil
+}
@@ -0,0 +1,254 @@
+// Package deployments reimages sets of hosts in waves, power cycling them through their BMC.
+package deployments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"gorm.io/gorm"
+)
+
+// the status of a deployment
+const (
+	Running   = "running"
+	Paused    = "paused"
+	Halted    = "halted"
+	Cancelled = "cancelled"
+	Completed = "completed"
+)
+
+// the status of a host in a deployment, cancelled is shared with the deployment
+const (
+	HostPending = "pending"
+	HostRunning = "running"
+	HostReady   = "ready"
+	HostFailed  = "failed"
+)
+
+// ErrHostBusy is returned when a host is already part of a deployment that hasn't finished
+var ErrHostBusy = errors.New("the host is part of another deployment")
+
+// ErrInvalidStatus is returned when a deployment can't be paused, resumed or cancelled in its current status
+var ErrInvalidStatus = errors.New("invalid deployment status")
+
+// mu serialises the changes of the api with the runner
+var mu sync.Mutex
+
+// wakeup makes the runner look at the deployments right away instead of at the next interval
+var wakeup = make(chan struct{}, 1)
+
+func wake() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Create stores a deployment of hosts, in order, and starts it. A host can only be part of one deployment at a time.
+func Create(form models.DeploymentForm, hosts []models.Host, actor string) (models.Deployment, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	active, err := Active()
+	if err != nil {
+		return models.Deployment{}, err
+	}
+	for _, host := range hosts {
+		if deployment, ok := active[host.ID]; ok {
+			return models.Deployment{}, fmt.Errorf("%w: host %s is part of deployment %d", ErrHostBusy, host.Hostname, deployment)
+		}
+	}
+
+	item := models.Deployment{
+		DeploymentForm: form,
+		Status:         Running,
+		Actor:          actor,
+	}
+	for i, host := range hosts {
+		wave := 0
+		if form.WaveSize > 0 {
+			wave = i / form.WaveSize
+		}
+		item.Hosts = append(item.Hosts, models.DeploymentHost{
+			HostID:   host.ID,
+			Hostname: host.Hostname,
+			Wave:     wave,
+			Status:   HostPending,
+		})
+	}
+
+	if res := db.DB.Create(&item); res.Error != nil {
+		return item, res.Error
+	}
+
+	wake()
+	return item, nil
+}
+
+// Hosts returns the hosts of a deployment in order, they need a BMC to be power cycled
+func Hosts(form models.DeploymentForm) ([]models.Host, error) {
+	var ids []int
+	if len(form.HostIDs) > 0 && string(form.HostIDs) != "null" {
+		if err := json.Unmarshal(form.HostIDs, &ids); err != nil {
+			return nil, fmt.Errorf("host_ids must be a list of host ids: %w", err)
+		}
+	}
+	if len(ids) > 0 && form.GroupID.Valid {
+		return nil, fmt.Errorf("set either host_ids or group_id")
+	}
+
+	var hosts []models.Host
+	if form.GroupID.Valid {
+		var group models.Group
+		if res := db.DB.First(&group, form.GroupID.Int32); res.Error != nil {
+			return nil, fmt.Errorf("group %d not found", form.GroupID.Int32)
+		}
+		if res := db.DB.Where("group_id = ? AND (state IS NULL OR state <> ?)", group.ID, provisioning.Decommissioned).Order("id").Find(&hosts); res.Error != nil {
+			return nil, res.Error
+		}
+	} else {
+		seen := map[int]bool{}
+		for _, id := range ids {
+			if seen[id] {
+				return nil, fmt.Errorf("host %d is listed twice", id)
+			}
+			seen[id] = true
+
+			var host models.Host
+			if res := db.DB.First(&host, id); res.Error != nil {
+				return nil, fmt.Errorf("host %d not found", id)
+			}
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("the deployment has no hosts")
+	}
+
+	var missing []string
+	for _, host := range hosts {
+		if host.IloIP == "" || host.IloApiFlavour == "" {
+			missing = append(missing, host.Hostname)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("hosts without a BMC: %s", strings.Join(missing, ", "))
+	}
+	return hosts, nil
+}
+
+// Active returns the ids of the hosts that are part of a deployment that hasn't finished
+func Active() (map[int]int, error) {
+	var rows []models.DeploymentHost
+	res := db.DB.Joins("JOIN deployments ON deployments.id = deployment_hosts.deployment_id").
+		Where("deployments.status IN ?", []string{Running, Paused, Halted}).
+		Where("deployment_hosts.status IN ?", []string{HostPending, HostRunning}).
+		Find(&rows)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+	active := make(map[int]int, len(rows))
+	for _, row := range rows {
+		active[row.HostID] = row.DeploymentID
+	}
+	return active, nil
+}
+
+// Pause stops a deployment from starting more hosts, the hosts that are being reimaged continue
+func Pause(id int) (models.Deployment, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return setStatus(id, Paused, "", Running)
+}
+
+// Resume continues a paused or halted deployment, the hosts that failed so far no longer count against maxfailures
+func Resume(id int) (models.Deployment, error) {
+	mu.Lock()
+	defer mu.Unlock()
+	return setStatus(id, Running, "", Paused, Halted)
+}
+
+// Cancel stops a deployment. The hosts that haven't started are cancelled, and hosts that haven't booted the
+// installer yet are no longer queued for reimaging.
+func Cancel(id int, actor string) (models.Deployment, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	item, err := setStatus(id, Cancelled, "cancelled", Running, Paused, Halted)
+	if err != nil {
+		return item, err
+	}
+
+	var running []models.DeploymentHost
+	if res := db.DB.Where("deployment_id = ? AND status = ?", id, HostRunning).Find(&running); res.Error != nil {
+		return item, res.Error
+	}
+	for _, dh := range running {
+		message := "the deployment was cancelled, the host continues to reimage"
+		var host models.Host
+		if res := db.DB.First(&host, dh.HostID); res.Error == nil && host.State == provisioning.Queued {
+			if _, err := provisioning.Transition(host.ID, provisioning.Registered, "deployment", actor, "the deployment was cancelled"); err == nil {
+				message = "the deployment was cancelled before the host booted the installer"
+			}
+		}
+		db.DB.Model(&dh).Updates(map[string]interface{}{"status": Cancelled, "error": message, "finished_at": time.Now()})
+	}
+	return item, nil
+}
+
+func setStatus(id int, to string, message string, from ...string) (models.Deployment, error) {
+	var item models.Deployment
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.First(&item, id); res.Error != nil {
+			return res.Error
+		}
+		if !contains(from, item.Status) {
+			return fmt.Errorf("%w: the deployment is %s", ErrInvalidStatus, item.Status)
+		}
+
+		updates := map[string]interface{}{"status": to, "message": message}
+		if item.Status == Halted && to == Running {
+			var failed int64
+			if res := tx.Model(&models.DeploymentHost{}).Where("deployment_id = ? AND status = ?", id, HostFailed).Count(&failed); res.Error != nil {
+				return res.Error
+			}
+			updates["ignored_failures"] = int(failed)
+		}
+		if to == Cancelled {
+			updates["finished_at"] = time.Now()
+		}
+		if res := tx.Model(&item).Updates(updates); res.Error != nil {
+			return res.Error
+		}
+		if to == Cancelled {
+			if res := tx.Model(&models.DeploymentHost{}).Where("deployment_id = ? AND status = ?", id, HostPending).Updates(map[string]interface{}{"status": Cancelled, "finished_at": time.Now()}); res.Error != nil {
+				return res.Error
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return item, err
+	}
+
+	wake()
+	return item, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
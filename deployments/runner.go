@@ -0,0 +1,281 @@
+package deployments
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/ilomapi"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// BMC returns the client of the BMC of a host. it logs in with the credentials of the host, or the ones of its
+// group when the host has none, so the group has to be loaded
+var BMC = func(host models.Host, key string) (ilomapi.IlomApi, error) {
+	if host.IloIP == "" {
+		return nil, fmt.Errorf("the host has no BMC")
+	}
+	user, password := host.IloUser, host.IloPassword
+	if user == "" && password == "" {
+		user, password = host.Group.IloUser, host.Group.IloPassword
+	}
+	if password != "" {
+		var err error
+		if password, err = secrets.TryDecrypt(password, key); err != nil {
+			return nil, fmt.Errorf("the BMC password can't be decrypted with the key of go-via")
+		}
+	}
+	return ilomapi.New(host.IloApiFlavour, host.IloIP, host.IloPort, user, password)
+}
+
+// Runner moves the running deployments along, it starts the next hosts once earlier ones are ready or failed
+type Runner struct {
+	key      string
+	interval time.Duration
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewRunner creates a Runner that looks at the deployments every interval, the key decrypts the BMC passwords
+func NewRunner(key string, interval time.Duration) *Runner {
+	return &Runner{
+		key:      key,
+		interval: interval,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (r *Runner) Name() string {
+	return "deployments"
+}
+
+func (r *Runner) Listen() error {
+	return nil
+}
+
+func (r *Runner) Serve(ctx context.Context) error {
+	defer close(r.stopped)
+	t := time.NewTicker(r.interval)
+	defer t.Stop()
+	for {
+		r.Step()
+		select {
+		case <-t.C:
+		case <-wakeup:
+		case <-r.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Shutdown waits for the hosts that are being started, the deployments continue at the next start
+func (r *Runner) Shutdown(ctx context.Context) error {
+	close(r.done)
+	select {
+	case <-r.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the deployment runner did not stop: %w", ctx.Err())
+	}
+}
+
+// Step looks at every running or paused deployment once
+func (r *Runner) Step() {
+	var items []models.Deployment
+	if res := db.DB.Where("status IN ?", []string{Running, Paused}).Order("id").Find(&items); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("deployments")
+		return
+	}
+
+	for _, item := range items {
+		started := r.step(item.ID)
+		r.start(item, started)
+	}
+}
+
+// step updates the hosts of a deployment from their provisioning state, and claims the hosts to start next
+func (r *Runner) step(id int) []models.DeploymentHost {
+	mu.Lock()
+	defer mu.Unlock()
+
+	// the deployment may have been paused or cancelled in the meantime
+	var item models.Deployment
+	if res := db.DB.Preload("Hosts", func(tx *gorm.DB) *gorm.DB { return tx.Order("wave, id") }).First(&item, id); res.Error != nil {
+		return nil
+	}
+	if item.Status != Running && item.Status != Paused {
+		return nil
+	}
+
+	// follow the hosts that are being reimaged, the watchdog fails the ones that stall
+	failed, pending := 0, 0
+	wave := -1
+	running := map[int]int{}
+	for i := range item.Hosts {
+		dh := &item.Hosts[i]
+		if dh.Status == HostRunning {
+			r.track(item, dh)
+		}
+		switch dh.Status {
+		case HostFailed:
+			failed++
+		case HostPending:
+			pending++
+		case HostRunning:
+			running[dh.Wave]++
+		}
+		if (dh.Status == HostPending || dh.Status == HostRunning) && wave == -1 {
+			wave = dh.Wave
+		}
+	}
+
+	if pending == 0 && len(running) == 0 {
+		ready := len(item.Hosts) - failed
+		r.finish(item, Completed, fmt.Sprintf("%d of %d hosts are ready", ready, len(item.Hosts)))
+		return nil
+	}
+	if failed-item.IgnoredFailures > item.MaxFailures {
+		if item.Status == Running {
+			r.finish(item, Halted, fmt.Sprintf("%d of %d hosts failed", failed, len(item.Hosts)))
+		}
+		return nil
+	}
+	if item.Status != Running {
+		return nil
+	}
+
+	// start the pending hosts of the current wave, up to the concurrency limit
+	var started []models.DeploymentHost
+	for i := range item.Hosts {
+		dh := item.Hosts[i]
+		if dh.Wave != wave || dh.Status != HostPending {
+			continue
+		}
+		if item.MaxConcurrency > 0 && running[wave] >= item.MaxConcurrency {
+			break
+		}
+
+		now := time.Now()
+		if _, err := provisioning.Transition(dh.HostID, provisioning.Queued, "deployment", item.Actor, fmt.Sprintf("deployment %d", item.ID)); err != nil {
+			db.DB.Model(&dh).Updates(map[string]interface{}{"status": HostFailed, "error": err.Error(), "started_at": now, "finished_at": now})
+			continue
+		}
+		db.DB.Model(&dh).Updates(map[string]interface{}{"status": HostRunning, "error": "", "started_at": now})
+		running[wave]++
+		started = append(started, dh)
+	}
+	return started
+}
+
+// track updates a host that is being reimaged from its provisioning state
+func (r *Runner) track(item models.Deployment, dh *models.DeploymentHost) {
+	var host models.Host
+	if res := db.DB.First(&host, dh.HostID); res.Error != nil {
+		dh.Status, dh.Error = HostFailed, "the host was deleted"
+	} else {
+		switch host.State {
+		case provisioning.Ready:
+			dh.Status = HostReady
+		case provisioning.Failed:
+			dh.Status, dh.Error = HostFailed, host.Progresstext
+		case provisioning.Registered, provisioning.Decommissioned:
+			dh.Status, dh.Error = HostFailed, "the host is no longer queued for reimaging, it is "+host.State
+		default:
+			return
+		}
+	}
+
+	now := time.Now()
+	dh.FinishedAt = &now
+	db.DB.Model(dh).Updates(map[string]interface{}{"status": dh.Status, "error": dh.Error, "finished_at": now})
+
+	logrus.WithFields(logrus.Fields{
+		"deployment": item.ID,
+		"id":         dh.HostID,
+		"host":       dh.Hostname,
+		"status":     dh.Status,
+		"error":      dh.Error,
+	}).Info("deployment")
+}
+
+func (r *Runner) finish(item models.Deployment, status string, message string) {
+	updates := map[string]interface{}{"status": status, "message": message}
+	if status == Completed {
+		updates["finished_at"] = time.Now()
+	}
+	db.DB.Model(&item).Updates(updates)
+
+	logrus.WithFields(logrus.Fields{
+		"deployment": item.ID,
+		"name":       item.Name,
+		"status":     status,
+		"message":    message,
+	}).Info("deployment")
+}
+
+// start boots the hosts into the installer through their BMC, outside of the lock as BMCs can be slow to answer
+func (r *Runner) start(item models.Deployment, hosts []models.DeploymentHost) {
+	var wg sync.WaitGroup
+	for _, dh := range hosts {
+		wg.Add(1)
+		go func(dh models.DeploymentHost) {
+			defer wg.Done()
+			err := r.boot(dh.HostID)
+			if err == nil {
+				logrus.WithFields(logrus.Fields{
+					"deployment": item.ID,
+					"id":         dh.HostID,
+					"host":       dh.Hostname,
+				}).Info("deployment: host is rebooting into the installer")
+				return
+			}
+
+			logrus.WithFields(logrus.Fields{
+				"deployment": item.ID,
+				"id":         dh.HostID,
+				"host":       dh.Hostname,
+				"err":        err,
+			}).Warn("deployment: could not reboot the host")
+
+			mu.Lock()
+			defer mu.Unlock()
+			provisioning.Transition(dh.HostID, provisioning.Registered, "deployment", item.Actor, "the BMC could not reboot the host")
+			db.DB.Model(&models.DeploymentHost{}).Where("id = ? AND status = ?", dh.ID, HostRunning).Updates(map[string]interface{}{"status": HostFailed, "error": err.Error(), "finished_at": time.Now()})
+			wake()
+		}(dh)
+	}
+	wg.Wait()
+}
+
+// boot sets the one-time boot of a host and power cycles it
+func (r *Runner) boot(hostID int) error {
+	var host models.Host
+	if res := db.DB.Preload("Group").First(&host, hostID); res.Error != nil {
+		return res.Error
+	}
+	bmc, err := BMC(host, r.key)
+	if err != nil {
+		return err
+	}
+	if err := bmc.SetOneTimeHTTPBoot(); err != nil {
+		return fmt.Errorf("one-time boot: %w", err)
+	}
+	// a host that is powered off can't be restarted
+	if err := bmc.RebootServer(); err != nil {
+		if err := bmc.StartServer(); err != nil {
+			return fmt.Errorf("reboot: %w", err)
+		}
+	}
+	return nil
+}
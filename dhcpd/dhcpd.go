@@ -2,18 +2,22 @@ package dhcpd
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/gopacket/layers"
 	"github.com/maxiepax/go-via/api"
 	"github.com/maxiepax/go-via/db"
 	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/scheduling"
+	"github.com/maxiepax/go-via/webhooks"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm"
 
@@ -88,6 +92,17 @@ func processDiscover(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (resp *lay
 		return nil, fmt.Errorf("ignored because mac address is not flagged for re-imaging")
 	}
 
+	// Hosts are only reimaged within the maintenance windows of their group
+	if lease != nil && lease.Reimage {
+		open, err := scheduling.MaintenanceOpen(lease.GroupID, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if !open {
+			return nil, fmt.Errorf("ignored because the maintenance window of the group is closed")
+		}
+	}
+
 	/*
 		if leaseIP == nil {
 			leaseIP, err = pool.Next()
@@ -219,6 +234,17 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 		return nil, fmt.Errorf("ignored because mac address is not flagged for reimaging")
 	}
 
+	// Hosts are only reimaged within the maintenance windows of their group
+	if lease != nil && lease.Reimage {
+		open, err := scheduling.MaintenanceOpen(lease.GroupID, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		if !open {
+			return nil, fmt.Errorf("ignored because the maintenance window of the group is closed")
+		}
+	}
+
 	// Its a new lease!
 	if lease == nil {
 		lease = &models.Host{
@@ -263,7 +289,22 @@ func processRequest(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	} else {
 		// Remove the previous record if there is any
 		db.DB.Exec("DELETE FROM hosts WHERE ip=? AND reimage=0 AND expires <= datetime('now', 'utc')", lease.IP)
-		db.DB.Save(lease)
+		// the state of the host is only changed by the state machine
+		db.DB.Omit("state", "state_changed_at", "progress", "progresstext").Save(lease)
+	}
+
+	if err := webhooks.Publish(db.DB, webhooks.LeaseGranted, webhooks.Lease{
+		HostID:   lease.ID,
+		PoolID:   pool.ID,
+		Mac:      lease.Mac,
+		IP:       lease.IP,
+		Hostname: lease.Hostname,
+		Relay:    lease.LastSeenRelay,
+		Expires:  lease.Expires,
+	}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("webhooks: could not queue the event")
 	}
 
 	return resp, nil
@@ -334,7 +375,22 @@ func processDecline(req *layers.DHCPv4, sourceNet net.IP, ip net.IP) (*layers.DH
 	if lease.ID == 0 {
 		db.DB.Create(lease)
 	} else {
-		db.DB.Save(lease)
+		// the state of the host is only changed by the state machine
+		db.DB.Omit("state", "state_changed_at", "progress", "progresstext").Save(lease)
+	}
+
+	if err := webhooks.Publish(db.DB, webhooks.LeaseGranted, webhooks.Lease{
+		HostID:   lease.ID,
+		PoolID:   pool.ID,
+		Mac:      lease.Mac,
+		IP:       lease.IP,
+		Hostname: lease.Hostname,
+		Relay:    lease.LastSeenRelay,
+		Expires:  lease.Expires,
+	}); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("webhooks: could not queue the event")
 	}
 
 	return nil, nil
@@ -501,7 +557,28 @@ func AddOptions(req *layers.DHCPv4, resp *layers.DHCPv4, pool models.PoolWithHos
 	return nil
 }
 
-func Init(intf string) {
+// Server answers DHCP requests received on a single interface
+type Server struct {
+	intf    string
+	ifi     *net.Interface
+	ip      net.IP
+	ipNet   *net.IPNet
+	conn    net.PacketConn
+	serving atomic.Bool
+	closing atomic.Bool
+	done    chan struct{}
+}
+
+func NewServer(intf string) *Server {
+	return &Server{intf: intf, done: make(chan struct{})}
+}
+
+func (s *Server) Name() string {
+	return "dhcpd " + s.intf
+}
+
+// Listen opens a raw socket on the interface
+func (s *Server) Listen() error {
 	//create the device classes for x86 and arm
 	//64bit x86 UEFI
 	var x86_64 models.DeviceClass
@@ -516,151 +593,177 @@ func Init(intf string) {
 	}
 
 	// Select interface to used
-	ifi, err := net.InterfaceByName(intf)
+	ifi, err := net.InterfaceByName(s.intf)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"if":  intf,
-			"err": err,
-		}).Fatalf("dhcp: failed to open interface")
+		return fmt.Errorf("dhcp: failed to open interface %s: %w", s.intf, err)
 	}
+	s.ifi = ifi
 
 	// Find the ip-address
-	ip, ipNet, err := FindIPv4Addr(ifi)
+	s.ip, s.ipNet, err = FindIPv4Addr(ifi)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"if":  intf,
-			"err": err,
-		}).Fatalf("dhcp: failed to get interface IPv4 address")
+		return fmt.Errorf("dhcp: failed to get interface %s IPv4 address: %w", s.intf, err)
 	}
 
-	mac := ifi.HardwareAddr
-
 	// Open a raw socket using ethertype 0x0800 (IPv4)
-	c, err := raw.ListenPacket(ifi, 0x0800, &raw.Config{})
+	s.conn, err = raw.ListenPacket(ifi, 0x0800, &raw.Config{})
 	if err != nil {
-		logrus.Fatalf("dhcp: failed to listen: %v", err)
+		return fmt.Errorf("dhcp: failed to listen: %w", err)
 	}
-	defer func() {
-		err := c.Close()
-		if err != nil {
-			logrus.WithFields(logrus.Fields{
-				"if":  intf,
-				"err": err,
-			}).Errorf("dhcp: failed to close socket")
-		}
-	}()
+
+	return nil
+}
+
+// Serve answers requests until Shutdown is called
+func (s *Server) Serve(ctx context.Context) error {
+	s.serving.Store(true)
+	defer close(s.done)
 
 	logrus.WithFields(logrus.Fields{
-		"mac": mac,
-		"ip":  ip,
-		"int": intf,
+		"mac": s.ifi.HardwareAddr,
+		"ip":  s.ip,
+		"int": s.intf,
 	}).Infof("Starting dhcp server")
 
 	// Accept frames up to interface's MTU in size
-	b := make([]byte, ifi.MTU)
+	b := make([]byte, s.ifi.MTU)
 
 	// Keep reading frames
 	for {
-		n, src, err := c.ReadFrom(b)
+		n, src, err := s.conn.ReadFrom(b)
 		if err != nil {
-			logrus.Fatalf("dhcp: failed to receive message: %v", err)
+			if s.closing.Load() {
+				return nil
+			}
+			return fmt.Errorf("dhcp: failed to receive message: %w", err)
 		}
 
-		packet := gopacket.NewPacket(b[:n], layers.LayerTypeEthernet, gopacket.Default)
+		s.handle(b[:n], src)
+	}
+}
+
+// Shutdown lets the request that is currently being answered finish and closes the socket
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.conn == nil {
+		return nil
+	}
+	s.closing.Store(true)
+
+	if s.serving.Load() {
+		// unblock ReadFrom, the current request is still answered
+		if err := s.conn.SetReadDeadline(time.Now()); err == nil {
+			select {
+			case <-s.done:
+			case <-ctx.Done():
+			}
+		}
+	}
 
-		ethLayer := packet.Layer(layers.LayerTypeEthernet)
-		ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
-		udpLayer := packet.Layer(layers.LayerTypeUDP)
-		dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
+	err := s.conn.Close()
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"if":  s.intf,
+			"err": err,
+		}).Errorf("dhcp: failed to close socket")
+	}
+	return err
+}
 
-		if ethLayer != nil && ipv4Layer != nil && udpLayer != nil && dhcpLayer != nil {
-			eth, _ := ethLayer.(*layers.Ethernet)
-			ipv4, _ := ipv4Layer.(*layers.IPv4)
-			udp, _ := udpLayer.(*layers.UDP)
-			req, _ := dhcpLayer.(*layers.DHCPv4)
+func (s *Server) handle(b []byte, src net.Addr) {
+	packet := gopacket.NewPacket(b, layers.LayerTypeEthernet, gopacket.Default)
 
-			//spew.Dump(req)
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	ipv4Layer := packet.Layer(layers.LayerTypeIPv4)
+	udpLayer := packet.Layer(layers.LayerTypeUDP)
+	dhcpLayer := packet.Layer(layers.LayerTypeDHCPv4)
 
-			t := findMsgType(req)
-			sourceNet := ip
-			source := "broadcast"
-			if ipNet != nil && !ipNet.Contains(ipv4.SrcIP) && !ipv4.SrcIP.Equal(net.IPv4zero) {
-				sourceNet = ipv4.SrcIP
-				source = "unicast"
-			}
+	if ethLayer != nil && ipv4Layer != nil && udpLayer != nil && dhcpLayer != nil {
+		eth, _ := ethLayer.(*layers.Ethernet)
+		ipv4, _ := ipv4Layer.(*layers.IPv4)
+		udp, _ := udpLayer.(*layers.UDP)
+		req, _ := dhcpLayer.(*layers.DHCPv4)
 
-			if (req.RelayAgentIP != nil && !req.RelayAgentIP.Equal(net.IP{0, 0, 0, 0})) {
-				sourceNet = req.RelayAgentIP
-				source = "relayed"
-			}
+		//spew.Dump(req)
 
-			resp, err := processPacket(t, req, sourceNet, ip)
+		t := findMsgType(req)
+		sourceNet := s.ip
+		source := "broadcast"
+		if s.ipNet != nil && !s.ipNet.Contains(ipv4.SrcIP) && !ipv4.SrcIP.Equal(net.IPv4zero) {
+			sourceNet = ipv4.SrcIP
+			source = "unicast"
+		}
 
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"type":       t.String(),
-					"client-mac": req.ClientHWAddr.String(),
-					"source":     sourceNet.String(),
-					"relay":      req.RelayAgentIP,
-					"error":      err,
-				}).Warnf("dhcp: failed to process %s %s", source, t)
-				continue
-			}
+		if (req.RelayAgentIP != nil && !req.RelayAgentIP.Equal(net.IP{0, 0, 0, 0})) {
+			sourceNet = req.RelayAgentIP
+			source = "relayed"
+		}
 
-			// Copy some information from the request like option 82 (agent info) to the response
-			resp.Flags = req.Flags
-			for _, v := range req.Options {
-				if v.Type == layers.DHCPOptClientID {
-					resp.Options = append(resp.Options, v)
-				}
-				if v.Type == layers.DHCPOptHostname {
-					resp.Options = append(resp.Options, v)
-				}
-				if v.Type == 82 {
-					resp.Options = append(resp.Options, v)
-				}
-			}
+		resp, err := processPacket(t, req, sourceNet, s.ip)
 
-			layers := buildHeaders(mac, ip, eth, ipv4, udp)
-			layers = append(layers, resp)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"type":       t.String(),
+				"client-mac": req.ClientHWAddr.String(),
+				"source":     sourceNet.String(),
+				"relay":      req.RelayAgentIP,
+				"error":      err,
+			}).Warnf("dhcp: failed to process %s %s", source, t)
+			return
+		}
 
-			buf := gopacket.NewSerializeBuffer()
-			opts := gopacket.SerializeOptions{
-				FixLengths:       true,
-				ComputeChecksums: true,
+		// Copy some information from the request like option 82 (agent info) to the response
+		resp.Flags = req.Flags
+		for _, v := range req.Options {
+			if v.Type == layers.DHCPOptClientID {
+				resp.Options = append(resp.Options, v)
 			}
-			err = gopacket.SerializeLayers(buf, opts, layers...)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"response":   findMsgType(resp).String(),
-					"client-mac": req.ClientHWAddr.String(),
-					"ip":         resp.YourClientIP,
-					"relay":      req.RelayAgentIP,
-				}).Warnf("dhcp: failed to serialise response to %s %s", source, t)
-				continue
+			if v.Type == layers.DHCPOptHostname {
+				resp.Options = append(resp.Options, v)
 			}
-
-			_, err = c.WriteTo(buf.Bytes(), src)
-			if err != nil {
-				logrus.WithFields(logrus.Fields{
-					"response":   findMsgType(resp).String(),
-					"client-mac": req.ClientHWAddr.String(),
-					"ip":         resp.YourClientIP,
-					"relay":      req.RelayAgentIP,
-				}).Warnf("dhcp: failed to send response to %s %s", source, t)
-				continue
+			if v.Type == 82 {
+				resp.Options = append(resp.Options, v)
 			}
+		}
 
-			//spew.Dump(resp)
+		layers := buildHeaders(s.ifi.HardwareAddr, s.ip, eth, ipv4, udp)
+		layers = append(layers, resp)
+
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		}
+		err = gopacket.SerializeLayers(buf, opts, layers...)
+		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"response":   findMsgType(resp).String(),
 				"client-mac": req.ClientHWAddr.String(),
 				"ip":         resp.YourClientIP,
 				"relay":      req.RelayAgentIP,
-			}).Infof("dhcp: answered %s %s with %s", source, t, findMsgType(resp))
-			for _, v := range resp.Options {
-				logrus.Debug(v)
-			}
+			}).Warnf("dhcp: failed to serialise response to %s %s", source, t)
+			return
+		}
+
+		_, err = s.conn.WriteTo(buf.Bytes(), src)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"response":   findMsgType(resp).String(),
+				"client-mac": req.ClientHWAddr.String(),
+				"ip":         resp.YourClientIP,
+				"relay":      req.RelayAgentIP,
+			}).Warnf("dhcp: failed to send response to %s %s", source, t)
+			return
+		}
+
+		//spew.Dump(resp)
+		logrus.WithFields(logrus.Fields{
+			"response":   findMsgType(resp).String(),
+			"client-mac": req.ClientHWAddr.String(),
+			"ip":         resp.YourClientIP,
+			"relay":      req.RelayAgentIP,
+		}).Infof("dhcp: answered %s %s with %s", source, t, findMsgType(resp))
+		for _, v := range resp.Options {
+			logrus.Debug(v)
 		}
 	}
 }
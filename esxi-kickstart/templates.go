@@ -0,0 +1,7 @@
+// Package esxikickstart contains the kickstarts that are seeded as built-in templates.
+package esxikickstart
+
+import "embed"
+
+//go:embed *.cfg
+var Files embed.FS
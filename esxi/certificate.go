@@ -0,0 +1,85 @@
+package esxi
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CertificateSigningRequest lets the host generate a new key and returns the request for a certificate for it
+func (h *Host) CertificateSigningRequest(ctx context.Context) (string, error) {
+	m, err := h.host.ConfigManager().CertificateManager(ctx)
+	if err != nil {
+		return "", err
+	}
+	return m.GenerateCertificateSigningRequest(ctx, false)
+}
+
+// InstallCertificate makes the host trust ca and replaces the certificate of the host with cert, which has
+// to belong to the key of the last signing request. It waits until the host presents the new certificate.
+func (h *Host) InstallCertificate(ctx context.Context, u *url.URL, cert string, ca string) error {
+	block, _ := pem.Decode([]byte(cert))
+	if block == nil {
+		return fmt.Errorf("the certificate is not PEM encoded")
+	}
+	installed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	m, err := h.host.ConfigManager().CertificateManager(ctx)
+	if err != nil {
+		return err
+	}
+
+	// the host has to trust the issuer, otherwise it refuses its own certificate
+	trusted, err := m.ListCACertificates(ctx)
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, t := range trusted {
+		if strings.TrimSpace(t) == strings.TrimSpace(ca) {
+			found = true
+		}
+	}
+	if !found {
+		crls, err := m.ListCACertificateRevocationLists(ctx)
+		if err != nil {
+			return err
+		}
+		if err := m.ReplaceCACertificatesAndCRLs(ctx, append(trusted, ca), crls); err != nil {
+			return fmt.Errorf("could not add the CA to the host: %w", err)
+		}
+	}
+
+	if err := m.InstallServerCertificate(ctx, cert); err != nil {
+		return fmt.Errorf("could not install the certificate: %w", err)
+	}
+
+	// the services of the host pick up the certificate on their own, which takes a moment
+	for {
+		presented, err := presentedCertificate(ctx, u.Host)
+		if err == nil && presented.Equal(installed) {
+			h.certificate = presented
+			// new connections of the session have to accept the new certificate
+			h.client.SetThumbprint(u.Host, h.Thumbprint())
+			logrus.WithFields(logrus.Fields{
+				"host":       u.Host,
+				"thumbprint": h.Thumbprint(),
+			}).Info("esxi: installed certificate")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s did not present the new certificate: %w", u.Host, ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+}
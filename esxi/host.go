@@ -0,0 +1,231 @@
+// Package esxi configures installed ESXi hosts through their vSphere API.
+package esxi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Host is a session on the vSphere API of an ESXi host
+type Host struct {
+	client *govmomi.Client
+	host   *object.HostSystem
+	// the certificate the host presented when the session was opened
+	certificate *x509.Certificate
+}
+
+// Connect logs in to the vSphere API of a host. A freshly installed host takes a while before hostd
+// answers, so it retries every interval until it succeeds or ctx is done. The session is pinned to the
+// certificate the host presented when it answered.
+func Connect(ctx context.Context, u *url.URL, interval time.Duration) (*Host, error) {
+	for attempt := 1; ; attempt++ {
+		c, cert, err := login(ctx, u)
+		if err == nil {
+			host, err := find.NewFinder(c.Client).DefaultHostSystem(ctx)
+			if err != nil {
+				c.Logout(ctx)
+				return nil, err
+			}
+			return &Host{client: c, host: host, certificate: cert}, nil
+		}
+		if isInvalidLogin(err) {
+			return nil, fmt.Errorf("could not log in to %s: %w", u.Host, err)
+		}
+
+		logrus.WithFields(logrus.Fields{
+			"host":    u.Host,
+			"attempt": attempt,
+			"err":     err,
+		}).Debug("esxi: the vSphere API is not ready yet")
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("the vSphere API of %s did not answer: %w", u.Host, err)
+		case <-time.After(interval):
+		}
+	}
+}
+
+// login logs in to the host, pinned to the certificate it presents
+func login(ctx context.Context, u *url.URL) (*govmomi.Client, *x509.Certificate, error) {
+	cert, err := presentedCertificate(ctx, u.Host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sc := soap.NewClient(u, false)
+	sc.SetThumbprint(u.Host, soap.ThumbprintSHA1(cert))
+	vc, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		return nil, nil, err
+	}
+	c := &govmomi.Client{Client: vc, SessionManager: session.NewManager(vc)}
+	if err := c.Login(ctx, u.User); err != nil {
+		return nil, nil, err
+	}
+	return c, cert, nil
+}
+
+// presentedCertificate returns the certificate a server presents
+func presentedCertificate(ctx context.Context, host string) (*x509.Certificate, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	d := tls.Dialer{Config: &tls.Config{InsecureSkipVerify: true}}
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s presented no certificate", host)
+	}
+	return certs[0], nil
+}
+
+// Certificate returns the certificate of the host
+func (h *Host) Certificate() *x509.Certificate {
+	return h.certificate
+}
+
+// Thumbprint returns the SHA-1 thumbprint of the certificate of the host, as vCenter expects it
+func (h *Host) Thumbprint() string {
+	return soap.ThumbprintSHA1(h.certificate)
+}
+
+// Logout ends the session
+func (h *Host) Logout(ctx context.Context) error {
+	return h.client.Logout(ctx)
+}
+
+// Expected is the configuration the kickstart should have left on the host, empty fields aren't verified
+type Expected struct {
+	Hostname string
+	Domain   string
+	DNS      []string
+	NTP      []string
+	Syslog   string
+}
+
+// Verify compares the configuration of the host with the expected one and reports every difference
+func (h *Host) Verify(ctx context.Context, want Expected) error {
+	var host mo.HostSystem
+	if err := h.host.Properties(ctx, h.host.Reference(), []string{"config.network.dnsConfig", "config.dateTimeInfo"}, &host); err != nil {
+		return err
+	}
+
+	var problems []string
+
+	var dns *types.HostDnsConfig
+	if host.Config != nil && host.Config.Network != nil && host.Config.Network.DnsConfig != nil {
+		dns = host.Config.Network.DnsConfig.GetHostDnsConfig()
+	}
+	if dns == nil {
+		dns = &types.HostDnsConfig{}
+	}
+	if want.Hostname != "" && !strings.EqualFold(dns.HostName, want.Hostname) {
+		problems = append(problems, fmt.Sprintf("hostname is %q instead of %q", dns.HostName, want.Hostname))
+	}
+	if want.Domain != "" && !strings.EqualFold(dns.DomainName, want.Domain) {
+		problems = append(problems, fmt.Sprintf("domain is %q instead of %q", dns.DomainName, want.Domain))
+	}
+	if missing := missingFrom(dns.Address, want.DNS); len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("dns servers %s are missing", strings.Join(missing, ", ")))
+	}
+
+	var ntp []string
+	if host.Config != nil && host.Config.DateTimeInfo != nil && host.Config.DateTimeInfo.NtpConfig != nil {
+		ntp = host.Config.DateTimeInfo.NtpConfig.Server
+	}
+	if missing := missingFrom(ntp, want.NTP); len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("ntp servers %s are missing", strings.Join(missing, ", ")))
+	}
+
+	if want.Syslog != "" {
+		logHost, err := h.option(ctx, "Syslog.global.logHost")
+		if err != nil {
+			return err
+		}
+		if got, _ := logHost.(string); got != want.Syslog {
+			problems = append(problems, fmt.Sprintf("syslog is %q instead of %q", got, want.Syslog))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("the host is not configured as expected: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// option returns the value of an advanced setting, nil if the host doesn't have it
+func (h *Host) option(ctx context.Context, key string) (interface{}, error) {
+	m, err := h.host.ConfigManager().OptionManager(ctx)
+	if err != nil {
+		return nil, err
+	}
+	values, err := m.Query(ctx, key)
+	if err != nil {
+		if isInvalidName(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// the query matches by prefix
+	for _, v := range values {
+		if o := v.GetOptionValue(); o.Key == key {
+			return o.Value, nil
+		}
+	}
+	return nil, nil
+}
+
+// missingFrom returns the values of want that aren't in have
+func missingFrom(have []string, want []string) []string {
+	var missing []string
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if strings.EqualFold(h, w) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, w)
+		}
+	}
+	return missing
+}
+
+func isInvalidLogin(err error) bool {
+	if soap.IsSoapFault(err) {
+		_, ok := soap.ToSoapFault(err).VimFault().(types.InvalidLogin)
+		return ok
+	}
+	return false
+}
+
+func isInvalidName(err error) bool {
+	if soap.IsSoapFault(err) {
+		_, ok := soap.ToSoapFault(err).VimFault().(types.InvalidName)
+		return ok
+	}
+	return false
+}
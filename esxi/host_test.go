@@ -0,0 +1,285 @@
+package esxi
+
+import (
+	"context"
+	"crypto/tls"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/maxiepax/go-via/models"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// newESX starts a simulated ESXi host that only accepts root with the given password
+func newESX(t *testing.T, password string) *simulator.Server {
+	t.Helper()
+	model := simulator.ESX()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	model.Service.Listen = &url.URL{User: url.UserPassword("root", password)}
+	s := model.Service.NewServer()
+	t.Cleanup(func() {
+		s.Close()
+		model.Remove()
+	})
+	return s
+}
+
+func connect(t *testing.T, s *simulator.Server) *Host {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	h, err := Connect(ctx, s.URL, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Logout(context.Background()) })
+	return h
+}
+
+func TestConnect(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	h := connect(t, s)
+	if h.Thumbprint() != soap.ThumbprintSHA1(s.Certificate()) {
+		t.Errorf("thumbprint %s doesn't match the certificate of the host", h.Thumbprint())
+	}
+
+	// a wrong password won't get better by retrying
+	u := *s.URL
+	u.User = url.UserPassword("root", "wrong")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	start := time.Now()
+	if _, err := Connect(ctx, &u, time.Second); err == nil || !strings.Contains(err.Error(), "could not log in") {
+		t.Fatalf("expected a login error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatal("retried a failed login")
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	u := *s.URL
+	s.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := Connect(ctx, &u, 20*time.Millisecond); err == nil || !strings.Contains(err.Error(), "did not answer") {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	h := connect(t, s)
+	ctx := context.Background()
+
+	// the simulator has no date time system, configure ntp on the host directly
+	host := simulator.Map.Get(h.host.Reference()).(*simulator.HostSystem)
+	host.Config.DateTimeInfo = &types.HostDateTimeInfo{NtpConfig: &types.HostNtpConfig{Server: []string{"ntp1.example.com", "ntp2.example.com"}}}
+	setOption(t, h, "Syslog.global.logHost", "udp://10.0.0.2:514")
+
+	// the simulated host is localhost.localdomain with 8.8.8.8 as its dns server
+	expected := Expected{
+		Hostname: "localhost",
+		Domain:   "localdomain",
+		DNS:      []string{"8.8.8.8"},
+		NTP:      []string{"ntp2.example.com", "ntp1.example.com"},
+		Syslog:   "udp://10.0.0.2:514",
+	}
+	if err := h.Verify(ctx, expected); err != nil {
+		t.Fatal(err)
+	}
+
+	// empty fields aren't verified
+	if err := h.Verify(ctx, Expected{Hostname: "LOCALHOST"}); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := Expected{
+		Hostname: "esx01",
+		Domain:   "localdomain",
+		DNS:      []string{"8.8.8.8", "10.0.0.53"},
+		NTP:      []string{"ntp3.example.com"},
+		Syslog:   "udp://10.0.0.3:514",
+	}
+	err := h.Verify(ctx, wrong)
+	if err == nil {
+		t.Fatal("expected the verification to fail")
+	}
+	for _, problem := range []string{`hostname is "localhost" instead of "esx01"`, "dns servers 10.0.0.53 are missing", "ntp servers ntp3.example.com are missing", `syslog is "udp://10.0.0.2:514"`} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q doesn't report %q", err, problem)
+		}
+	}
+	if strings.Contains(err.Error(), "domain") {
+		t.Errorf("%q reports the domain, which is correct", err)
+	}
+}
+
+func TestVerifyWithoutSyslog(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	h := connect(t, s)
+
+	err := h.Verify(context.Background(), Expected{Syslog: "udp://10.0.0.2:514"})
+	if err == nil || !strings.Contains(err.Error(), `syslog is "" instead of`) {
+		t.Fatalf("expected a missing syslog to be reported, got %v", err)
+	}
+}
+
+func TestApply(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	h := connect(t, s)
+	ctx := context.Background()
+
+	pc := models.PostConfig{
+		VSwitches: []models.VSwitchConfig{
+			{Name: "vSwitch1", Uplinks: []string{"vmnic2", "vmnic3"}, MTU: 9000},
+		},
+		PortGroups: []models.PortGroupConfig{
+			{Name: "vMotion", VSwitch: "vSwitch1", VLAN: 20},
+			{Name: "Storage", VSwitch: "vSwitch1", VLAN: 30},
+		},
+		AdvancedSettings: map[string]interface{}{
+			"Config.HostAgent.log.level": "verbose",
+		},
+	}
+	if err := h.Apply(ctx, pc); err != nil {
+		t.Fatal(err)
+	}
+
+	network := networkInfo(t, h)
+	found := false
+	for _, vs := range network.Vswitch {
+		if vs.Name == "vSwitch1" {
+			found = true
+			if strings.Join(vs.Portgroup, ",") != "vMotion,Storage" {
+				t.Errorf("vSwitch1 has portgroups %v", vs.Portgroup)
+			}
+		}
+	}
+	if !found {
+		t.Fatal("vSwitch1 wasn't added")
+	}
+	vlans := map[string]int32{}
+	for _, pg := range network.Portgroup {
+		vlans[pg.Spec.Name] = pg.Spec.VlanId
+	}
+	if vlans["vMotion"] != 20 || vlans["Storage"] != 30 {
+		t.Errorf("unexpected portgroups %v", vlans)
+	}
+
+	if v, err := h.option(ctx, "Config.HostAgent.log.level"); err != nil || v != "verbose" {
+		t.Errorf("Config.HostAgent.log.level is %v (%v)", v, err)
+	}
+
+	// portgroups and settings that already match are left alone
+	pc.VSwitches = nil
+	if err := h.Apply(ctx, pc); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestApplyUnknownSetting(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	h := connect(t, s)
+
+	pc := models.PostConfig{AdvancedSettings: map[string]interface{}{"Net.DoesNotExist": 1}}
+	if err := h.Apply(context.Background(), pc); err == nil || !strings.Contains(err.Error(), "no advanced setting Net.DoesNotExist") {
+		t.Fatalf("expected an unknown setting to fail, got %v", err)
+	}
+}
+
+func TestApplyUnknownVSwitch(t *testing.T) {
+	s := newESX(t, "VMware1!")
+	h := connect(t, s)
+
+	pc := models.PostConfig{PortGroups: []models.PortGroupConfig{{Name: "vMotion", VSwitch: "vSwitch9"}}}
+	if err := h.Apply(context.Background(), pc); err == nil || !strings.Contains(err.Error(), "could not add portgroup vMotion") {
+		t.Fatalf("expected a portgroup on a missing vswitch to fail, got %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := models.PostConfig{
+		VSwitches:        []models.VSwitchConfig{{Name: "vSwitch1", Uplinks: []string{"vmnic1"}, MTU: 9000}},
+		PortGroups:       []models.PortGroupConfig{{Name: "vMotion", VSwitch: "vSwitch1", VLAN: 4095}},
+		AdvancedSettings: map[string]interface{}{"UserVars.SuppressShellWarning": float64(1), "Net.TcpipHeapSize": "32", "Misc.Flag": true},
+	}
+	if err := Validate(valid); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := []models.PostConfig{
+		{VSwitches: []models.VSwitchConfig{{Uplinks: []string{"vmnic1"}}}},
+		{VSwitches: []models.VSwitchConfig{{Name: "vSwitch1"}, {Name: "vSwitch1"}}},
+		{VSwitches: []models.VSwitchConfig{{Name: "vSwitch1", MTU: 100}}},
+		{PortGroups: []models.PortGroupConfig{{Name: "vMotion"}}},
+		{PortGroups: []models.PortGroupConfig{{Name: "vMotion", VSwitch: "vSwitch0", VLAN: 4096}}},
+		{PortGroups: []models.PortGroupConfig{{Name: "vMotion", VSwitch: "vSwitch0"}, {Name: "vMotion", VSwitch: "vSwitch1"}}},
+		{AdvancedSettings: map[string]interface{}{"Net.List": []interface{}{"a"}}},
+	}
+	for i, pc := range invalid {
+		if err := Validate(pc); err == nil {
+			t.Errorf("%d: expected %+v to be invalid", i, pc)
+		}
+	}
+}
+
+func TestOptionValue(t *testing.T) {
+	tests := []struct {
+		current interface{}
+		value   interface{}
+		want    interface{}
+	}{
+		{"info", "verbose", "verbose"},
+		{"info", float64(3), "3"},
+		{int32(0), float64(1), int32(1)},
+		{int64(0), float64(1e6), int64(1000000)},
+		{int64(0), "42", int64(42)},
+		{false, true, true},
+		{false, "true", true},
+	}
+	for _, tt := range tests {
+		got, err := optionValue(tt.current, tt.value)
+		if err != nil || got != tt.want {
+			t.Errorf("optionValue(%#v, %#v) = %#v, %v, want %#v", tt.current, tt.value, got, err, tt.want)
+		}
+	}
+
+	if _, err := optionValue(int32(0), "a lot"); err == nil {
+		t.Error("expected a string to be refused for a number")
+	}
+}
+
+func setOption(t *testing.T, h *Host, key string, value interface{}) {
+	t.Helper()
+	m, err := h.host.ConfigManager().OptionManager(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(context.Background(), []types.BaseOptionValue{&types.OptionValue{Key: key, Value: value}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func networkInfo(t *testing.T, h *Host) *types.HostNetworkInfo {
+	t.Helper()
+	ns, err := h.host.ConfigManager().NetworkSystem(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var network mo.HostNetworkSystem
+	if err := ns.Properties(context.Background(), ns.Reference(), []string{"networkInfo"}, &network); err != nil {
+		t.Fatal(err)
+	}
+	return network.NetworkInfo
+}
@@ -0,0 +1,253 @@
+package esxi
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Validate checks the post-config of a group before a host fails on it
+func Validate(pc models.PostConfig) error {
+	vswitches := map[string]bool{}
+	for _, vs := range pc.VSwitches {
+		if vs.Name == "" {
+			return fmt.Errorf("postconfig: every vswitch needs a name")
+		}
+		if vswitches[vs.Name] {
+			return fmt.Errorf("postconfig: vswitch %s is configured twice", vs.Name)
+		}
+		vswitches[vs.Name] = true
+		if vs.MTU != 0 && (vs.MTU < 1280 || vs.MTU > 9000) {
+			return fmt.Errorf("postconfig: the mtu of vswitch %s must be between 1280 and 9000", vs.Name)
+		}
+	}
+
+	portgroups := map[string]bool{}
+	for _, pg := range pc.PortGroups {
+		if pg.Name == "" || pg.VSwitch == "" {
+			return fmt.Errorf("postconfig: every portgroup needs a name and a vswitch")
+		}
+		if portgroups[pg.Name] {
+			return fmt.Errorf("postconfig: portgroup %s is configured twice", pg.Name)
+		}
+		portgroups[pg.Name] = true
+		// 4095 trunks all vlans to the guests
+		if pg.VLAN < 0 || pg.VLAN > 4095 {
+			return fmt.Errorf("postconfig: the vlan of portgroup %s must be between 0 and 4095", pg.Name)
+		}
+	}
+
+	for key, value := range pc.AdvancedSettings {
+		switch value.(type) {
+		case string, float64, bool:
+		default:
+			return fmt.Errorf("postconfig: advanced setting %s must be a string, number or boolean", key)
+		}
+	}
+	return nil
+}
+
+// Apply brings the host in line with the post-config, settings that already match are left alone
+func (h *Host) Apply(ctx context.Context, pc models.PostConfig) error {
+	if len(pc.VSwitches) > 0 || len(pc.PortGroups) > 0 {
+		if err := h.applyNetwork(ctx, pc); err != nil {
+			return err
+		}
+	}
+	if len(pc.AdvancedSettings) > 0 {
+		if err := h.applyAdvancedSettings(ctx, pc.AdvancedSettings); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *Host) applyNetwork(ctx context.Context, pc models.PostConfig) error {
+	ns, err := h.host.ConfigManager().NetworkSystem(ctx)
+	if err != nil {
+		return err
+	}
+	var network mo.HostNetworkSystem
+	if err := ns.Properties(ctx, ns.Reference(), []string{"networkInfo"}, &network); err != nil {
+		return err
+	}
+	if network.NetworkInfo == nil {
+		network.NetworkInfo = &types.HostNetworkInfo{}
+	}
+
+	for _, vs := range pc.VSwitches {
+		var current *types.HostVirtualSwitch
+		for i := range network.NetworkInfo.Vswitch {
+			if network.NetworkInfo.Vswitch[i].Name == vs.Name {
+				current = &network.NetworkInfo.Vswitch[i]
+			}
+		}
+
+		if current == nil {
+			spec := types.HostVirtualSwitchSpec{NumPorts: 128}
+			vswitchSpec(&spec, vs)
+			if err := ns.AddVirtualSwitch(ctx, vs.Name, &spec); err != nil {
+				return fmt.Errorf("could not add vswitch %s: %w", vs.Name, err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"vswitch": vs.Name,
+				"uplinks": vs.Uplinks,
+				"mtu":     vs.MTU,
+			}).Info("postconfig: added vswitch")
+			continue
+		}
+
+		spec := current.Spec
+		if !vswitchSpec(&spec, vs) {
+			continue
+		}
+		if err := ns.UpdateVirtualSwitch(ctx, vs.Name, spec); err != nil {
+			return fmt.Errorf("could not update vswitch %s: %w", vs.Name, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"vswitch": vs.Name,
+			"uplinks": vs.Uplinks,
+			"mtu":     vs.MTU,
+		}).Info("postconfig: updated vswitch")
+	}
+
+	for _, pg := range pc.PortGroups {
+		var current *types.HostPortGroup
+		for i := range network.NetworkInfo.Portgroup {
+			if network.NetworkInfo.Portgroup[i].Spec.Name == pg.Name {
+				current = &network.NetworkInfo.Portgroup[i]
+			}
+		}
+
+		if current == nil {
+			spec := types.HostPortGroupSpec{Name: pg.Name, VswitchName: pg.VSwitch, VlanId: int32(pg.VLAN)}
+			if err := ns.AddPortGroup(ctx, spec); err != nil {
+				return fmt.Errorf("could not add portgroup %s: %w", pg.Name, err)
+			}
+			logrus.WithFields(logrus.Fields{
+				"portgroup": pg.Name,
+				"vswitch":   pg.VSwitch,
+				"vlan":      pg.VLAN,
+			}).Info("postconfig: added portgroup")
+			continue
+		}
+
+		if current.Spec.VswitchName == pg.VSwitch && current.Spec.VlanId == int32(pg.VLAN) {
+			continue
+		}
+		spec := current.Spec
+		spec.VswitchName = pg.VSwitch
+		spec.VlanId = int32(pg.VLAN)
+		if err := ns.UpdatePortGroup(ctx, pg.Name, spec); err != nil {
+			return fmt.Errorf("could not update portgroup %s: %w", pg.Name, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"portgroup": pg.Name,
+			"vswitch":   pg.VSwitch,
+			"vlan":      pg.VLAN,
+		}).Info("postconfig: updated portgroup")
+	}
+	return nil
+}
+
+// vswitchSpec sets the uplinks and mtu of the post-config on spec, it reports if anything changed
+func vswitchSpec(spec *types.HostVirtualSwitchSpec, vs models.VSwitchConfig) bool {
+	changed := false
+	if vs.MTU != 0 && spec.Mtu != int32(vs.MTU) {
+		spec.Mtu = int32(vs.MTU)
+		changed = true
+	}
+	if len(vs.Uplinks) == 0 {
+		return changed
+	}
+
+	var current []string
+	if bridge, ok := spec.Bridge.(*types.HostVirtualSwitchBondBridge); ok {
+		current = bridge.NicDevice
+	}
+	if reflect.DeepEqual(current, vs.Uplinks) {
+		return changed
+	}
+	spec.Bridge = &types.HostVirtualSwitchBondBridge{NicDevice: vs.Uplinks}
+	// the uplinks are active in the order they are configured
+	if spec.Policy == nil {
+		spec.Policy = &types.HostNetworkPolicy{}
+	}
+	if spec.Policy.NicTeaming == nil {
+		spec.Policy.NicTeaming = &types.HostNicTeamingPolicy{}
+	}
+	spec.Policy.NicTeaming.NicOrder = &types.HostNicOrderPolicy{ActiveNic: vs.Uplinks}
+	return true
+}
+
+func (h *Host) applyAdvancedSettings(ctx context.Context, settings map[string]interface{}) error {
+	m, err := h.host.ConfigManager().OptionManager(ctx)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var changes []types.BaseOptionValue
+	for _, key := range keys {
+		current, err := h.option(ctx, key)
+		if err != nil {
+			return err
+		}
+		if current == nil {
+			return fmt.Errorf("the host has no advanced setting %s", key)
+		}
+		value, err := optionValue(current, settings[key])
+		if err != nil {
+			return fmt.Errorf("advanced setting %s: %w", key, err)
+		}
+		if value == current {
+			continue
+		}
+		changes = append(changes, &types.OptionValue{Key: key, Value: value})
+		logrus.WithFields(logrus.Fields{
+			"setting": key,
+			"from":    current,
+			"to":      value,
+		}).Info("postconfig: advanced setting")
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	return m.Update(ctx, changes)
+}
+
+// optionValue converts a value from the post-config to the type of the current value of the setting,
+// the API refuses values of another type
+func optionValue(current interface{}, value interface{}) (interface{}, error) {
+	s := fmt.Sprint(value)
+	if f, ok := value.(float64); ok {
+		s = strconv.FormatFloat(f, 'f', -1, 64)
+	}
+	switch current.(type) {
+	case string:
+		return s, nil
+	case bool:
+		return strconv.ParseBool(s)
+	case int32:
+		i, err := strconv.ParseInt(s, 10, 32)
+		return int32(i), err
+	case int64:
+		return strconv.ParseInt(s, 10, 64)
+	case int:
+		return strconv.Atoi(s)
+	}
+	return nil, fmt.Errorf("settings of type %T are not supported", current)
+}
@@ -1,5 +1,7 @@
 package ilomapi
 
+import "fmt"
+
 type IlomApi interface {
 	// GetEndpoint
 	GetEndpoint() string
@@ -32,3 +34,15 @@ type IfaceConfig struct {
 	Speed      string `json:"speed"`  // Added Speed field
 	Status     string `json:"status"` // Added Status field
 }
+
+// New returns the client for a BMC of the given api flavour, the port defaults to 443
+func New(apiFlavour, iloIpAddr, port, username, password string) (IlomApi, error) {
+	if port == "" {
+		port = "443"
+	}
+	switch apiFlavour {
+	case "redfish":
+		return NewRedFishApi(iloIpAddr, port, username, password), nil
+	}
+	return nil, fmt.Errorf("unsupported api flavour %q", apiFlavour)
+}
@@ -288,6 +288,7 @@ func (r *RedFishApi) RebootServer() error {
 	c, err := gofish.Connect(*r.config)
 	if err != nil {
 		log.Warnf("Failed to connect to Redfish API: %v", err)
+		return err
 	}
 	defer c.Logout()
 
@@ -316,6 +317,7 @@ func (r *RedFishApi) StartServer() error {
 	c, err := gofish.Connect(*r.config)
 	if err != nil {
 		log.Warnf("Failed to connect to Redfish API: %v", err)
+		return err
 	}
 	defer c.Logout()
 
@@ -344,6 +346,7 @@ func (r *RedFishApi) StopServer() error {
 	c, err := gofish.Connect(*r.config)
 	if err != nil {
 		log.Warnf("Failed to connect to Redfish API: %v", err)
+		return err
 	}
 	defer c.Logout()
 
@@ -0,0 +1,169 @@
+// Package jobs runs background work from a queue in the database, so it is resumed after a restart.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"gorm.io/gorm"
+)
+
+// the status of a job
+const (
+	Queued    = "queued"
+	Running   = "running"
+	Succeeded = "succeeded"
+	Failed    = "failed"
+	Cancelled = "cancelled"
+)
+
+// ErrInvalidStatus is returned when a job can't be cancelled or retried in its current status
+var ErrInvalidStatus = errors.New("invalid job status")
+
+// Handler runs a job. The context is cancelled when the job is cancelled or go-via shuts down, a job that
+// is interrupted by a shutdown runs again after the restart.
+type Handler func(ctx context.Context, job models.Job) error
+
+// Options of a job type
+type Options struct {
+	// the attempts before a job fails, defaults to 1
+	MaxAttempts int
+	// the delay after the first failed attempt, it doubles with every attempt up to an hour. defaults to 30 seconds
+	Backoff time.Duration
+}
+
+type jobType struct {
+	handler Handler
+	options Options
+}
+
+var (
+	typesMu sync.RWMutex
+	types   = map[string]jobType{}
+)
+
+// Register sets the handler of a job type
+func Register(name string, handler Handler, options Options) {
+	if options.MaxAttempts < 1 {
+		options.MaxAttempts = 1
+	}
+	if options.Backoff == 0 {
+		options.Backoff = 30 * time.Second
+	}
+	typesMu.Lock()
+	defer typesMu.Unlock()
+	types[name] = jobType{handler: handler, options: options}
+}
+
+func lookup(name string) (jobType, bool) {
+	typesMu.RLock()
+	defer typesMu.RUnlock()
+	t, ok := types[name]
+	return t, ok
+}
+
+// permanent is an error that isn't worth retrying
+type permanent struct {
+	err error
+}
+
+func (p permanent) Error() string { return p.err.Error() }
+func (p permanent) Unwrap() error { return p.err }
+
+// Permanent marks an error of a handler as final, the job fails without further attempts
+func Permanent(err error) error {
+	return permanent{err}
+}
+
+// LastAttempt reports if a failure of this attempt fails the job
+func LastAttempt(job models.Job) bool {
+	return job.Attempts >= job.MaxAttempts
+}
+
+// wakeup makes the queue look for jobs right away instead of at the next interval
+var wakeup = make(chan struct{}, 1)
+
+func wake() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Enqueue queues a job. A host only has one queued or running job of each type, queuing it again returns
+// that job.
+func Enqueue(tx *gorm.DB, name string, hostID int, payload interface{}) (models.Job, error) {
+	if tx == nil {
+		tx = db.DB
+	}
+	var job models.Job
+	t, ok := lookup(name)
+	if !ok {
+		return job, fmt.Errorf("unknown job type %s", name)
+	}
+
+	if hostID != 0 {
+		res := tx.Where("type = ? AND host_id = ? AND status IN ?", name, hostID, []string{Queued, Running}).Limit(1).Find(&job)
+		if res.Error != nil {
+			return job, res.Error
+		}
+		if res.RowsAffected > 0 {
+			wake()
+			return job, nil
+		}
+	}
+
+	job = models.Job{
+		Type:        name,
+		Status:      Queued,
+		MaxAttempts: t.options.MaxAttempts,
+		RunAt:       time.Now(),
+	}
+	if hostID != 0 {
+		job.HostID.Int32, job.HostID.Valid = int32(hostID), true
+	}
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			return job, err
+		}
+		job.Payload = b
+	}
+	if res := tx.Create(&job); res.Error != nil {
+		return job, res.Error
+	}
+
+	wake()
+	return job, nil
+}
+
+// Retry queues a failed or cancelled job again, with all its attempts
+func Retry(id int) (models.Job, error) {
+	var job models.Job
+	if res := db.DB.First(&job, id); res.Error != nil {
+		return job, res.Error
+	}
+	if job.Status != Failed && job.Status != Cancelled {
+		return job, fmt.Errorf("%w: the job is %s", ErrInvalidStatus, job.Status)
+	}
+
+	res := db.DB.Model(&job).Where("status = ?", job.Status).Updates(map[string]interface{}{
+		"status":      Queued,
+		"attempts":    0,
+		"run_at":      time.Now(),
+		"error":       "",
+		"finished_at": nil,
+	})
+	if res.Error != nil {
+		return job, res.Error
+	}
+
+	wake()
+	return job, db.DB.First(&job, id).Error
+}
@@ -0,0 +1,347 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+// the longest delay between two attempts of a job
+var maxBackoff = time.Hour
+
+// the jobs running in this instance, so they can be cancelled
+var (
+	runningMu sync.Mutex
+	running   = map[int]context.CancelFunc{}
+)
+
+// Cancel cancels a queued job, or stops a running one
+func Cancel(id int) (models.Job, error) {
+	var job models.Job
+	if res := db.DB.First(&job, id); res.Error != nil {
+		return job, res.Error
+	}
+	if job.Status != Queued && job.Status != Running {
+		return job, fmt.Errorf("%w: the job is %s", ErrInvalidStatus, job.Status)
+	}
+
+	now := time.Now()
+	res := db.DB.Model(&job).Where("status = ?", job.Status).Updates(map[string]interface{}{
+		"status":      Cancelled,
+		"error":       "cancelled",
+		"finished_at": now,
+	})
+	if res.Error != nil {
+		return job, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return job, fmt.Errorf("%w: the job changed in the meantime", ErrInvalidStatus)
+	}
+
+	runningMu.Lock()
+	if cancel, ok := running[id]; ok {
+		cancel()
+	}
+	runningMu.Unlock()
+
+	return job, db.DB.First(&job, id).Error
+}
+
+// Queue runs the queued jobs, at most workers at a time and one at a time per host. Running jobs hold a
+// lease that is renewed while they run, a job whose lease expired is run again.
+type Queue struct {
+	workers  int
+	interval time.Duration
+	lease    time.Duration
+	owner    string
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	active   int
+	activeMu sync.Mutex
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewQueue creates a Queue that looks for due jobs every interval
+func NewQueue(workers int, interval time.Duration, lease time.Duration) *Queue {
+	hostname, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Queue{
+		workers:  workers,
+		interval: interval,
+		lease:    lease,
+		owner:    hostname + "-" + secrets.NewNonce()[:8],
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (q *Queue) Name() string {
+	return "jobs"
+}
+
+func (q *Queue) Listen() error {
+	return nil
+}
+
+func (q *Queue) Serve(ctx context.Context) error {
+	defer close(q.stopped)
+	t := time.NewTicker(q.interval)
+	defer t.Stop()
+	for {
+		q.recover()
+		q.claim()
+		select {
+		case <-t.C:
+		case <-wakeup:
+		case <-q.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Shutdown interrupts the running jobs, they are queued again and resume after the restart
+func (q *Queue) Shutdown(ctx context.Context) error {
+	close(q.done)
+	q.cancel()
+
+	stopped := make(chan struct{})
+	go func() {
+		<-q.stopped
+		q.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the job queue did not stop: %w", ctx.Err())
+	}
+}
+
+// recover queues the jobs again whose lease expired, the instance that ran them stopped
+func (q *Queue) recover() {
+	var expired []models.Job
+	db.DB.Where("status = ? AND lease_expires_at < ?", Running, time.Now()).Find(&expired)
+	for _, job := range expired {
+		res := db.DB.Model(&job).Where("status = ? AND lease_owner = ?", Running, job.LeaseOwner).Updates(map[string]interface{}{
+			"status":           Queued,
+			"run_at":           time.Now(),
+			"lease_owner":      "",
+			"lease_expires_at": nil,
+		})
+		if res.Error == nil && res.RowsAffected > 0 {
+			logrus.WithFields(logrus.Fields{
+				"id":   job.ID,
+				"type": job.Type,
+				"host": job.HostID,
+			}).Warn("jobs: the job was interrupted, it is run again")
+		}
+	}
+}
+
+// claim starts the due jobs there are workers for, the oldest first
+func (q *Queue) claim() {
+	q.activeMu.Lock()
+	free := q.workers - q.active
+	q.activeMu.Unlock()
+	if free <= 0 {
+		return
+	}
+
+	// hosts that are busy with another job
+	var busy []int
+	db.DB.Model(&models.Job{}).Where("status = ? AND host_id IS NOT NULL", Running).Pluck("host_id", &busy)
+	hosts := map[int]bool{}
+	for _, id := range busy {
+		hosts[id] = true
+	}
+
+	var due []models.Job
+	if res := db.DB.Where("status = ? AND run_at <= ?", Queued, time.Now()).Order("id").Limit(100).Find(&due); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("jobs")
+		return
+	}
+
+	for _, job := range due {
+		if free == 0 {
+			return
+		}
+		if job.HostID.Valid {
+			if hosts[int(job.HostID.Int32)] {
+				continue
+			}
+			hosts[int(job.HostID.Int32)] = true
+		}
+
+		t, ok := lookup(job.Type)
+		if !ok {
+			// registered by a newer version of go-via
+			continue
+		}
+
+		now := time.Now()
+		expires := now.Add(q.lease)
+		attempt := job.Attempts + 1
+		// every claim has its own lease, a cancelled attempt that is still stopping can't touch a retry
+		lease := q.owner + "/" + secrets.NewNonce()[:8]
+		res := db.DB.Model(&job).Where("status = ?", Queued).Updates(map[string]interface{}{
+			"status":           Running,
+			"attempts":         attempt,
+			"lease_owner":      lease,
+			"lease_expires_at": expires,
+			"started_at":       now,
+		})
+		if res.Error != nil || res.RowsAffected == 0 {
+			continue
+		}
+		job.Status, job.Attempts, job.LeaseOwner, job.LeaseExpiresAt, job.StartedAt = Running, attempt, lease, &expires, &now
+
+		free--
+		q.activeMu.Lock()
+		q.active++
+		q.activeMu.Unlock()
+		q.wg.Add(1)
+		go q.run(job, t)
+	}
+}
+
+// run runs a job and renews its lease until it is done
+func (q *Queue) run(job models.Job, t jobType) {
+	defer q.wg.Done()
+	defer func() {
+		q.activeMu.Lock()
+		q.active--
+		q.activeMu.Unlock()
+		wake()
+	}()
+
+	ctx, cancel := context.WithCancel(q.ctx)
+	defer cancel()
+	runningMu.Lock()
+	running[job.ID] = cancel
+	runningMu.Unlock()
+	defer func() {
+		runningMu.Lock()
+		delete(running, job.ID)
+		runningMu.Unlock()
+	}()
+
+	heartbeat := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(q.lease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				db.DB.Model(&models.Job{}).Where("id = ? AND status = ? AND lease_owner = ?", job.ID, Running, job.LeaseOwner).Update("lease_expires_at", time.Now().Add(q.lease))
+			case <-heartbeat:
+				return
+			}
+		}
+	}()
+
+	logrus.WithFields(logrus.Fields{
+		"id":      job.ID,
+		"type":    job.Type,
+		"host":    job.HostID,
+		"attempt": job.Attempts,
+	}).Debug("jobs: started")
+
+	err := q.call(ctx, job, t.handler)
+	close(heartbeat)
+	q.finish(job, t, err)
+}
+
+// call runs the handler, a panic fails the attempt instead of go-via
+func (q *Queue) call(ctx context.Context, job models.Job, handler Handler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// finish stores the outcome of an attempt, the job may have been cancelled while it ran
+func (q *Queue) finish(job models.Job, t jobType, err error) {
+	now := time.Now()
+	updates := map[string]interface{}{
+		"lease_owner":      "",
+		"lease_expires_at": nil,
+	}
+	fields := logrus.Fields{
+		"id":      job.ID,
+		"type":    job.Type,
+		"host":    job.HostID,
+		"attempt": job.Attempts,
+	}
+
+	switch {
+	case err == nil:
+		updates["status"] = Succeeded
+		updates["error"] = ""
+		updates["finished_at"] = now
+	case q.ctx.Err() != nil:
+		// go-via is shutting down, the job resumes after the restart and the attempt doesn't count
+		updates["status"] = Queued
+		updates["attempts"] = job.Attempts - 1
+		updates["run_at"] = now
+		updates["error"] = "interrupted by a shutdown"
+	case job.Attempts >= job.MaxAttempts || errors.As(err, &permanent{}):
+		updates["status"] = Failed
+		updates["error"] = err.Error()
+		updates["finished_at"] = now
+	default:
+		updates["status"] = Queued
+		updates["error"] = err.Error()
+		updates["run_at"] = now.Add(backoff(t.options.Backoff, job.Attempts))
+	}
+
+	res := db.DB.Model(&job).Where("status = ? AND lease_owner = ?", Running, job.LeaseOwner).Updates(updates)
+	if res.Error != nil {
+		fields["err"] = res.Error
+		logrus.WithFields(fields).Warn("jobs: could not store the outcome")
+		return
+	}
+	if res.RowsAffected == 0 {
+		logrus.WithFields(fields).Info("jobs: cancelled")
+		return
+	}
+
+	fields["status"] = updates["status"]
+	if err != nil {
+		fields["err"] = err
+		logrus.WithFields(fields).Warn("jobs")
+		return
+	}
+	logrus.WithFields(fields).Debug("jobs")
+}
+
+// backoff returns the delay before the next attempt after attempts failed ones
+func backoff(base time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
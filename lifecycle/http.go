@@ -0,0 +1,68 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+)
+
+// HTTPServer serves a http.Handler over HTTP, or HTTPS if a certificate is set.
+type HTTPServer struct {
+	name     string
+	certFile string
+	keyFile  string
+	srv      *http.Server
+	ln       net.Listener
+}
+
+// NewHTTPServer creates a HTTPServer, leave certFile and keyFile empty to serve plain HTTP.
+func NewHTTPServer(name string, addr string, handler http.Handler, certFile string, keyFile string) *HTTPServer {
+	return &HTTPServer{
+		name:     name,
+		certFile: certFile,
+		keyFile:  keyFile,
+		srv: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		},
+	}
+}
+
+func (h *HTTPServer) Name() string {
+	return h.name
+}
+
+func (h *HTTPServer) Listen() error {
+	ln, err := net.Listen("tcp", h.srv.Addr)
+	if err != nil {
+		return err
+	}
+	h.ln = ln
+	return nil
+}
+
+func (h *HTTPServer) Serve(ctx context.Context) error {
+	var err error
+	if h.certFile != "" {
+		err = h.srv.ServeTLS(h.ln, h.certFile, h.keyFile)
+	} else {
+		err = h.srv.Serve(h.ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+func (h *HTTPServer) Shutdown(ctx context.Context) error {
+	if h.ln == nil {
+		return nil
+	}
+	err := h.srv.Shutdown(ctx)
+	// the listener is only tracked by srv once Serve has been called
+	if cerr := h.ln.Close(); err == nil && cerr != nil && !errors.Is(cerr, net.ErrClosed) {
+		err = cerr
+	}
+	return err
+}
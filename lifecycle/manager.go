@@ -0,0 +1,167 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Service is a long running listener that is started and stopped by the Manager.
+type Service interface {
+	// Name is used for logging
+	Name() string
+	// Listen binds the listener, it must not block.
+	Listen() error
+	// Serve blocks until the service is shut down or fails.
+	Serve(ctx context.Context) error
+	// Shutdown stops accepting new work and drains in-flight work until ctx expires.
+	Shutdown(ctx context.Context) error
+}
+
+// Manager starts all registered services with a shared context and shuts them down together.
+type Manager struct {
+	services []Service
+	optional map[Service]bool
+	timeout  time.Duration
+	ready    atomic.Bool
+
+	mu       sync.Mutex
+	disabled []string
+}
+
+// New creates a Manager that gives in-flight work up to timeout to finish on shutdown.
+func New(timeout time.Duration) *Manager {
+	return &Manager{timeout: timeout, optional: map[Service]bool{}}
+}
+
+// Add registers a service, services are started in the order they were added.
+func (m *Manager) Add(s Service) {
+	m.services = append(m.services, s)
+}
+
+// AddOptional registers a service that is skipped if its listener can't be bound, e.g. dhcp without CAP_NET_RAW.
+// the other services keep serving, but the Manager doesn't report ready.
+func (m *Manager) AddOptional(s Service) {
+	m.optional[s] = true
+	m.Add(s)
+}
+
+// Ready reports if every listener is bound and serving.
+func (m *Manager) Ready() bool {
+	return m.ready.Load()
+}
+
+// Disabled returns the names of the optional services whose listener couldn't be bound.
+func (m *Manager) Disabled() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string(nil), m.disabled...)
+}
+
+// Run binds all services, serves them until ctx is cancelled or one of them fails, and then shuts all of them down.
+func (m *Manager) Run(ctx context.Context) error {
+	// bind all listeners first, so that we fail early if a port is in use
+	var services []Service
+	var disabled []string
+	for _, s := range m.services {
+		if err := s.Listen(); err != nil {
+			if m.optional[s] {
+				logrus.WithFields(logrus.Fields{
+					"service": s.Name(),
+					"err":     err,
+				}).Warn("lifecycle: could not bind listener, the service is disabled")
+				disabled = append(disabled, s.Name())
+				continue
+			}
+			logrus.WithFields(logrus.Fields{
+				"service": s.Name(),
+				"err":     err,
+			}).Error("lifecycle: could not bind listener")
+			m.shutdown(services)
+			return err
+		}
+		services = append(services, s)
+		logrus.WithFields(logrus.Fields{
+			"service": s.Name(),
+		}).Debug("lifecycle: listener bound")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(services))
+	for _, s := range services {
+		go func(s Service) {
+			err := s.Serve(ctx)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"service": s.Name(),
+					"err":     err,
+				}).Error("lifecycle: service stopped unexpectedly")
+			}
+			errs <- err
+		}(s)
+	}
+
+	m.mu.Lock()
+	m.disabled = disabled
+	m.mu.Unlock()
+	if len(disabled) > 0 {
+		logrus.WithFields(logrus.Fields{
+			"services": len(services),
+			"disabled": disabled,
+		}).Warn("lifecycle: not ready, some listeners could not be bound")
+	} else {
+		m.ready.Store(true)
+		logrus.WithFields(logrus.Fields{
+			"services": len(services),
+		}).Info("lifecycle: all listeners ready")
+	}
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+		if err == nil {
+			err = errors.New("service stopped unexpectedly")
+		}
+	}
+
+	m.ready.Store(false)
+	logrus.WithFields(logrus.Fields{
+		"timeout": m.timeout.String(),
+	}).Info("lifecycle: shutting down, draining in-flight requests")
+	cancel()
+	m.shutdown(services)
+
+	return err
+}
+
+// shutdown stops the given services concurrently and waits at most m.timeout for them to drain.
+func (m *Manager) shutdown(services []Service) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, s := range services {
+		wg.Add(1)
+		go func(s Service) {
+			defer wg.Done()
+			if err := s.Shutdown(ctx); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"service": s.Name(),
+					"err":     err,
+				}).Warn("lifecycle: service did not shut down cleanly")
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"service": s.Name(),
+			}).Info("lifecycle: service stopped")
+		}(s)
+	}
+	wg.Wait()
+}
@@ -4,17 +4,30 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/maxiepax/go-via/api"
 	"github.com/maxiepax/go-via/config"
 	ca "github.com/maxiepax/go-via/crypto"
 	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/deployments"
+	"github.com/maxiepax/go-via/dhcpd"
+	"github.com/maxiepax/go-via/jobs"
+	"github.com/maxiepax/go-via/lifecycle"
 	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/maxiepax/go-via/scheduling"
 	"github.com/maxiepax/go-via/secrets"
+	"github.com/maxiepax/go-via/syslogd"
+	"github.com/maxiepax/go-via/webhooks"
 	"github.com/maxiepax/go-via/websockets"
 
 	"github.com/gin-contrib/static"
@@ -65,7 +78,7 @@ func main() {
 	}
 
 	//migrate all models
-	db.Migrate([]interface{}{&models.Pool{}, &models.Host{}, &models.Option{}, &models.DeviceClass{}, &models.Group{}, &models.Image{}, &models.User{}, &models.Theme{}})
+	db.Migrate([]interface{}{&models.Pool{}, &models.Host{}, &models.Option{}, &models.DeviceClass{}, &models.Group{}, &models.Image{}, &models.User{}, &models.Theme{}, &models.KickstartTemplate{}, &models.KickstartTemplateVersion{}, &models.AuditEvent{}, &models.HostCredential{}, &models.Script{}, &models.InstallReport{}, &models.HostTransition{}, &models.VCenter{}, &models.Webhook{}, &models.WebhookDelivery{}, &models.HostLog{}, &models.Deployment{}, &models.DeploymentHost{}, &models.Job{}, &models.Schedule{}, &models.MaintenanceWindow{}, &models.ReadinessResult{}})
 
 	//create admin user if it doesn't exist
 	var adm models.User
@@ -74,18 +87,105 @@ func main() {
 		logrus.Warning(res.Error)
 	}
 
+	// seed the kickstart templates shipped with go-via
+	api.SeedKickstartTemplates()
+
 	// load secrets key
 	key := secrets.Init()
 
+	// hosts are only queued for reimaging if they pass the preflight checks
+	provisioning.Preflight = api.QueuePreflight(key)
+
+	// hosts from before the state machine that are waiting to be reimaged
+	provisioning.QueueReimaging()
+
+	// BMC passwords from before they were encrypted
+	api.EncryptBMCPasswords(key)
+
+	// all listeners are started and stopped together
+	services := lifecycle.New(time.Duration(conf.ShutdownTimeout) * time.Second)
+
 	// TFTPd
-	go TFTPd(conf)
+	services.Add(NewTFTPd(conf, key))
+
+	// DHCPd, the other services start even if it can't open its raw sockets, but go-via is not ready
+	if conf.EnableDhcp {
+		for _, v := range conf.Network.Interfaces {
+			services.AddOptional(dhcpd.NewServer(v))
+		}
+	}
+
+	// fail hosts that stalled during provisioning
+	services.Add(provisioning.NewWatchdog(time.Minute, api.HandleStalledHost(key)))
+
+	// run the background jobs, the ones interrupted by the last shutdown are resumed
+	api.RegisterJobs(key)
+	services.Add(jobs.NewQueue(8, 5*time.Second, time.Minute))
+
+	// reimage the hosts of deployments wave by wave
+	services.Add(deployments.NewRunner(key, 15*time.Second))
+
+	// queue the scheduled reimages when they are due
+	services.Add(scheduling.NewScheduler(30 * time.Second))
+
+	// deliver the events to the webhooks and the callback urls of the groups
+	services.Add(webhooks.NewDispatcher(key, 30*time.Second))
+
+	// receive the logs of the installer and the hosts, and forward them to the websocket
+	if conf.SyslogPort != 0 {
+		retention := syslogd.Retention{
+			MaxAge:     time.Duration(conf.SyslogRetention) * 24 * time.Hour,
+			MaxPerHost: conf.SyslogMaxPerHost,
+		}
+		services.Add(syslogd.NewServer(":"+strconv.Itoa(conf.SyslogPort), retention, func(l models.HostLog) {
+			msg, err := json.Marshal(map[string]interface{}{
+				"level":    syslogd.Level(l.Severity),
+				"msg":      l.Message,
+				"time":     l.Timestamp,
+				"host_id":  l.HostID,
+				"source":   l.Source,
+				"hostname": l.Hostname,
+				"app":      l.App,
+			})
+			if err == nil {
+				logServer.Publish(msg)
+			}
+		}))
+		api.SyslogPort = conf.SyslogPort
+		api.SyslogDefault = conf.SyslogDefault
+	}
 
 	//REST API
 	r := gin.New()
 	r.Use(cors.Default())
 
-	// ks.cfg is served at top to not place it behind BasicAuth
-	r.GET("ks.cfg", api.Ks(key))
+	// ks.cfg and boot files are served at top to not place them behind BasicAuth, they are protected by signed urls
+	r.GET("ks/:token/ks.cfg", api.Ks(key))
+	r.GET("boot/:token/*file", api.BootFile(key))
+	r.POST("report/:token/bootdisk", api.ReportBootDisk(key))
+	r.POST("report/:token/stage", api.ReportStage(key))
+
+	// optionally serve the same over plain http, the installer doesn't validate our self-signed certificate anyway
+	if conf.HTTPPort != 0 {
+		h := gin.New()
+		h.GET("ks/:token/ks.cfg", api.Ks(key))
+		h.GET("boot/:token/*file", api.BootFile(key))
+		h.POST("report/:token/bootdisk", api.ReportBootDisk(key))
+		h.POST("report/:token/stage", api.ReportStage(key))
+		services.Add(lifecycle.NewHTTPServer("http", ":"+strconv.Itoa(conf.HTTPPort), h, "", ""))
+	}
+
+	// liveness and readiness probes
+	r.GET("healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	})
+	r.GET("readyz", func(c *gin.Context) {
+		if !services.Ready() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready", "disabled": services.Disabled()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ready"})
+	})
 
 	statikFS, err := fs.New()
 	if err != nil {
@@ -134,9 +234,18 @@ func main() {
 			hosts.GET("", api.ListHosts)
 			hosts.GET(":id", api.GetHost)
 			hosts.POST("/search", api.SearchHost)
-			hosts.POST("", api.CreateHost)
-			hosts.PATCH(":id", api.UpdateHost)
+			hosts.POST("", api.CreateHost(key))
+			hosts.PATCH(":id", api.UpdateHost(key))
 			hosts.DELETE(":id", api.DeleteHost)
+			hosts.GET(":id/credentials", api.RequireUser(), api.GetHostCredentials(key))
+			hosts.GET(":id/preview/ks", api.PreviewKs(key))
+			hosts.GET(":id/preview/bootcfg", api.PreviewBootCfg(bootScheme(conf)))
+			hosts.GET(":id/reports", api.ListHostReports)
+			hosts.GET(":id/transitions", api.ListHostTransitions)
+			hosts.GET(":id/logs", api.ListHostLogs)
+			hosts.GET(":id/readiness", api.ListHostReadiness)
+			hosts.POST(":id/state", api.SetHostState)
+			hosts.POST(":id/preflight", api.Preflight(key))
 		}
 
 		options := v1.Group("/options")
@@ -166,6 +275,7 @@ func main() {
 			groups.POST("", api.CreateGroup(key))
 			groups.PATCH(":id", api.UpdateGroup(key))
 			groups.DELETE(":id", api.DeleteGroup)
+			groups.GET(":id/password", api.RequireUser(), api.RevealGroupPassword(key))
 		}
 
 		images := v1.Group("/images")
@@ -177,6 +287,94 @@ func main() {
 			images.DELETE(":id", api.DeleteImage)
 		}
 
+		kickstartTemplates := v1.Group("/kickstart_templates")
+		{
+			kickstartTemplates.GET("", api.ListKickstartTemplates)
+			kickstartTemplates.GET(":id", api.GetKickstartTemplate)
+			kickstartTemplates.POST("", api.RequireUser(), api.CreateKickstartTemplate)
+			kickstartTemplates.PATCH(":id", api.RequireUser(), api.UpdateKickstartTemplate)
+			kickstartTemplates.DELETE(":id", api.RequireUser(), api.DeleteKickstartTemplate)
+			kickstartTemplates.GET(":id/versions/:version", api.GetKickstartTemplateVersion)
+			kickstartTemplates.POST(":id/versions/:version/approve", api.RequireUser(), api.ApproveKickstartTemplateVersion)
+		}
+
+		scripts := v1.Group("/scripts")
+		{
+			scripts.GET("", api.ListScripts)
+			scripts.GET(":id", api.GetScript)
+			scripts.POST("", api.CreateScript)
+			scripts.PATCH(":id", api.UpdateScript)
+			scripts.DELETE(":id", api.DeleteScript)
+		}
+
+		vcenters := v1.Group("/vcenters")
+		{
+			vcenters.GET("", api.ListVCenters)
+			vcenters.GET(":id", api.GetVCenter)
+			vcenters.POST("", api.CreateVCenter(key))
+			vcenters.PATCH(":id", api.UpdateVCenter(key))
+			vcenters.DELETE(":id", api.DeleteVCenter)
+		}
+
+		hooks := v1.Group("/webhooks")
+		{
+			hooks.GET("", api.ListWebhooks)
+			hooks.GET(":id", api.GetWebhook)
+			hooks.POST("", api.CreateWebhook(key))
+			hooks.PATCH(":id", api.UpdateWebhook(key))
+			hooks.DELETE(":id", api.DeleteWebhook)
+
+			hooks.GET("deliveries", api.ListWebhookDeliveries)
+			hooks.GET("deliveries/:id", api.GetWebhookDelivery)
+			hooks.POST("deliveries/:id/replay", api.ReplayWebhookDelivery)
+		}
+
+		queue := v1.Group("/jobs")
+		{
+			queue.GET("", api.ListJobs)
+			queue.GET(":id", api.GetJob)
+			queue.POST(":id/cancel", api.CancelJob)
+			queue.POST(":id/retry", api.RetryJob)
+		}
+
+		deploys := v1.Group("/deployments")
+		{
+			deploys.GET("", api.ListDeployments)
+			deploys.GET(":id", api.GetDeployment)
+			deploys.POST("", api.CreateDeployment)
+			deploys.DELETE(":id", api.DeleteDeployment)
+			deploys.POST(":id/pause", api.PauseDeployment)
+			deploys.POST(":id/resume", api.ResumeDeployment)
+			deploys.POST(":id/cancel", api.CancelDeployment)
+		}
+
+		schedules := v1.Group("/schedules")
+		{
+			schedules.GET("", api.ListSchedules)
+			schedules.GET(":id", api.GetSchedule)
+			schedules.POST("", api.CreateSchedule)
+			schedules.PATCH(":id", api.UpdateSchedule)
+			schedules.DELETE(":id", api.DeleteSchedule)
+		}
+
+		windows := v1.Group("/maintenance_windows")
+		{
+			windows.GET("", api.ListMaintenanceWindows)
+			windows.GET(":id", api.GetMaintenanceWindow)
+			windows.POST("", api.CreateMaintenanceWindow)
+			windows.PATCH(":id", api.UpdateMaintenanceWindow)
+			windows.DELETE(":id", api.DeleteMaintenanceWindow)
+		}
+
+		certificates := v1.Group("/certificates")
+		{
+			certificates.GET("ca", api.GetCACertificate)
+			certificates.PUT("intermediate", api.RequireUser(), api.UploadIntermediate)
+			certificates.DELETE("intermediate", api.RequireUser(), api.DeleteIntermediate)
+		}
+
+		v1.GET("audit", api.ListAuditEvents)
+
 		users := v1.Group("/users")
 		{
 			users.GET("", api.ListUsers)
@@ -203,11 +401,11 @@ func main() {
 		}
 		ilohosts := v1.Group("/ilohosts")
 		{
-			ilohosts.POST(":id/setvlanID", api.SetVLANID)      // Set VLAN ID
-			ilohosts.POST(":id/start", api.StartIloHost)       // Start the host
-			ilohosts.POST(":id/shutdown", api.ShutdownIloHost) // Shutdown the host
-			ilohosts.POST(":id/reboot", api.RebootIloHost)     // Reboot the host
-			ilohosts.POST(":id/onetimeboot", api.OneTimeBoot)  // Set one time boot
+			ilohosts.POST(":id/setvlanID", api.SetVLANID(key))      // Set VLAN ID
+			ilohosts.POST(":id/start", api.StartIloHost(key))       // Start the host
+			ilohosts.POST(":id/shutdown", api.ShutdownIloHost(key)) // Shutdown the host
+			ilohosts.POST(":id/reboot", api.RebootIloHost(key))     // Reboot the host
+			ilohosts.POST(":id/onetimeboot", api.OneTimeBoot(key))  // Set one time boot
 
 			ilohosts.POST("/checkilo", api.CheckIP) // Check ILO IP
 		}
@@ -243,12 +441,22 @@ func main() {
 	logrus.WithFields(logrus.Fields{
 		"port": listen,
 	}).Info("Webserver")
-	err = r.RunTLS(listen, "./cert/server.crt", "./cert/server.key")
+	services.Add(lifecycle.NewHTTPServer("https", listen, r, "./cert/server.crt", "./cert/server.key"))
 
-	logrus.WithFields(logrus.Fields{
-		"error": err,
-	}).Error("Webserver")
+	// stop all services gracefully on SIGTERM, e.g. when the pod is stopped
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	err = services.Run(ctx)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Error("lifecycle")
+		stop()
+		os.Exit(1)
+	}
 
+	logrus.Info("Shutdown complete")
 }
 
 // ServeFileSystem implementation that wraps around http.FileSystem
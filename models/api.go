@@ -4,3 +4,17 @@ type APIError struct {
 	ErrorStatus  int    `json:"error_status"`
 	ErrorMessage string `json:"error_message"`
 }
+
+// KickstartIssue is a problem found while validating a kickstart template
+type KickstartIssue struct {
+	// line in the template for template errors, otherwise the line in the rendered kickstart
+	Line     int    `json:"line,omitempty"`
+	Severity string `json:"severity"` // error or warning
+	Message  string `json:"message"`
+}
+
+type KickstartValidationError struct {
+	ErrorStatus  int              `json:"error_status"`
+	ErrorMessage string           `json:"error_message"`
+	Issues       []KickstartIssue `json:"issues"`
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+// AuditEvent records access to secrets
+type AuditEvent struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	Actor    string `json:"actor" gorm:"type:varchar(255)"`
+	Remote   string `json:"remote" gorm:"type:varchar(255)"`
+	Action   string `json:"action" gorm:"type:varchar(255);index"`
+	Object   string `json:"object" gorm:"type:varchar(255);index:idxAuditObject"`
+	ObjectID int    `json:"object_id" gorm:"type:BIGINT;index:idxAuditObject"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
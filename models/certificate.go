@@ -0,0 +1,9 @@
+package models
+
+// IntermediateForm is a CA that issues the host certificates in place of the CA of go-via
+type IntermediateForm struct {
+	// PEM encoded, the intermediate followed by the certificates up to the root
+	Certificate string `json:"certificate"`
+	// PEM encoded private key of the intermediate
+	Key string `json:"key,omitempty"`
+}
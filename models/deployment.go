@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+type DeploymentForm struct {
+	Name string `json:"name" gorm:"type:varchar(255)"`
+	// the hosts to reimage, in order. either hosts or a group is required
+	HostIDs datatypes.JSON `json:"host_ids" sql:"type:JSONB" swaggertype:"array,integer"`
+	// reimage all hosts of the group
+	GroupID NullInt32 `json:"group_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	// hosts per wave, a wave only starts once the previous one is done. 0 runs all hosts in one wave
+	WaveSize int `json:"wavesize" gorm:"type:INT"`
+	// hosts reimaged at the same time within a wave, 0 reimages the whole wave at once
+	MaxConcurrency int `json:"maxconcurrency" gorm:"type:INT"`
+	// failed hosts that are tolerated, the deployment halts when more hosts fail
+	MaxFailures int `json:"maxfailures" gorm:"type:INT"`
+}
+
+// Deployment reimages a set of hosts in waves, through their BMC
+type Deployment struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	DeploymentForm
+
+	// running, paused, halted, cancelled or completed
+	Status  string `json:"status" gorm:"type:varchar(16);index"`
+	Message string `json:"message" gorm:"type:text"`
+	// the user that created the deployment
+	Actor string `json:"actor" gorm:"type:varchar(255)"`
+	// the failures before the deployment was resumed after it halted, they don't count against maxfailures
+	IgnoredFailures int `json:"ignored_failures" gorm:"type:INT"`
+
+	Hosts []DeploymentHost `json:"hosts,omitempty" gorm:"foreignkey:DeploymentID"`
+
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// DeploymentHost is the progress of a host in a deployment
+type DeploymentHost struct {
+	ID           int    `json:"id" gorm:"primary_key"`
+	DeploymentID int    `json:"deployment_id" gorm:"type:BIGINT;index"`
+	HostID       int    `json:"host_id" gorm:"type:BIGINT;index"`
+	Hostname     string `json:"hostname" gorm:"type:varchar(255)"`
+	Wave         int    `json:"wave" gorm:"type:INT"`
+	// pending, running, ready, failed or cancelled
+	Status     string     `json:"status" gorm:"type:varchar(16)"`
+	Error      string     `json:"error" gorm:"type:text"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
 
 	"gorm.io/datatypes"
@@ -22,6 +23,32 @@ type GroupForm struct {
 	CallbackURL string         `json:"callbackurl"`
 	BootDisk    string         `json:"bootdisk" gorm:"type:varchar(255)"`
 	Options     datatypes.JSON `json:"options" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// free-form values for kickstart templates, overrides the pool and is overridden by the host
+	Metadata datatypes.JSON `json:"metadata" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// rules that select the boot disk at install time, BootDisk is ignored if there are any
+	BootDiskRules datatypes.JSON `json:"bootdisk_rules" sql:"type:JSONB" swaggertype:"array,object"`
+
+	// kickstart template, Ks is ignored if set. version 0 follows the current approved version
+	KickstartTemplateID      NullInt32 `json:"kickstart_template_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	KickstartTemplateVersion int       `json:"kickstart_template_version" gorm:"type:INT"`
+	// kickstart templates for specific ESXi versions, they take precedence over the template above
+	KickstartVariants datatypes.JSON `json:"kickstart_variants" sql:"type:JSONB" swaggertype:"array,object"`
+	// ids of the scripts appended to the kickstart
+	ScriptIDs datatypes.JSON `json:"script_ids" sql:"type:JSONB" swaggertype:"array,integer"`
+
+	// vCenter the hosts are added to once they are ready, in the cluster of the datacenter
+	VCenterID  NullInt32 `json:"vcenter_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	Datacenter string    `json:"datacenter" gorm:"type:varchar(255)"`
+	Cluster    string    `json:"cluster" gorm:"type:varchar(255)"`
+	// leave the added hosts in maintenance mode, otherwise they are taken out of it
+	MaintenanceMode bool `json:"maintenance_mode" gorm:"type:bool"`
+
+	// BMC credentials of the hosts that have none of their own. the password is encrypted with the key of go-via,
+	// never returned by the api
+	IloUser     string `json:"ilo_user" gorm:"type:varchar(255)"`
+	IloPassword string `json:"ilo_password,omitempty" gorm:"type:varchar(255)"`
 }
 
 type NoPWGroupForm struct {
@@ -39,6 +66,30 @@ type NoPWGroupForm struct {
 	CallbackURL string         `json:"callbackurl"`
 	BootDisk    string         `json:"bootdisk" gorm:"type:varchar(255)"`
 	Options     datatypes.JSON `json:"options" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// free-form values for kickstart templates, overrides the pool and is overridden by the host
+	Metadata datatypes.JSON `json:"metadata" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// rules that select the boot disk at install time, BootDisk is ignored if there are any
+	BootDiskRules datatypes.JSON `json:"bootdisk_rules" sql:"type:JSONB" swaggertype:"array,object"`
+
+	// kickstart template, Ks is ignored if set. version 0 follows the current approved version
+	KickstartTemplateID      NullInt32 `json:"kickstart_template_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	KickstartTemplateVersion int       `json:"kickstart_template_version" gorm:"type:INT"`
+	// kickstart templates for specific ESXi versions, they take precedence over the template above
+	KickstartVariants datatypes.JSON `json:"kickstart_variants" sql:"type:JSONB" swaggertype:"array,object"`
+	// ids of the scripts appended to the kickstart
+	ScriptIDs datatypes.JSON `json:"script_ids" sql:"type:JSONB" swaggertype:"array,integer"`
+
+	// vCenter the hosts are added to once they are ready, in the cluster of the datacenter
+	VCenterID  NullInt32 `json:"vcenter_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	Datacenter string    `json:"datacenter" gorm:"type:varchar(255)"`
+	Cluster    string    `json:"cluster" gorm:"type:varchar(255)"`
+	// leave the added hosts in maintenance mode, otherwise they are taken out of it
+	MaintenanceMode bool `json:"maintenance_mode" gorm:"type:bool"`
+
+	// BMC user of the hosts that have none of their own
+	IloUser string `json:"ilo_user" gorm:"type:varchar(255)"`
 }
 
 type Group struct {
@@ -46,6 +97,9 @@ type Group struct {
 
 	GroupForm
 
+	// SHA-512 crypt hash of the root password, used in the kickstart with rootpw --iscrypted
+	PasswordHash string `json:"-" gorm:"type:varchar(255)"`
+
 	Pool   *Pool    `json:"pool,omitempty" gorm:"foreignkey:PoolID"`
 	Option []Option `json:"option,omitempty" gorm:"foreignkey:PoolID"`
 	Host   []Host   `json:"host,omitempty" gorm:"foreignkey:GroupID"`
@@ -55,6 +109,13 @@ type Group struct {
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
+// MarshalJSON leaves out the BMC password, also when the group is part of another response
+func (g Group) MarshalJSON() ([]byte, error) {
+	type group Group
+	g.IloPassword = ""
+	return json.Marshal(group(g))
+}
+
 type NoPWGroup struct {
 	ID int `json:"id" gorm:"primary_key"`
 
@@ -78,6 +139,83 @@ type GroupOptions struct {
 	SuppressShellWarning bool `json:"suppressshellwarning"`
 	EraseDisks           bool `json:"erasedisks"`
 	AllowLegacyCPU       bool `json:"allowlegacycpu"`
-	Certificate          bool `json:"certificate"`
-	CreateVMFS           bool `json:"createvmfs"`
+	// issue the certificate of the host from the CA of go-via instead of a self-signed one
+	Certificate bool `json:"certificate"`
+	CreateVMFS  bool `json:"createvmfs"`
+	// generate a unique root password for every host at reimage time instead of using the group password
+	PerHostPassword bool `json:"perhostpassword"`
+	// minutes a host may spend in a provisioning state before it is marked failed, 0 disables the timeout of a state
+	StageTimeouts map[string]int `json:"stagetimeouts,omitempty"`
+	// requeue a stalled host and power cycle it through its BMC, up to this many times in a row
+	TimeoutRetries int `json:"timeoutretries,omitempty"`
+	// send the host to the callback url of the group when it stalled
+	TimeoutNotify bool `json:"timeoutnotify,omitempty"`
+	// configuration applied through the vSphere API of the host once it has booted
+	PostConfig *PostConfig `json:"postconfig,omitempty"`
+	// with certificate set, how the certificate issued by go-via gets to the host: "firstboot" (default) writes it
+	// from the kickstart, "postconfig" installs it through the vSphere API so the key never leaves the host
+	CertificateDelivery string `json:"certificatedelivery,omitempty"`
+	// checks the host has to pass after the post-config before it is ready, none if not set
+	Readiness *ReadinessConfig `json:"readiness,omitempty"`
+}
+
+// ReadinessConfig are the checks of a host that is about to be ready, they are retried until they pass or the
+// postconfig stage times out
+type ReadinessConfig struct {
+	// the host answers to ping
+	ICMP bool `json:"icmp,omitempty"`
+	// tcp ports that accept connections, e.g. [443, 902, 22]
+	Ports []int `json:"ports,omitempty"`
+	// the common name of the certificate on port 443 is the fqdn of the host
+	TLS bool `json:"tls,omitempty"`
+	// the fqdn resolves to the ip of the host and the ip back to the fqdn, with the dns servers of the group
+	DNS bool `json:"dns,omitempty"`
+}
+
+// PostConfig is the configuration that is awkward to do in a kickstart, it is applied by the provisioning
+// worker once the host answers on its vSphere API
+type PostConfig struct {
+	VSwitches  []VSwitchConfig   `json:"vswitches,omitempty"`
+	PortGroups []PortGroupConfig `json:"portgroups,omitempty"`
+	// advanced settings by key, e.g. {"UserVars.SuppressShellWarning": 1}. values are converted to the type of the setting
+	AdvancedSettings map[string]interface{} `json:"advanced_settings,omitempty"`
+}
+
+// VSwitchConfig is a standard vSwitch, it is created if the host doesn't have it
+type VSwitchConfig struct {
+	Name string `json:"name"`
+	// physical nics, in failover order
+	Uplinks []string `json:"uplinks,omitempty"`
+	MTU     int      `json:"mtu,omitempty"`
+}
+
+// PortGroupConfig is a portgroup on a standard vSwitch, it is created if the host doesn't have it
+type PortGroupConfig struct {
+	Name    string `json:"name"`
+	VSwitch string `json:"vswitch"`
+	VLAN    int    `json:"vlan,omitempty"`
+}
+
+// KickstartVariant selects a kickstart template for images of an ESXi version. Version matches by prefix,
+// 8 matches all 8.x images and 8.0.2 only 8.0 update 2. The longest match wins.
+type KickstartVariant struct {
+	Version                  string `json:"version"`
+	KickstartTemplateID      int    `json:"kickstart_template_id"`
+	KickstartTemplateVersion int    `json:"kickstart_template_version"`
+}
+
+// BootDiskRule matches disks of a host at install time, the first rule that matches any disk selects the boot disk
+type BootDiskRule struct {
+	// regular expressions matched against the vendor and model of the disk
+	Vendor string `json:"vendor,omitempty"`
+	Model  string `json:"model,omitempty"`
+	// size range in GB, 0 is unbounded
+	MinSizeGB int `json:"min_size_gb,omitempty"`
+	MaxSizeGB int `json:"max_size_gb,omitempty"`
+	// usb, sata, sas, pcie, fc or iscsi
+	Transport string `json:"transport,omitempty"`
+	// only ssds or only non-ssds, both if not set
+	SSD *bool `json:"ssd,omitempty"`
+	// first, smallest or largest of the matching disks, defaults to first
+	Pick string `json:"pick,omitempty"`
 }
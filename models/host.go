@@ -1,14 +1,17 @@
 package models
 
 import (
+	"encoding/json"
 	"time"
+
+	"gorm.io/datatypes"
 )
 
 type HostForm struct {
 	IP            string    `json:"ip" gorm:"type:varchar(15);not null;index:uniqIp,unique"`
 	IloIP         string    `json:"ilo_ip" gorm:"type:varchar(15);index:uniqIp,unique"`
 	IloUser       string    `json:"ilo_user" gorm:"type:varchar(255)"`
-	IloPassword   string    `json:"ilo_password" gorm:"type:varchar(255)"`
+	IloPassword   string    `json:"ilo_password,omitempty" gorm:"type:varchar(255)"` // encrypted with the key of go-via, never returned by the api
 	IloPort       string    `json:"ilo_port" gorm:"type:varchar(255)"`
 	IloApiFlavour string    `json:"ilo_api_flavour" gorm:"type:varchar(255)"`
 	IloFqdn       string    `json:"ilo_fqdn" gorm:"type:varchar(255)"`
@@ -22,6 +25,15 @@ type HostForm struct {
 	Progress      int       `json:"progress" gorm:"type:INT"`
 	Progresstext  string    `json:"progresstext" gorm:"type:varchar(255)"`
 	Ks            string    `json:"ks" gorm:"type:text"`
+
+	// free-form values for kickstart templates, overrides the pool and group
+	Metadata datatypes.JSON `json:"metadata" sql:"type:JSONB" swaggertype:"object,string"`
+
+	// kickstart template, overrides the one of the group. version 0 follows the current approved version
+	KickstartTemplateID      NullInt32 `json:"kickstart_template_id" gorm:"type:BIGINT" swaggertype:"integer"`
+	KickstartTemplateVersion int       `json:"kickstart_template_version" gorm:"type:INT"`
+	// ids of the scripts appended to the kickstart, in addition to the ones of the group
+	ScriptIDs datatypes.JSON `json:"script_ids" sql:"type:JSONB" swaggertype:"array,integer"`
 }
 
 type Host struct {
@@ -35,12 +47,42 @@ type Host struct {
 	FirstSeen time.Time `json:"first_seen"`
 	LastSeen  time.Time `json:"last_seen"`
 
+	// provisioning state, only changed through the state machine in the provisioning package
+	State          string    `json:"state" gorm:"type:varchar(32);default:registered"`
+	StateChangedAt time.Time `json:"state_changed_at"`
+
+	// the boot disk the installer selected with the boot disk rules of the group
+	InstalledBootDisk string `json:"installed_bootdisk" gorm:"type:varchar(255)"`
+
 	// DHCP parameters
 	LastSeenRelay  string    `json:"last_seen_relay" gorm:"type:varchar(15)"`
 	MissingOptions string    `json:"missing_options" gorm:"type:varchar(255)"`
 	Expires        time.Time `json:"expires_at"`
 
+	// nonce of the signed kickstart url that has not been used yet
+	KsNonce string `json:"-" gorm:"type:varchar(64)"`
+	// nonce of the kickstart of the current install, only its report url is accepted
+	InstallNonce string `json:"-" gorm:"type:varchar(64)"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
+
+// MarshalJSON leaves out the BMC password, also when the host is part of another response
+func (h Host) MarshalJSON() ([]byte, error) {
+	type host Host
+	h.IloPassword = ""
+	return json.Marshal(host(h))
+}
+
+// BootDiskReport is sent by the installer after the boot disk rules of the group selected a disk
+type BootDiskReport struct {
+	Disk   string `json:"disk"`
+	Vendor string `json:"vendor"`
+	Model  string `json:"model"`
+	SizeMB int    `json:"size_mb"`
+	// the number of the rule that matched, starting at 1
+	Rule  int    `json:"rule"`
+	Error string `json:"error"`
+}
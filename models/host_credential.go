@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+)
+
+// HostCredential is a root password generated for a single host, the latest one is current
+type HostCredential struct {
+	ID     int `json:"id" gorm:"primary_key"`
+	HostID int `json:"host_id" gorm:"type:BIGINT;index"`
+
+	// encrypted with the secret key
+	Password     string `json:"-" gorm:"type:varchar(255)"`
+	PasswordHash string `json:"-" gorm:"type:varchar(255)"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// RevealedCredential is a HostCredential with the password decrypted
+type RevealedCredential struct {
+	ID        int        `json:"id"`
+	Password  string     `json:"password"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+type HostCredentials struct {
+	HostID int `json:"host_id"`
+	// the current password, empty if the host uses the password of the group
+	Password string               `json:"password"`
+	History  []RevealedCredential `json:"history"`
+}
@@ -0,0 +1,25 @@
+package models
+
+import (
+	"time"
+)
+
+// HostLog is a syslog message received from a host
+type HostLog struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	// empty if the sender isn't a known host
+	HostID NullInt32 `json:"host_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	// the address the message came from
+	Source   string `json:"source" gorm:"type:varchar(64)"`
+	Facility int    `json:"facility" gorm:"type:INT"`
+	// 0 (emergency) to 7 (debug)
+	Severity int    `json:"severity" gorm:"type:INT"`
+	Hostname string `json:"hostname" gorm:"type:varchar(255)"`
+	App      string `json:"app" gorm:"type:varchar(255)"`
+	Message  string `json:"message" gorm:"type:text"`
+	// the time the host put on the message, the time it was received if it had none
+	Timestamp time.Time `json:"timestamp"`
+
+	CreatedAt time.Time `json:"created_at" gorm:"index"`
+}
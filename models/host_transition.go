@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+)
+
+// HostTransition is a change of the provisioning state of a host
+type HostTransition struct {
+	ID     int    `json:"id" gorm:"primary_key"`
+	HostID int    `json:"host_id" gorm:"type:BIGINT;index"`
+	From   string `json:"from" gorm:"type:varchar(32)"`
+	To     string `json:"to" gorm:"type:varchar(32)"`
+	// what caused the transition, e.g. tftp, kickstart, installer or api
+	Source string `json:"source" gorm:"type:varchar(32)"`
+	// the user, or the address of the host for automatic transitions
+	Actor   string `json:"actor" gorm:"type:varchar(255)"`
+	Message string `json:"message" gorm:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HostStateForm is used to move a host to another state manually
+type HostStateForm struct {
+	State   string `json:"state" binding:"required"`
+	Message string `json:"message"`
+}
@@ -10,6 +10,10 @@ type ImageForm struct {
 	Size        int64  `json:"size" gorm:"type:BIGINT"`
 	Hash        string `json:"hash" gorm:"type:varchar(255)"`
 	Description string `json:"description" gorm:"type:text"`
+
+	// ESXi version of the image, e.g. 8.0.2, detected from boot.cfg or the iso name when empty
+	Version string `json:"version" gorm:"type:varchar(255)"`
+	Build   string `json:"build" gorm:"type:varchar(255)"`
 }
 
 type Image struct {
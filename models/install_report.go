@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+// InstallReportForm is sent by the installer from the %pre, %post and %firstboot scripts of the kickstart
+type InstallReportForm struct {
+	// pre, post or firstboot
+	Stage string `json:"stage" gorm:"type:varchar(16)"`
+	// started, finished or failed
+	Status   string `json:"status" gorm:"type:varchar(16)"`
+	ExitCode *int   `json:"exit_code" gorm:"type:INT"`
+	Message  string `json:"message" gorm:"type:text"`
+}
+
+// InstallReport is a phone-home of the installer of a host
+type InstallReport struct {
+	ID     int `json:"id" gorm:"primary_key"`
+	HostID int `json:"host_id" gorm:"type:BIGINT;index"`
+
+	InstallReportForm
+
+	Remote string `json:"remote" gorm:"type:varchar(255)"`
+	// seconds since the stage reported that it started
+	Duration float64 `json:"duration,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
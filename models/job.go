@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+// Job is work that is run in the background, it survives restarts of go-via
+type Job struct {
+	ID   int    `json:"id" gorm:"primary_key"`
+	Type string `json:"type" gorm:"type:varchar(32);index"`
+	// the jobs of a host run one at a time
+	HostID  NullInt32      `json:"host_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	Payload datatypes.JSON `json:"payload" sql:"type:JSONB" swaggertype:"object"`
+
+	// queued, running, succeeded, failed or cancelled
+	Status      string    `json:"status" gorm:"type:varchar(16);index"`
+	Attempts    int       `json:"attempts" gorm:"type:INT"`
+	MaxAttempts int       `json:"max_attempts" gorm:"type:INT"`
+	RunAt       time.Time `json:"run_at" gorm:"index"`
+	Error       string    `json:"error" gorm:"type:text"`
+
+	// the instance of go-via and the attempt running the job, the job is run again if the lease expires before it finished
+	LeaseOwner     string     `json:"lease_owner" gorm:"type:varchar(64)"`
+	LeaseExpiresAt *time.Time `json:"lease_expires_at,omitempty"`
+
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+)
+
+type KickstartTemplateForm struct {
+	Name        string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex"`
+	Description string `json:"description" gorm:"type:text"`
+
+	// supplying content creates a new version that has to be approved before it is used, the author is
+	// the user of the basic auth credentials
+	Content string `json:"content,omitempty" gorm:"-"`
+	Comment string `json:"comment,omitempty" gorm:"-"`
+}
+
+type KickstartTemplate struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	KickstartTemplateForm
+
+	// the approved version used by groups and hosts that don't pin a version
+	CurrentVersion int `json:"current_version" gorm:"type:INT"`
+	LatestVersion  int `json:"latest_version" gorm:"type:INT"`
+	// true for the templates shipped with go-via
+	BuiltIn bool `json:"built_in" gorm:"type:bool"`
+
+	Versions []KickstartTemplateVersion `json:"versions,omitempty" gorm:"foreignkey:TemplateID"`
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+type KickstartTemplateVersion struct {
+	ID         int `json:"id" gorm:"primary_key"`
+	TemplateID int `json:"template_id" gorm:"type:BIGINT;index:uniqVersion,unique"`
+	Version    int `json:"version" gorm:"type:INT;index:uniqVersion,unique"`
+
+	Content string `json:"content" gorm:"type:text"`
+	Author  string `json:"author" gorm:"type:varchar(255)"`
+	Comment string `json:"comment" gorm:"type:text"`
+	// unified diff against the version that was current when this version was created
+	Diff string `json:"diff" gorm:"type:text"`
+
+	Approved   bool       `json:"approved" gorm:"type:bool"`
+	ApprovedBy string     `json:"approved_by" gorm:"type:varchar(255)"`
+	ApprovedAt *time.Time `json:"approved_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
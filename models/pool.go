@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/maxiepax/go-via/db"
+	"gorm.io/datatypes"
 	"gorm.io/gorm"
 )
 
@@ -20,6 +21,9 @@ type PoolForm struct {
 
 	Gateway          string `json:"gateway" gorm:"type:varchar(15)" binding:"required" `
 	OnlyServeReimage bool   `json:"only_serve_reimage" gorm:"type:boolean"`
+
+	// free-form values for kickstart templates, overridden by the group and host
+	Metadata datatypes.JSON `json:"metadata" sql:"type:JSONB" swaggertype:"object,string"`
 }
 
 type Pool struct {
@@ -0,0 +1,24 @@
+package models
+
+// PreflightCheck is a check of a host before it is reimaged
+type PreflightCheck struct {
+	// image, pool, kickstart, password, dns or bmc
+	Name string `json:"name"`
+	// pass, warn or fail
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+// PreflightReport are the checks of a host before it is reimaged, the host can't be reimaged if one of them failed
+type PreflightReport struct {
+	HostID int `json:"host_id"`
+	// the worst status of the checks
+	Status string           `json:"status"`
+	Checks []PreflightCheck `json:"checks"`
+}
+
+type PreflightError struct {
+	ErrorStatus  int             `json:"error_status"`
+	ErrorMessage string          `json:"error_message"`
+	Report       PreflightReport `json:"report"`
+}
@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// ReadinessResult is the outcome of a readiness check of a host, the results of the last run are kept
+type ReadinessResult struct {
+	ID     int `json:"id" gorm:"primary_key"`
+	HostID int `json:"host_id" gorm:"type:BIGINT;index"`
+	// icmp, tcp/<port>, tls or dns
+	Check   string `json:"check" gorm:"type:varchar(32)"`
+	Passed  bool   `json:"passed" gorm:"type:bool"`
+	Message string `json:"message" gorm:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
@@ -0,0 +1,67 @@
+package models
+
+import (
+	"time"
+)
+
+type ScheduleForm struct {
+	Name string `json:"name" gorm:"type:varchar(255)"`
+	// what the schedule reimages, exactly one is required: a host, all hosts of a group, or the hosts of a deployment with its limits
+	HostID       NullInt32 `json:"host_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	GroupID      NullInt32 `json:"group_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	DeploymentID NullInt32 `json:"deployment_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	// run once at this time, or repeatedly with a cron expression, e.g. "0 2 * * sat"
+	At   *time.Time `json:"at,omitempty"`
+	Cron string     `json:"cron" gorm:"type:varchar(255)"`
+	// the timezone of the cron expression, e.g. "Europe/Stockholm". defaults to UTC
+	Timezone string `json:"timezone" gorm:"type:varchar(64)"`
+	Enabled  bool   `json:"enabled" gorm:"type:bool"`
+}
+
+// Schedule reimages a host, a group or a deployment at a later time
+type Schedule struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	ScheduleForm
+
+	// the user that created the schedule
+	Actor string `json:"actor" gorm:"type:varchar(255)"`
+	// empty once a one-off schedule has run
+	NextRunAt  *time.Time `json:"next_run_at,omitempty" gorm:"index"`
+	LastRunAt  *time.Time `json:"last_run_at,omitempty"`
+	LastResult string     `json:"last_result" gorm:"type:text"`
+
+	// the next runs, in the timezone of the schedule
+	Upcoming []time.Time `json:"upcoming" gorm:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type MaintenanceWindowForm struct {
+	Name string `json:"name" gorm:"type:varchar(255)"`
+	// the group the window applies to, empty applies to all groups
+	GroupID NullInt32 `json:"group_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	// when the window opens, a cron expression e.g. "0 22 * * fri"
+	Cron string `json:"cron" gorm:"type:varchar(255)"`
+	// how long the window is open, in minutes
+	Duration int `json:"duration" gorm:"type:INT"`
+	// the timezone of the cron expression, e.g. "Europe/Stockholm". defaults to UTC
+	Timezone string `json:"timezone" gorm:"type:varchar(64)"`
+}
+
+// MaintenanceWindow limits when hosts are served DHCP and PXE to reimage. A group with windows is only reimaged
+// while one of them is open, a group without windows at any time.
+type MaintenanceWindow struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	MaintenanceWindowForm
+
+	// if the window is open right now
+	Open bool `json:"open" gorm:"-"`
+	// the next times the window opens, in the timezone of the window
+	Upcoming []time.Time `json:"upcoming" gorm:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
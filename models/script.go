@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+)
+
+type ScriptForm struct {
+	Name        string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex"`
+	Description string `json:"description" gorm:"type:text"`
+	// busybox or python
+	Interpreter string `json:"interpreter" gorm:"type:varchar(255)"`
+	// pre, post or firstboot
+	Stage string `json:"stage" gorm:"type:varchar(255)"`
+	// scripts of the same stage run in ascending order
+	Priority int `json:"priority" gorm:"type:INT"`
+	// the content is a template with the same values as the kickstart
+	Content string `json:"content" gorm:"type:text"`
+}
+
+// Script is a snippet that is appended to the kickstart of the groups and hosts it is attached to
+type Script struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	ScriptForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"time"
+)
+
+type VCenterForm struct {
+	Name string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex"`
+	// hostname or ip of the vCenter server
+	Host     string `json:"host" gorm:"type:varchar(255)"`
+	Username string `json:"username" gorm:"type:varchar(255)"`
+	// encrypted with the key of go-via, never returned by the api
+	Password string `json:"password,omitempty" gorm:"type:varchar(255)"`
+	// SHA-1 thumbprint of the vCenter certificate, when empty the certificate has to be trusted by the system
+	Thumbprint string `json:"thumbprint" gorm:"type:varchar(255)"`
+}
+
+// VCenter is a vCenter server that groups add their hosts to once they are ready
+type VCenter struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	VCenterForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
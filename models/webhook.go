@@ -0,0 +1,56 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/datatypes"
+)
+
+type WebhookForm struct {
+	Name string `json:"name" gorm:"type:varchar(255);not null;uniqueIndex"`
+	URL  string `json:"url" gorm:"type:varchar(2048)"`
+	// the payloads are signed with a HMAC of the secret, it is encrypted with the key of go-via and never returned
+	// by the api. a secret is generated if none is set, it is only returned when the webhook is created
+	Secret string `json:"secret,omitempty" gorm:"type:varchar(255)"`
+	// the event types that are sent to the webhook, e.g. ["host.failed"]. empty subscribes to all events
+	Events  datatypes.JSON `json:"events" sql:"type:JSONB" swaggertype:"array,string"`
+	Enabled bool           `json:"enabled" gorm:"type:bool"`
+}
+
+// Webhook is a subscription to the events of go-via
+type Webhook struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	WebhookForm
+
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// WebhookDelivery is an event on its way to a webhook, or the callback url of a group
+type WebhookDelivery struct {
+	ID int `json:"id" gorm:"primary_key"`
+
+	// empty for the callback url of a group
+	WebhookID NullInt32 `json:"webhook_id" gorm:"type:BIGINT;index" swaggertype:"integer"`
+	URL       string    `json:"url" gorm:"type:varchar(2048)"`
+	// the id of the event, replays of a delivery keep it so receivers can ignore duplicates
+	EventID string         `json:"event_id" gorm:"type:varchar(64);index"`
+	Event   string         `json:"event" gorm:"type:varchar(64);index"`
+	Payload datatypes.JSON `json:"payload" sql:"type:JSONB" swaggertype:"object"`
+
+	// pending, delivered or failed
+	Status        string     `json:"status" gorm:"type:varchar(16);index"`
+	Attempts      int        `json:"attempts" gorm:"type:INT"`
+	NextAttemptAt time.Time  `json:"next_attempt_at" gorm:"index"`
+	LastAttemptAt *time.Time `json:"last_attempt_at,omitempty"`
+	// the http status of the last attempt, 0 if there was no response
+	ResponseStatus int    `json:"response_status" gorm:"type:INT"`
+	Error          string `json:"error" gorm:"type:text"`
+	// the delivery this one replays
+	ReplayOf NullInt32 `json:"replay_of" gorm:"type:BIGINT" swaggertype:"integer"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,254 @@
+// Package provisioning implements the lifecycle of a host, from registration to a ready ESXi host.
+package provisioning
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/webhooks"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// the states of a host
+const (
+	Registered     = "registered"
+	Queued         = "queued"
+	PXE            = "pxe"
+	BootCfg        = "bootcfg"
+	Installing     = "installing"
+	Firstboot      = "firstboot"
+	Postconfig     = "postconfig"
+	Ready          = "ready"
+	Failed         = "failed"
+	Decommissioned = "decommissioned"
+)
+
+// ErrInvalidTransition is returned when a host can't move from its current state to the requested one
+var ErrInvalidTransition = errors.New("invalid state transition")
+
+// ErrStateChanged is returned by TransitionFrom when the host has left the expected state
+var ErrStateChanged = errors.New("the host changed its state in the meantime")
+
+// ErrPreflightFailed is returned when a host fails the preflight checks before it is queued for reimaging
+var ErrPreflightFailed = errors.New("the host failed the preflight checks")
+
+// Preflight checks a host, loaded with its group and pool, before it is queued for reimaging. a host that
+// fails it isn't queued. the checks are implemented by the api, it is set on startup
+var Preflight func(host models.Host) error
+
+// transitions are the states a host can move to from each state
+var transitions = map[string][]string{
+	Registered:     {Queued, Decommissioned},
+	Queued:         {PXE, Registered, Failed, Decommissioned},
+	PXE:            {BootCfg, Queued, Registered, Failed},
+	BootCfg:        {Installing, PXE, Queued, Registered, Failed},
+	Installing:     {Firstboot, Postconfig, Queued, Failed},
+	Firstboot:      {Postconfig, Queued, Failed},
+	Postconfig:     {Ready, Queued, Failed},
+	Ready:          {Queued, Postconfig, Decommissioned},
+	Failed:         {Queued, Registered, Decommissioned},
+	Decommissioned: {Registered},
+}
+
+// the progress shown for each state, failed keeps the progress of the state that failed
+var progress = map[string]struct {
+	Percentage int
+	Text       string
+}{
+	Registered:     {0, ""},
+	Queued:         {0, "queued"},
+	PXE:            {10, "mboot.efi"},
+	BootCfg:        {15, "installation"},
+	Installing:     {50, "kickstart"},
+	Firstboot:      {70, "firstboot"},
+	Postconfig:     {75, "customization"},
+	Ready:          {100, "completed"},
+	Decommissioned: {0, "decommissioned"},
+}
+
+// States returns all states in lifecycle order
+func States() []string {
+	return []string{Registered, Queued, PXE, BootCfg, Installing, Firstboot, Postconfig, Ready, Failed, Decommissioned}
+}
+
+// CanTransition reports if a host may move from one state to another
+func CanTransition(from string, to string) bool {
+	for _, s := range transitions[current(from)] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// hosts created before the state machine have no state
+func current(state string) string {
+	if state == "" {
+		return Registered
+	}
+	return state
+}
+
+// Transition moves a host to another state and records it in the history of the host. Moving a host
+// to the state it already is in does nothing.
+func Transition(hostID int, to string, source string, actor string, message string) (models.Host, error) {
+	return transition(hostID, nil, to, source, actor, message)
+}
+
+// TransitionFrom moves a host like Transition, but only while it is still in the state it entered at
+// changedAt. it returns ErrStateChanged if the host moved on since it was loaded.
+func TransitionFrom(hostID int, from string, changedAt time.Time, to string, source string, actor string, message string) (models.Host, error) {
+	return transition(hostID, &expectation{state: from, changedAt: changedAt}, to, source, actor, message)
+}
+
+// expectation is the state a host has to be in for a transition
+type expectation struct {
+	state     string
+	changedAt time.Time
+}
+
+func transition(hostID int, expect *expectation, to string, source string, actor string, message string) (models.Host, error) {
+	// every way of queueing a host for reimaging runs the preflight checks, outside of the transaction as
+	// they read the image, the pool and the kickstart of the host
+	if to == Queued && Preflight != nil {
+		var host models.Host
+		if res := db.DB.Preload("Group").Preload("Pool").First(&host, hostID); res.Error != nil {
+			return host, res.Error
+		}
+		if current(host.State) != Queued && CanTransition(host.State, Queued) {
+			if err := Preflight(host); err != nil {
+				return host, fmt.Errorf("%w: %s", ErrPreflightFailed, err)
+			}
+		}
+	}
+
+	var host models.Host
+	var from string
+	err := db.DB.Transaction(func(tx *gorm.DB) error {
+		if res := tx.First(&host, hostID); res.Error != nil {
+			return res.Error
+		}
+		if expect != nil && (current(host.State) != expect.state || !host.StateChangedAt.Equal(expect.changedAt)) {
+			return ErrStateChanged
+		}
+		from = current(host.State)
+		if from == to {
+			return nil
+		}
+		if !CanTransition(from, to) {
+			return fmt.Errorf("%w from %s to %s", ErrInvalidTransition, from, to)
+		}
+
+		updates := map[string]interface{}{
+			"state":            to,
+			"state_changed_at": time.Now(),
+		}
+		// only queued hosts are reimaged, the report url of the previous install is revoked
+		switch to {
+		case Queued:
+			updates["reimage"] = true
+			updates["install_nonce"] = ""
+		case Registered, Failed, Decommissioned:
+			updates["reimage"] = false
+		}
+		if p, ok := progress[to]; ok {
+			updates["progress"] = p.Percentage
+			updates["progresstext"] = p.Text
+		} else {
+			updates["progresstext"] = to
+			if message != "" {
+				updates["progresstext"] = to + ": " + message
+			}
+		}
+		// the update only applies while the host is in the state it was loaded in, so a host that
+		// moved on concurrently isn't moved again
+		query := tx.Model(&models.Host{}).Where("id = ?", host.ID)
+		if expect != nil {
+			query = query.Where("state = ? AND state_changed_at = ?", host.State, host.StateChangedAt)
+		}
+		res := query.Updates(updates)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return ErrStateChanged
+		}
+		if res := tx.First(&host, hostID); res.Error != nil {
+			return res.Error
+		}
+
+		if res := tx.Create(&models.HostTransition{
+			HostID:  host.ID,
+			From:    from,
+			To:      to,
+			Source:  source,
+			Actor:   actor,
+			Message: message,
+		}); res.Error != nil {
+			return res.Error
+		}
+
+		// the events are queued with the transition, subscribers never hear of a change that was rolled back
+		change := webhooks.HostStateChange{Host: host, From: from, To: to, Source: source, Actor: actor, Message: message}
+		change.Host.IloPassword = ""
+		change.Host.KsNonce = ""
+		change.Host.InstallNonce = ""
+		if err := webhooks.Publish(tx, webhooks.HostStateChanged, change); err != nil {
+			return err
+		}
+		if to == Failed {
+			return webhooks.Publish(tx, webhooks.HostFailed, change)
+		}
+		return nil
+	})
+	if err != nil || from == to {
+		return host, err
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"id":      host.ID,
+		"from":    from,
+		"to":      to,
+		"source":  source,
+		"actor":   actor,
+		"message": message,
+	}).Info("state")
+	logrus.WithFields(logrus.Fields{
+		"id":           host.ID,
+		"percentage":   host.Progress,
+		"progresstext": host.Progresstext,
+	}).Info("progress")
+
+	return host, nil
+}
+
+// SetProgress updates the progress of a host within a state, it is ignored if the host has moved on
+func SetProgress(hostID int, state string, percentage int, text string) {
+	res := db.DB.Model(&models.Host{}).Where("id = ? AND state = ? AND progress <= ?", hostID, state, percentage).Updates(map[string]interface{}{"progress": percentage, "progresstext": text})
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+	logrus.WithFields(logrus.Fields{
+		"id":           hostID,
+		"percentage":   percentage,
+		"progresstext": text,
+	}).Info("progress")
+}
+
+// QueueReimaging queues the hosts that were marked for reimaging before hosts had a state
+func QueueReimaging() {
+	var hosts []models.Host
+	db.DB.Where("reimage = ? AND (state = ? OR state = '' OR state IS NULL)", true, Registered).Find(&hosts)
+	for _, h := range hosts {
+		if _, err := Transition(h.ID, Queued, "startup", "go-via", "marked for reimaging"); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"id":  h.ID,
+				"err": err,
+			}).Warn("state")
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+)
+
+// DefaultTimeouts are the minutes a host may spend in a state before it is considered stalled,
+// groups can override them with the stagetimeouts option
+var DefaultTimeouts = map[string]int{
+	PXE:        15,
+	BootCfg:    30,
+	Installing: 60,
+	Firstboot:  30,
+	Postconfig: 60,
+}
+
+// ValidateTimeouts checks the stagetimeouts option of a group
+func ValidateTimeouts(timeouts map[string]int) error {
+	for state, minutes := range timeouts {
+		if _, ok := DefaultTimeouts[state]; !ok {
+			return fmt.Errorf("stagetimeouts: %s has no timeout, use pxe, bootcfg, installing, firstboot or postconfig", state)
+		}
+		if minutes < 0 {
+			return fmt.Errorf("stagetimeouts: the timeout of %s can't be negative", state)
+		}
+	}
+	return nil
+}
+
+// Timeout returns the timeout of a state for hosts in the group, 0 if the state doesn't time out
+func Timeout(options models.GroupOptions, state string) time.Duration {
+	minutes, ok := options.StageTimeouts[state]
+	if !ok {
+		minutes = DefaultTimeouts[state]
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
+// Watchdog fails hosts that stalled in a state for longer than the timeout of their group
+type Watchdog struct {
+	interval  time.Duration
+	onTimeout func(host models.Host, stalled string)
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewWatchdog creates a Watchdog that checks the hosts every interval. onTimeout is called for every host
+// that was failed, with the state it stalled in.
+func NewWatchdog(interval time.Duration, onTimeout func(host models.Host, stalled string)) *Watchdog {
+	return &Watchdog{
+		interval:  interval,
+		onTimeout: onTimeout,
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+}
+
+func (w *Watchdog) Name() string {
+	return "watchdog"
+}
+
+func (w *Watchdog) Listen() error {
+	return nil
+}
+
+func (w *Watchdog) Serve(ctx context.Context) error {
+	defer close(w.stopped)
+	t := time.NewTicker(w.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			w.Check()
+		case <-w.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Shutdown waits for a running check to finish
+func (w *Watchdog) Shutdown(ctx context.Context) error {
+	close(w.done)
+	select {
+	case <-w.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the watchdog did not stop: %w", ctx.Err())
+	}
+}
+
+// Check fails every host that stalled
+func (w *Watchdog) Check() {
+	var states []string
+	for state := range DefaultTimeouts {
+		states = append(states, state)
+	}
+
+	var hosts []models.Host
+	if res := db.DB.Preload(clause.Associations).Where("state IN ?", states).Find(&hosts); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("watchdog")
+		return
+	}
+
+	for _, host := range hosts {
+		// hosts that haven't moved since the state machine was introduced have no timestamp
+		if host.StateChangedAt.IsZero() {
+			continue
+		}
+		options := models.GroupOptions{}
+		if len(host.Group.Options) > 0 {
+			json.Unmarshal(host.Group.Options, &options)
+		}
+		timeout := Timeout(options, host.State)
+		if timeout == 0 || time.Since(host.StateChangedAt) < timeout {
+			continue
+		}
+
+		stalled := host.State
+		message := fmt.Sprintf("%s timed out after %s", stalled, timeout)
+		// the host may have moved on since it was loaded, it is only failed if it is still in the stalled state
+		failed, err := TransitionFrom(host.ID, stalled, host.StateChangedAt, Failed, "watchdog", "go-via", message)
+		if err != nil {
+			if !errors.Is(err, ErrStateChanged) {
+				logrus.WithFields(logrus.Fields{
+					"id":  host.ID,
+					"err": err,
+				}).Warn("watchdog")
+			}
+			continue
+		}
+		logrus.WithFields(logrus.Fields{
+			"id":      host.ID,
+			"host":    host.Hostname,
+			"stalled": stalled,
+			"timeout": timeout.String(),
+		}).Error("watchdog: host stalled")
+
+		if w.onTimeout != nil {
+			failed.Group = host.Group
+			failed.Pool = host.Pool
+			w.onTimeout(failed, stalled)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package readiness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// ping sends echo requests to the host until one is answered, with a raw socket if go-via runs as root and
+// an unprivileged one otherwise
+func ping(ctx context.Context, ip string) error {
+	dst := net.ParseIP(ip).To4()
+	if dst == nil {
+		return fmt.Errorf("%s is not an ipv4 address", ip)
+	}
+
+	privileged := true
+	conn, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		privileged = false
+		if conn, err = icmp.ListenPacket("udp4", "0.0.0.0"); err != nil {
+			return fmt.Errorf("could not open an icmp socket: %w", err)
+		}
+	}
+	defer conn.Close()
+
+	var addr net.Addr = &net.IPAddr{IP: dst}
+	if !privileged {
+		addr = &net.UDPAddr{IP: dst}
+	}
+
+	deadline := time.Now().Add(checkTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	// unprivileged sockets get their id from the kernel, the replies are only delivered to them
+	id := os.Getpid() & 0xffff
+	buf := make([]byte, 1500)
+	for seq := 1; time.Now().Before(deadline); seq++ {
+		msg := icmp.Message{
+			Type: ipv4.ICMPTypeEcho,
+			Body: &icmp.Echo{ID: id, Seq: seq, Data: []byte("go-via")},
+		}
+		b, err := msg.Marshal(nil)
+		if err != nil {
+			return err
+		}
+		if _, err := conn.WriteTo(b, addr); err != nil {
+			return err
+		}
+
+		wait := time.Now().Add(time.Second)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		conn.SetReadDeadline(wait)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				// no reply within a second, try again
+				break
+			}
+			reply, err := icmp.ParseMessage(1, buf[:n])
+			if err != nil || reply.Type != ipv4.ICMPTypeEchoReply {
+				continue
+			}
+			echo, ok := reply.Body.(*icmp.Echo)
+			if !ok || !sameIP(peer, dst) || (privileged && echo.ID != id) {
+				continue
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("no reply to ping")
+}
+
+func sameIP(addr net.Addr, ip net.IP) bool {
+	switch a := addr.(type) {
+	case *net.IPAddr:
+		return a.IP.Equal(ip)
+	case *net.UDPAddr:
+		return a.IP.Equal(ip)
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+// Package readiness checks that an installed host is reachable the way vCenter and VCF expect, before it is
+// handed over.
+package readiness
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/maxiepax/go-via/models"
+)
+
+// the time a single check may take
+var checkTimeout = 5 * time.Second
+
+// the names of the checks, a tcp check is named tcp/<port>
+const (
+	ICMP = "icmp"
+	TLS  = "tls"
+	DNS  = "dns"
+)
+
+// Target is the host that is checked
+type Target struct {
+	IP   string
+	FQDN string
+	// the dns servers of the group, the system resolver is used if there are none
+	DNS []string
+}
+
+// Run runs the checks of a config against a host
+func Run(ctx context.Context, target Target, config models.ReadinessConfig) []models.ReadinessResult {
+	var results []models.ReadinessResult
+	add := func(check string, err error) {
+		result := models.ReadinessResult{Check: check, Passed: err == nil, Message: "ok"}
+		if err != nil {
+			result.Message = err.Error()
+		}
+		results = append(results, result)
+	}
+
+	if config.ICMP {
+		add(ICMP, ping(ctx, target.IP))
+	}
+	for _, port := range config.Ports {
+		add("tcp/"+strconv.Itoa(port), Dial(ctx, target.IP, port))
+	}
+	if config.TLS {
+		add(TLS, certificate(ctx, target.IP, target.FQDN))
+	}
+	if config.DNS {
+		add(DNS, Lookup(ctx, target))
+	}
+	return results
+}
+
+// Failed returns the names of the checks that failed
+func Failed(results []models.ReadinessResult) []string {
+	var failed []string
+	for _, result := range results {
+		if !result.Passed {
+			failed = append(failed, result.Check)
+		}
+	}
+	return failed
+}
+
+// Dial checks that a tcp port of a host accepts connections
+func Dial(ctx context.Context, ip string, port int) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// certificate checks that the certificate on port 443 is issued to the fqdn
+func certificate(ctx context.Context, ip string, fqdn string) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	d := tls.Dialer{
+		// the certificate may not be trusted yet, only the name matters
+		Config: &tls.Config{InsecureSkipVerify: true},
+	}
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(ip, "443"))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	certs := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("the host sent no certificate")
+	}
+	// the names of a certificate are its subject alternative names, the common name is ignored
+	if err := certs[0].VerifyHostname(fqdn); err != nil {
+		return fmt.Errorf("the certificate is issued to %s, not %s", strings.Join(certs[0].DNSNames, ", "), fqdn)
+	}
+	return nil
+}
+
+// Lookup checks that the fqdn resolves to the ip, and the ip back to the fqdn
+func Lookup(ctx context.Context, target Target) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	r := resolver(target.DNS)
+
+	addrs, err := r.LookupHost(ctx, target.FQDN)
+	if err != nil {
+		return fmt.Errorf("forward lookup: %w", err)
+	}
+	found := false
+	for _, addr := range addrs {
+		if addr == target.IP {
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s resolves to %s, not %s", target.FQDN, strings.Join(addrs, ", "), target.IP)
+	}
+
+	names, err := r.LookupAddr(ctx, target.IP)
+	if err != nil {
+		return fmt.Errorf("reverse lookup: %w", err)
+	}
+	for _, name := range names {
+		if strings.EqualFold(strings.TrimSuffix(name, "."), target.FQDN) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s resolves to %s, not %s", target.IP, strings.Join(names, ", "), target.FQDN)
+}
+
+// resolver asks the first dns server of the group
+func resolver(servers []string) *net.Resolver {
+	if len(servers) == 0 {
+		return net.DefaultResolver
+	}
+	server := net.JoinHostPort(servers[0], "53")
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
@@ -0,0 +1,151 @@
+// Package scheduling reimages hosts, groups and deployments at a later time, and keeps reimaging within the
+// maintenance windows of the groups.
+package scheduling
+
+import (
+	"fmt"
+	"time"
+	// the timezones are embedded, go-via may run in a container without them
+	_ "time/tzdata"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/robfig/cron/v3"
+)
+
+// the runs that are shown of a schedule or a maintenance window
+const upcomingRuns = 5
+
+// Location returns the timezone of a schedule, UTC when none is set
+func Location(timezone string) (*time.Location, error) {
+	if timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("unknown timezone %s", timezone)
+	}
+	return loc, nil
+}
+
+// Parse parses a standard cron expression in a timezone, e.g. "0 2 * * sat" or "@daily"
+func Parse(expr string, timezone string) (cron.Schedule, error) {
+	if _, err := Location(timezone); err != nil {
+		return nil, err
+	}
+	if timezone == "" {
+		timezone = "UTC"
+	}
+	sched, err := cron.ParseStandard("CRON_TZ=" + timezone + " " + expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cron expression %q: %w", expr, err)
+	}
+	return sched, nil
+}
+
+// Next returns the next run of a schedule after a time, in UTC so the runs compare in the database. A one-off
+// schedule runs at its time, even if it has passed, unless it ran since.
+func Next(item models.Schedule, after time.Time) (*time.Time, error) {
+	if item.Cron == "" {
+		if item.At == nil || (item.LastRunAt != nil && !item.LastRunAt.Before(*item.At)) {
+			return nil, nil
+		}
+		at := item.At.UTC()
+		return &at, nil
+	}
+	sched, err := Parse(item.Cron, item.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	next := sched.Next(after)
+	if next.IsZero() {
+		return nil, nil
+	}
+	next = next.UTC()
+	return &next, nil
+}
+
+// Upcoming sets the next runs of a schedule
+func Upcoming(item *models.Schedule) {
+	item.Upcoming = []time.Time{}
+	if !item.Enabled || item.NextRunAt == nil {
+		return
+	}
+	loc, err := Location(item.Timezone)
+	if err != nil {
+		return
+	}
+	item.Upcoming = append(item.Upcoming, item.NextRunAt.In(loc))
+	if item.Cron == "" {
+		return
+	}
+	sched, err := Parse(item.Cron, item.Timezone)
+	if err != nil {
+		return
+	}
+	t := item.NextRunAt.In(loc)
+	for len(item.Upcoming) < upcomingRuns {
+		if t = sched.Next(t); t.IsZero() {
+			return
+		}
+		item.Upcoming = append(item.Upcoming, t)
+	}
+}
+
+// WindowOpen reports if a maintenance window is open at a time
+func WindowOpen(window models.MaintenanceWindow, now time.Time) (bool, error) {
+	sched, err := Parse(window.Cron, window.Timezone)
+	if err != nil {
+		return false, err
+	}
+	// the window is open if it opened at most its duration ago
+	duration := time.Duration(window.Duration) * time.Minute
+	start := sched.Next(now.Add(-duration - time.Second))
+	return !start.IsZero() && !start.After(now), nil
+}
+
+// WindowUpcoming sets if a maintenance window is open, and the next times it opens
+func WindowUpcoming(window *models.MaintenanceWindow) {
+	window.Upcoming = []time.Time{}
+	now := time.Now()
+	window.Open, _ = WindowOpen(*window, now)
+	loc, err := Location(window.Timezone)
+	if err != nil {
+		return
+	}
+	sched, err := Parse(window.Cron, window.Timezone)
+	if err != nil {
+		return
+	}
+	t := now.In(loc)
+	for len(window.Upcoming) < upcomingRuns {
+		if t = sched.Next(t); t.IsZero() {
+			return
+		}
+		window.Upcoming = append(window.Upcoming, t)
+	}
+}
+
+// MaintenanceOpen reports if the hosts of a group may be reimaged at a time. They can if one of the windows
+// of the group, or of all groups, is open, or if there are no such windows.
+func MaintenanceOpen(groupID models.NullInt32, now time.Time) (bool, error) {
+	var windows []models.MaintenanceWindow
+	query := db.DB.Where("group_id IS NULL")
+	if groupID.Valid {
+		query = db.DB.Where("group_id IS NULL OR group_id = ?", groupID.Int32)
+	}
+	if res := query.Find(&windows); res.Error != nil {
+		return false, res.Error
+	}
+	if len(windows) == 0 {
+		return true, nil
+	}
+
+	for _, window := range windows {
+		// a window that can't be parsed is never open
+		if open, err := WindowOpen(window, now); err == nil && open {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,166 @@
+package scheduling
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/deployments"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/sirupsen/logrus"
+)
+
+// Scheduler runs the schedules that are due
+type Scheduler struct {
+	interval time.Duration
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewScheduler creates a Scheduler that looks for due schedules every interval
+func NewScheduler(interval time.Duration) *Scheduler {
+	return &Scheduler{
+		interval: interval,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (s *Scheduler) Name() string {
+	return "scheduler"
+}
+
+func (s *Scheduler) Listen() error {
+	return nil
+}
+
+func (s *Scheduler) Serve(ctx context.Context) error {
+	defer close(s.stopped)
+	t := time.NewTicker(s.interval)
+	defer t.Stop()
+	for {
+		s.Step(time.Now())
+		select {
+		case <-t.C:
+		case <-s.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	close(s.done)
+	select {
+	case <-s.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the scheduler did not stop: %w", ctx.Err())
+	}
+}
+
+// Step runs the schedules that are due at a time. A run that was missed while go-via was down is run once.
+func (s *Scheduler) Step(now time.Time) {
+	now = now.UTC()
+	var items []models.Schedule
+	if res := db.DB.Where("enabled = ? AND next_run_at <= ?", true, now).Order("next_run_at").Find(&items); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("scheduler")
+		return
+	}
+
+	for _, item := range items {
+		due := *item.NextRunAt
+		item.LastRunAt = &now
+		next, err := Next(item, now)
+		if err != nil {
+			next = nil
+		}
+
+		// claim the run, another instance of go-via may have run it already
+		res := db.DB.Model(&models.Schedule{}).Where("id = ? AND next_run_at = ?", item.ID, due).Update("next_run_at", next)
+		if res.Error != nil || res.RowsAffected == 0 {
+			continue
+		}
+
+		result, err := s.run(item)
+		fields := logrus.Fields{
+			"id":   item.ID,
+			"name": item.Name,
+			"due":  due,
+		}
+		if err != nil {
+			result = err.Error()
+			fields["err"] = err
+			logrus.WithFields(fields).Warn("scheduler")
+		} else {
+			fields["result"] = result
+			logrus.WithFields(fields).Info("scheduler")
+		}
+
+		db.DB.Model(&models.Schedule{}).Where("id = ?", item.ID).Updates(map[string]interface{}{
+			"last_run_at": now,
+			"last_result": result,
+		})
+	}
+}
+
+// run queues the hosts of a schedule for reimaging
+func (s *Scheduler) run(item models.Schedule) (string, error) {
+	actor := item.Actor
+	if actor == "" {
+		actor = "schedule"
+	}
+	message := fmt.Sprintf("scheduled by %s", item.Name)
+
+	switch {
+	case item.HostID.Valid:
+		if _, err := provisioning.Transition(int(item.HostID.Int32), provisioning.Queued, "schedule", actor, message); err != nil {
+			return "", err
+		}
+		return "the host was queued for reimaging", nil
+
+	case item.GroupID.Valid:
+		var hosts []models.Host
+		if res := db.DB.Where("group_id = ? AND (state IS NULL OR state <> ?)", item.GroupID.Int32, provisioning.Decommissioned).Order("id").Find(&hosts); res.Error != nil {
+			return "", res.Error
+		}
+		queued := 0
+		for _, host := range hosts {
+			if _, err := provisioning.Transition(host.ID, provisioning.Queued, "schedule", actor, message); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"id":   item.ID,
+					"host": host.ID,
+					"err":  err,
+				}).Warn("scheduler")
+				continue
+			}
+			queued++
+		}
+		if queued == 0 && len(hosts) > 0 {
+			return "", fmt.Errorf("none of the %d hosts could be queued for reimaging", len(hosts))
+		}
+		return fmt.Sprintf("%d of %d hosts were queued for reimaging", queued, len(hosts)), nil
+
+	case item.DeploymentID.Valid:
+		// a new deployment of the same hosts, with the same limits
+		var deployment models.Deployment
+		if res := db.DB.First(&deployment, item.DeploymentID.Int32); res.Error != nil {
+			return "", fmt.Errorf("deployment %d not found", item.DeploymentID.Int32)
+		}
+		hosts, err := deployments.Hosts(deployment.DeploymentForm)
+		if err != nil {
+			return "", err
+		}
+		created, err := deployments.Create(deployment.DeploymentForm, hosts, actor)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("deployment %d was created", created.ID), nil
+	}
+	return "", fmt.Errorf("the schedule has nothing to reimage")
+}
@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"strings"
+)
+
+// SHA-512 crypt as specified in https://www.akkadia.org/drepper/SHA-crypt.txt, this is the format the
+// ESXi installer accepts with rootpw --iscrypted
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+const cryptRounds = 5000
+
+// HashPassword returns the SHA-512 crypt hash of a password with a random salt
+func HashPassword(password string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err.Error())
+	}
+	salt := make([]byte, len(b))
+	for i, v := range b {
+		salt[i] = cryptAlphabet[int(v)%len(cryptAlphabet)]
+	}
+	return sha512Crypt([]byte(password), salt)
+}
+
+// HashEncrypted returns the SHA-512 crypt hash of an encrypted password, without exposing the password
+func HashEncrypted(encryptedString string, keyString string) (string, error) {
+	password, err := TryDecrypt(encryptedString, keyString)
+	if err != nil {
+		return "", err
+	}
+	return HashPassword(password), nil
+}
+
+// IsCrypted reports if s looks like a crypt hash rather than a password
+func IsCrypted(s string) bool {
+	return strings.HasPrefix(s, "$6$") || strings.HasPrefix(s, "$5$") || strings.HasPrefix(s, "$1$")
+}
+
+func sha512Crypt(password []byte, salt []byte) string {
+	if len(salt) > 16 {
+		salt = salt[:16]
+	}
+
+	b := sha512.New()
+	b.Write(password)
+	b.Write(salt)
+	b.Write(password)
+	sumB := b.Sum(nil)
+
+	a := sha512.New()
+	a.Write(password)
+	a.Write(salt)
+	for i := len(password); i > 0; i -= 64 {
+		a.Write(sumB[:min(i, 64)])
+	}
+	for i := len(password); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			a.Write(sumB)
+		} else {
+			a.Write(password)
+		}
+	}
+	sumA := a.Sum(nil)
+
+	dp := sha512.New()
+	for range password {
+		dp.Write(password)
+	}
+	p := repeatDigest(dp.Sum(nil), len(password))
+
+	ds := sha512.New()
+	for i := 0; i < 16+int(sumA[0]); i++ {
+		ds.Write(salt)
+	}
+	s := repeatDigest(ds.Sum(nil), len(salt))
+
+	sum := sumA
+	for i := 0; i < cryptRounds; i++ {
+		c := sha512.New()
+		if i&1 != 0 {
+			c.Write(p)
+		} else {
+			c.Write(sum)
+		}
+		if i%3 != 0 {
+			c.Write(s)
+		}
+		if i%7 != 0 {
+			c.Write(p)
+		}
+		if i&1 != 0 {
+			c.Write(sum)
+		} else {
+			c.Write(p)
+		}
+		sum = c.Sum(nil)
+	}
+
+	// the bytes of the digest are encoded in this order
+	order := [][3]int{
+		{0, 21, 42}, {22, 43, 1}, {44, 2, 23}, {3, 24, 45}, {25, 46, 4}, {47, 5, 26}, {6, 27, 48},
+		{28, 49, 7}, {50, 8, 29}, {9, 30, 51}, {31, 52, 10}, {53, 11, 32}, {12, 33, 54}, {34, 55, 13},
+		{56, 14, 35}, {15, 36, 57}, {37, 58, 16}, {59, 17, 38}, {18, 39, 60}, {40, 61, 19}, {62, 20, 41},
+	}
+	var out strings.Builder
+	out.WriteString("$6$")
+	out.Write(salt)
+	out.WriteString("$")
+	for _, o := range order {
+		cryptEncode(&out, uint(sum[o[0]])<<16|uint(sum[o[1]])<<8|uint(sum[o[2]]), 4)
+	}
+	cryptEncode(&out, uint(sum[63]), 2)
+
+	return out.String()
+}
+
+func repeatDigest(sum []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, sum[:min(n-len(out), len(sum))]...)
+	}
+	return out
+}
+
+func cryptEncode(out *strings.Builder, w uint, n int) {
+	for ; n > 0; n-- {
+		out.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,46 @@
+package secrets
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// the vectors of https://www.akkadia.org/drepper/SHA-crypt.txt that use the default of 5000 rounds
+func TestSHA512Crypt(t *testing.T) {
+	tests := []struct {
+		password string
+		salt     string
+		want     string
+	}{
+		{"Hello world!", "saltstring", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		// the salt is cut off after 16 characters
+		{"This is just a test", "toolongsaltstring", "$6$toolongsaltstrin$lQ8jolhgVRVhY4b5pZKaysCLi0QBxGoNeKQzQ3glMhwllF7oGDZxUhx1yxdYcz/e1JSbq3y6JMxxl8audkUEm0"},
+	}
+	for _, tt := range tests {
+		if got := sha512Crypt([]byte(tt.password), []byte(tt.salt)); got != tt.want {
+			t.Errorf("sha512Crypt(%q, %q) = %s, want %s", tt.password, tt.salt, got, tt.want)
+		}
+	}
+}
+
+func TestHashEncrypted(t *testing.T) {
+	key := hex.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	other := hex.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+
+	hash, err := HashEncrypted(Encrypt("VMware1!", key), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt := strings.Split(hash, "$")[2]
+	if want := sha512Crypt([]byte("VMware1!"), []byte(salt)); hash != want {
+		t.Errorf("HashEncrypted = %s, want %s", hash, want)
+	}
+
+	// a password encrypted with another key or not at all is an error, not a panic
+	for _, enc := range []string{Encrypt("VMware1!", other), "VMware1!", "deadbeef"} {
+		if _, err := HashEncrypted(enc, key); err == nil {
+			t.Errorf("HashEncrypted(%q) did not fail", enc)
+		}
+	}
+}
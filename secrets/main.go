@@ -100,24 +100,39 @@ func Encrypt(stringToEncrypt string, keyString string) (encryptedString string)
 }
 
 func Decrypt(encryptedString string, keyString string) (decryptedString string) {
+	plaintext, err := TryDecrypt(encryptedString, keyString)
+	if err != nil {
+		panic(err.Error())
+	}
+	return plaintext
+}
+
+// TryDecrypt decrypts like Decrypt, but returns an error if the string wasn't encrypted with the key
+func TryDecrypt(encryptedString string, keyString string) (string, error) {
 
 	key, _ := hex.DecodeString(keyString)
-	enc, _ := hex.DecodeString(encryptedString)
+	enc, err := hex.DecodeString(encryptedString)
+	if err != nil {
+		return "", fmt.Errorf("not an encrypted string: %w", err)
+	}
 
 	//Create a new Cipher Block from the key
 	block, err := aes.NewCipher(key)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Create a new GCM
 	aesGCM, err := cipher.NewGCM(block)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
 	//Get the nonce size
 	nonceSize := aesGCM.NonceSize()
+	if len(enc) < nonceSize {
+		return "", fmt.Errorf("not an encrypted string")
+	}
 
 	//Extract the nonce from the encrypted data
 	nonce, ciphertext := enc[:nonceSize], enc[nonceSize:]
@@ -125,8 +140,8 @@ func Decrypt(encryptedString string, keyString string) (decryptedString string)
 	//Decrypt the data
 	plaintext, err := aesGCM.Open(nil, nonce, ciphertext, nil)
 	if err != nil {
-		panic(err.Error())
+		return "", err
 	}
 
-	return string(plaintext)
+	return string(plaintext), nil
 }
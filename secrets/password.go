@@ -0,0 +1,29 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"math/big"
+)
+
+// characters that need no quoting in a kickstart or shell
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789!#%+-.:=@^_~"
+
+const passwordLength = 20
+
+// GeneratePassword returns a new random password that passes valid, encrypted and as SHA-512 crypt hash.
+// The password itself never leaves this package.
+func GeneratePassword(keyString string, valid func(string) error) (encrypted string, hash string) {
+	for {
+		b := make([]byte, passwordLength)
+		for i := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordAlphabet))))
+			if err != nil {
+				panic(err.Error())
+			}
+			b[i] = passwordAlphabet[n.Int64()]
+		}
+		if valid(string(b)) == nil {
+			return Encrypt(string(b), keyString), HashPassword(string(b))
+		}
+	}
+}
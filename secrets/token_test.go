@@ -0,0 +1,78 @@
+package secrets
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	key := hex.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	other := hex.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+
+	valid := Token{Purpose: "ks", HostID: 1, Nonce: NewNonce(), Expires: time.Now().Add(time.Hour)}
+	token := SignToken(valid, key)
+	payload, sig, _ := strings.Cut(token, ".")
+
+	// resign replaces the payload of the token but keeps its signature
+	resign := func(t Token) string {
+		p, _, _ := strings.Cut(SignToken(t, key), ".")
+		return p + "." + sig
+	}
+	tampered := valid
+	tampered.HostID = 2
+	reused := valid
+	reused.Nonce = NewNonce()
+	extended := valid
+	extended.Expires = valid.Expires.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		token   string
+		purpose string
+		key     string
+		wantErr string
+	}{
+		{"valid", token, "ks", key, ""},
+		{"other key", token, "ks", other, "invalid token signature"},
+		{"other host", resign(tampered), "ks", key, "invalid token signature"},
+		{"other nonce", resign(reused), "ks", key, "invalid token signature"},
+		{"later expiry", resign(extended), "ks", key, "invalid token signature"},
+		{"flipped signature", payload + "." + base64.RawURLEncoding.EncodeToString(make([]byte, 32)), "ks", key, "invalid token signature"},
+		{"no signature", payload, "ks", key, "malformed token"},
+		{"garbage signature", payload + ".!!", "ks", key, "malformed token signature"},
+		{"wrong purpose", token, "report", key, "token is not valid for report"},
+		{"expired", SignToken(Token{Purpose: "ks", HostID: 1, Nonce: valid.Nonce, Expires: time.Now().Add(-time.Minute)}, key), "ks", key, "token expired"},
+	}
+	for _, tt := range tests {
+		got, err := VerifyToken(tt.token, tt.purpose, tt.key)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: VerifyToken failed: %v", tt.name, err)
+		case tt.wantErr == "" && (got.Purpose != valid.Purpose || got.HostID != valid.HostID || got.Nonce != valid.Nonce || got.Expires.Unix() != valid.Expires.Unix()):
+			t.Errorf("%s: VerifyToken = %+v, want %+v", tt.name, got, valid)
+		case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%s: VerifyToken error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// every signed url carries its own nonce, so a host can only fetch the url it was last issued
+func TestNewNonce(t *testing.T) {
+	seen := map[string]bool{}
+	for i := 0; i < 100; i++ {
+		n := NewNonce()
+		if len(n) != 32 || seen[n] {
+			t.Fatalf("NewNonce = %q, want 32 unique hex characters", n)
+		}
+		seen[n] = true
+	}
+
+	a := SignToken(Token{Purpose: "ks", HostID: 1, Nonce: NewNonce(), Expires: time.Unix(0, 0)}, "00")
+	b := SignToken(Token{Purpose: "ks", HostID: 1, Nonce: NewNonce(), Expires: time.Unix(0, 0)}, "00")
+	if a == b {
+		t.Error("tokens with different nonces are equal")
+	}
+}
@@ -0,0 +1,166 @@
+package syslogd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Message is a parsed syslog message
+type Message struct {
+	Facility int
+	Severity int
+	// the time the sender put on the message, zero if it had none
+	Timestamp time.Time
+	Hostname  string
+	App       string
+	ProcID    string
+	Text      string
+}
+
+// Parse parses a RFC 5424 or RFC 3164 message. Senders take liberties with RFC 3164, whatever can't be
+// parsed ends up in the text.
+func Parse(b []byte) (Message, error) {
+	s := strings.TrimRight(string(b), "\r\n\x00")
+
+	var m Message
+	if !strings.HasPrefix(s, "<") {
+		return m, fmt.Errorf("the message has no priority")
+	}
+	end := strings.IndexByte(s, '>')
+	if end < 2 || end > 4 {
+		return m, fmt.Errorf("the message has no priority")
+	}
+	pri, err := strconv.Atoi(s[1:end])
+	if err != nil || pri > 191 {
+		return m, fmt.Errorf("invalid priority %q", s[1:end])
+	}
+	m.Facility, m.Severity = pri/8, pri%8
+	s = s[end+1:]
+
+	// RFC 5424 has a version after the priority
+	if strings.HasPrefix(s, "1 ") {
+		return parse5424(m, s[2:]), nil
+	}
+	return parse3164(m, s), nil
+}
+
+func parse5424(m Message, s string) Message {
+	fields := make([]string, 0, 5)
+	for len(fields) < 5 {
+		i := strings.IndexByte(s, ' ')
+		if i < 0 {
+			fields = append(fields, s)
+			s = ""
+			break
+		}
+		fields = append(fields, s[:i])
+		s = s[i+1:]
+	}
+	for len(fields) < 5 {
+		fields = append(fields, "-")
+	}
+	if t, err := time.Parse(time.RFC3339Nano, fields[0]); err == nil {
+		m.Timestamp = t
+	}
+	m.Hostname = nilValue(fields[1])
+	m.App = nilValue(fields[2])
+	m.ProcID = nilValue(fields[3])
+
+	m.Text = strings.TrimPrefix(skipStructuredData(s), "\ufeff")
+	return m
+}
+
+// skipStructuredData returns what follows the structured data of a RFC 5424 message
+func skipStructuredData(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " ")
+	}
+	for strings.HasPrefix(s, "[") {
+		quoted, escaped := false, false
+		i := 1
+		for ; i < len(s); i++ {
+			c := s[i]
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				quoted = !quoted
+			case c == ']' && !quoted:
+				goto next
+			}
+		}
+		return ""
+	next:
+		s = s[i+1:]
+	}
+	return strings.TrimPrefix(s, " ")
+}
+
+func parse3164(m Message, s string) Message {
+	// Mmm dd hh:mm:ss, or a RFC 3339 timestamp which ESXi uses
+	if len(s) >= 16 && s[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, s[:15], time.Local); err == nil {
+			now := time.Now()
+			m.Timestamp = t.AddDate(now.Year(), 0, 0)
+			// messages from the end of last year
+			if m.Timestamp.After(now.Add(24 * time.Hour)) {
+				m.Timestamp = m.Timestamp.AddDate(-1, 0, 0)
+			}
+			s = s[16:]
+		}
+	}
+	if m.Timestamp.IsZero() {
+		if i := strings.IndexByte(s, ' '); i > 0 {
+			if t, err := time.Parse(time.RFC3339Nano, s[:i]); err == nil {
+				m.Timestamp = t
+				s = s[i+1:]
+			}
+		}
+	}
+	if m.Timestamp.IsZero() {
+		m.Text = s
+		return m
+	}
+
+	// HOSTNAME TAG[PID]: TEXT
+	if i := strings.IndexByte(s, ' '); i > 0 && !strings.HasSuffix(s[:i], ":") {
+		m.Hostname = s[:i]
+		s = s[i+1:]
+	}
+	if i := strings.Index(s, ": "); i > 0 && !strings.ContainsAny(s[:i], " ") {
+		tag := s[:i]
+		if j := strings.IndexByte(tag, '['); j > 0 && strings.HasSuffix(tag, "]") {
+			m.ProcID = tag[j+1 : len(tag)-1]
+			tag = tag[:j]
+		}
+		m.App = tag
+		s = s[i+2:]
+	}
+	m.Text = s
+	return m
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+// Level returns the log level of a severity, as the websocket names them
+func Level(severity int) string {
+	switch {
+	case severity <= 3:
+		return "error"
+	case severity == 4:
+		return "warning"
+	case severity == 7:
+		return "debug"
+	default:
+		return "info"
+	}
+}
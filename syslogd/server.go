@@ -0,0 +1,369 @@
+// Package syslogd receives the syslog messages of the installer and the installed hosts.
+package syslogd
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/sirupsen/logrus"
+)
+
+// messages longer than this are cut off
+const maxMessageSize = 64 << 10
+
+// Retention limits how many messages are kept
+type Retention struct {
+	// messages older than this are deleted, 0 keeps them forever
+	MaxAge time.Duration
+	// the newest messages kept per host, 0 keeps all of them
+	MaxPerHost int
+}
+
+// Server receives syslog messages over UDP and TCP on the same port, and stores them with the host that sent them
+type Server struct {
+	addr      string
+	retention Retention
+	// called for every stored message, e.g. to forward it to the websocket
+	onMessage func(models.HostLog)
+
+	udp net.PacketConn
+	tcp net.Listener
+
+	queue   chan models.HostLog
+	done    chan struct{}
+	wg      sync.WaitGroup
+	writer  sync.WaitGroup
+	closing sync.Once
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+}
+
+// NewServer creates a Server that listens on addr, e.g. ":514"
+func NewServer(addr string, retention Retention, onMessage func(models.HostLog)) *Server {
+	return &Server{
+		addr:      addr,
+		retention: retention,
+		onMessage: onMessage,
+		queue:     make(chan models.HostLog, 1024),
+		done:      make(chan struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+func (s *Server) Name() string {
+	return "syslog"
+}
+
+func (s *Server) Listen() error {
+	udp, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("syslog: %w", err)
+	}
+	tcp, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		udp.Close()
+		return fmt.Errorf("syslog: %w", err)
+	}
+	s.udp, s.tcp = udp, tcp
+	return nil
+}
+
+// Serve receives messages until Shutdown is called
+func (s *Server) Serve(ctx context.Context) error {
+	logrus.WithFields(logrus.Fields{
+		"addr": s.addr,
+	}).Info("Starting syslog server")
+
+	s.writer.Add(1)
+	go s.write()
+
+	s.wg.Add(2)
+	go s.serveUDP()
+	go s.serveTCP()
+
+	t := time.NewTicker(time.Hour)
+	defer t.Stop()
+	s.expire()
+	for {
+		select {
+		case <-t.C:
+			s.expire()
+		case <-s.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Shutdown stops receiving and stores the messages that were already received
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.closing.Do(func() {
+		close(s.done)
+		if s.udp != nil {
+			s.udp.Close()
+		}
+		if s.tcp != nil {
+			s.tcp.Close()
+		}
+		s.connsMu.Lock()
+		for c := range s.conns {
+			c.Close()
+		}
+		s.connsMu.Unlock()
+	})
+
+	stopped := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(s.queue)
+		s.writer.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the syslog server did not stop: %w", ctx.Err())
+	}
+}
+
+func (s *Server) serveUDP() {
+	defer s.wg.Done()
+	b := make([]byte, maxMessageSize)
+	for {
+		n, addr, err := s.udp.ReadFrom(b)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("syslog")
+			continue
+		}
+		s.receive(addr, b[:n])
+	}
+}
+
+func (s *Server) serveTCP() {
+	defer s.wg.Done()
+	for {
+		c, err := s.tcp.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"err": err,
+			}).Warn("syslog")
+			continue
+		}
+		s.connsMu.Lock()
+		s.conns[c] = struct{}{}
+		s.connsMu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer func() {
+				s.connsMu.Lock()
+				delete(s.conns, c)
+				s.connsMu.Unlock()
+				c.Close()
+			}()
+			s.serveConn(c)
+		}()
+	}
+}
+
+// serveConn reads the messages of a TCP connection, framed by octet counting (RFC 6587) or by newlines
+func (s *Server) serveConn(c net.Conn) {
+	r := bufio.NewReaderSize(c, maxMessageSize)
+	for {
+		first, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		var msg []byte
+		if first[0] >= '1' && first[0] <= '9' {
+			length, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, err := strconv.Atoi(length[:len(length)-1])
+			if err != nil || n > maxMessageSize {
+				logrus.WithFields(logrus.Fields{
+					"remote": c.RemoteAddr(),
+				}).Warn("syslog: invalid frame, closing the connection")
+				return
+			}
+			msg = make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+		} else {
+			line, err := r.ReadSlice('\n')
+			if errors.Is(err, bufio.ErrBufferFull) {
+				// keep the start of an over-long message, the rest up to the next newline is dropped
+				s.receive(c.RemoteAddr(), line)
+				for errors.Is(err, bufio.ErrBufferFull) {
+					_, err = r.ReadSlice('\n')
+				}
+				if err != nil {
+					return
+				}
+				continue
+			}
+			if err != nil {
+				if len(line) > 0 {
+					s.receive(c.RemoteAddr(), line)
+				}
+				return
+			}
+			msg = line
+		}
+		s.receive(c.RemoteAddr(), msg)
+	}
+}
+
+// receive parses a message and queues it to be stored
+func (s *Server) receive(addr net.Addr, b []byte) {
+	m, err := Parse(b)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"remote": addr.String(),
+			"err":    err,
+		}).Debug("syslog: ignored message")
+		return
+	}
+
+	source := addr.String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	entry := models.HostLog{
+		Source:    source,
+		Facility:  m.Facility,
+		Severity:  m.Severity,
+		Hostname:  m.Hostname,
+		App:       m.App,
+		Message:   m.Text,
+		Timestamp: m.Timestamp,
+	}
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now()
+	}
+
+	select {
+	case s.queue <- entry:
+	default:
+		logrus.WithFields(logrus.Fields{
+			"remote": source,
+		}).Debug("syslog: dropped message, the database can't keep up")
+	}
+}
+
+// write stores the queued messages in batches
+func (s *Server) write() {
+	defer s.writer.Done()
+	hosts := newHostCache()
+	batch := make([]models.HostLog, 0, 100)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if res := db.DB.Create(&batch); res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": res.Error,
+			}).Warn("syslog: could not store messages")
+		} else if s.onMessage != nil {
+			for _, entry := range batch {
+				s.onMessage(entry)
+			}
+		}
+		batch = batch[:0]
+	}
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case entry, ok := <-s.queue:
+			if !ok {
+				flush()
+				return
+			}
+			if id, ok := hosts.lookup(entry.Source); ok {
+				entry.HostID.Int32, entry.HostID.Valid = int32(id), true
+			}
+			batch = append(batch, entry)
+			if len(batch) == cap(batch) {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		}
+	}
+}
+
+// expire deletes the messages that are past the retention limits
+func (s *Server) expire() {
+	if s.retention.MaxAge > 0 {
+		res := db.DB.Where("created_at < ?", time.Now().Add(-s.retention.MaxAge)).Delete(&models.HostLog{})
+		if res.Error != nil {
+			logrus.WithFields(logrus.Fields{
+				"err": res.Error,
+			}).Warn("syslog: could not expire messages")
+		}
+	}
+
+	if s.retention.MaxPerHost > 0 {
+		var hostIDs []int
+		db.DB.Model(&models.HostLog{}).Distinct("host_id").Where("host_id IS NOT NULL").Pluck("host_id", &hostIDs)
+		for _, id := range hostIDs {
+			var oldest []int
+			db.DB.Model(&models.HostLog{}).Where("host_id = ?", id).Order("id desc").Offset(s.retention.MaxPerHost).Limit(1).Pluck("id", &oldest)
+			if len(oldest) == 0 {
+				continue
+			}
+			db.DB.Where("host_id = ? AND id <= ?", id, oldest[0]).Delete(&models.HostLog{})
+		}
+	}
+}
+
+// hostCache attributes messages to hosts by the address they came from, the address of a host is its lease
+type hostCache struct {
+	ids     map[string]int
+	expires time.Time
+}
+
+func newHostCache() *hostCache {
+	return &hostCache{}
+}
+
+func (c *hostCache) lookup(ip string) (int, bool) {
+	if time.Now().After(c.expires) {
+		var hosts []models.Host
+		db.DB.Select("id", "ip").Where("ip <> ''").Find(&hosts)
+		c.ids = make(map[string]int, len(hosts))
+		for _, h := range hosts {
+			c.ids[h.IP] = h.ID
+		}
+		c.expires = time.Now().Add(30 * time.Second)
+	}
+	id, ok := c.ids[ip]
+	return id, ok
+}
@@ -15,28 +15,31 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
+	"context"
 	"fmt"
 	"io"
 
 	"net"
 	"os"
 	"path"
-	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/maxiepax/go-via/api"
 	"github.com/maxiepax/go-via/config"
 	"github.com/maxiepax/go-via/db"
 	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/provisioning"
+	"github.com/maxiepax/go-via/scheduling"
 	"github.com/sirupsen/logrus"
 	"gorm.io/gorm/clause"
 
 	"github.com/pin/tftp"
 )
 
-func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
+func readHandler(conf *config.Config, key string) func(string, io.ReaderFrom) error {
 	return func(filename string, rf io.ReaderFrom) error {
 
 		// get the requesting ip-address and our source address
@@ -68,32 +71,31 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 			logrus.WithFields(logrus.Fields{
 				ip: "requesting mboot.efi",
 			}).Info("tftpd")
-			logrus.WithFields(logrus.Fields{
-				"id":           host.ID,
-				"percentage":   10,
-				"progresstext": "mboot.efi",
-			}).Info("progress")
-			filename, _ = mbootPath(image.Path)
-			host.Progress = 10
-			host.Progresstext = "mboot.efi"
-			db.DB.Save(&host)
+			// the installer is only booted within the maintenance windows of the group
+			if host.Reimage {
+				open, err := scheduling.MaintenanceOpen(host.GroupID, time.Now())
+				if err != nil {
+					return err
+				}
+				if !open {
+					logrus.WithFields(logrus.Fields{
+						ip: "the maintenance window of the group is closed",
+					}).Info("tftpd")
+					return fmt.Errorf("the maintenance window of the group is closed")
+				}
+			}
+			filename, _ = api.MbootPath(image.Path)
+			transition(host, provisioning.PXE, ip)
 		case "crypto64.efi":
 			logrus.WithFields(logrus.Fields{
 				ip: "requesting crypto64.efi",
 			}).Info("tftpd")
-			logrus.WithFields(logrus.Fields{
-				"id":           host.ID,
-				"percentage":   12,
-				"progresstext": "crypto64.efi",
-			}).Info("progress")
 			filename, _ = crypto64Path(image.Path)
-			host.Progress = 12
-			host.Progresstext = "crypto64.efi"
-			db.DB.Save(&host)
+			provisioning.SetProgress(host.ID, provisioning.PXE, 12, "crypto64.efi")
 		case "boot.cfg":
-			serveBootCfg(filename, host, image, rf, conf)
+			serveBootCfg(filename, host, image, rf, conf, key)
 		case "/boot.cfg":
-			serveBootCfg(filename, host, image, rf, conf)
+			serveBootCfg(filename, host, image, rf, conf, key)
 		default:
 			//if no case matches, chroot to /images
 			if _, err := os.Stat("images/" + filename); err == nil {
@@ -145,30 +147,61 @@ func readHandler(conf *config.Config) func(string, io.ReaderFrom) error {
 	}
 }
 
-func TFTPd(conf *config.Config) {
-	s := tftp.NewServer(readHandler(conf), nil)
-	s.SetTimeout(5 * time.Second)  // optional
-	err := s.ListenAndServe(":69") // blocks until s.Shutdown() is called
+// TFTPd serves the boot files of the images over TFTP
+type TFTPd struct {
+	addr    string
+	srv     *tftp.Server
+	conn    net.PacketConn
+	serving atomic.Bool
+}
+
+func NewTFTPd(conf *config.Config, key string) *TFTPd {
+	s := tftp.NewServer(readHandler(conf, key), nil)
+	s.SetTimeout(5 * time.Second) // optional
+	return &TFTPd{addr: ":69", srv: s}
+}
+
+func (t *TFTPd) Name() string {
+	return "tftpd"
+}
+
+func (t *TFTPd) Listen() error {
+	a, err := net.ResolveUDPAddr("udp", t.addr)
 	if err != nil {
-		logrus.WithFields(logrus.Fields{
-			"could not start tftp server:": err,
-		}).Info("tftpd")
-		os.Exit(1)
+		return err
 	}
+	conn, err := net.ListenUDP("udp", a)
+	if err != nil {
+		return fmt.Errorf("could not start tftp server: %w", err)
+	}
+	t.conn = conn
+	return nil
 }
 
-func mbootPath(imagePath string) (string, error) {
-	//check these paths if the file exists.
-	paths := []string{"/EFI/BOOT/BOOTX64.EFI", "/EFI/BOOT/BOOTAA64.EFI", "/MBOOT.EFI", "/mboot.efi", "/efi/boot/bootx64.efi", "/efi/boot/bootaa64.efi"}
+func (t *TFTPd) Serve(ctx context.Context) error {
+	t.serving.Store(true)
+	return t.srv.Serve(t.conn) // blocks until t.srv.Shutdown() is called
+}
 
-	for _, v := range paths {
-		if _, err := os.Stat(imagePath + v); err == nil {
-			return imagePath + v, nil
-		}
+// Shutdown stops accepting new requests and waits for in-flight transfers to complete
+func (t *TFTPd) Shutdown(ctx context.Context) error {
+	if t.conn == nil {
+		return nil
+	}
+	if !t.serving.Load() {
+		return t.conn.Close()
+	}
+	done := make(chan struct{})
+	go func() {
+		t.srv.Shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("in-flight tftp transfers did not finish: %w", ctx.Err())
 	}
-	//couldn't find the file
-	return "", fmt.Errorf("could not locate a mboot.efi")
-
 }
 
 func crypto64Path(imagePath string) (string, error) {
@@ -185,7 +218,7 @@ func crypto64Path(imagePath string) (string, error) {
 
 }
 
-func serveBootCfg(filename string, host models.Host, image models.Image, rf io.ReaderFrom, conf *config.Config) {
+func serveBootCfg(filename string, host models.Host, image models.Image, rf io.ReaderFrom, conf *config.Config, key string) {
 	//if the filename is boot.cfg, or /boot.cfg, we serve the boot cfg that belongs to that build. unfortunately, it seems boot.cfg or /boot.cfg varies in builds.
 
 	// get the requesting ip-address and our source address
@@ -199,76 +232,29 @@ func serveBootCfg(filename string, host models.Host, image models.Image, rf io.R
 	logrus.WithFields(logrus.Fields{
 		ip: "requesting boot.cfg",
 	}).Info("tftpd")
-	logrus.WithFields(logrus.Fields{
-		"id":           host.ID,
-		"percentage":   15,
-		"progresstext": "installation",
-	}).Info("progress")
-	host.Progress = 15
-	host.Progresstext = "installation"
-	db.DB.Save(&host)
-
-	bc, err := os.ReadFile(image.Path + "/BOOT.CFG")
+	transition(host, provisioning.BootCfg, ip)
+
+	scheme, port := bootScheme(conf)
+	urls, err := api.SignBootURLs(host, scheme, net.JoinHostPort(laddr.String(), strconv.Itoa(port)), key, time.Duration(conf.TokenTTL)*time.Second)
 	if err != nil {
-		logrus.Warn(err)
+		logrus.WithFields(logrus.Fields{
+			"err": err,
+		}).Warn("could not sign kickstart url")
 		return
 	}
-
-	// strip slashes from paths in file
-	re := regexp.MustCompile("/")
-	bc = re.ReplaceAllLiteral(bc, []byte(""))
-
-	// add kickstart path to kernelopt
-	re = regexp.MustCompile("kernelopt=.*")
-	o := re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" ks=https://"+laddr.String()+":"+strconv.Itoa(conf.Port)+"/ks.cfg")...))
-
-	// append the mac address of the hardware interface to ensure ks.cfg request comes from the right interface, along with ip, netmask and gateway.
-	nm := net.CIDRMask(host.Pool.Netmask, 32)
-	netmask := ipv4MaskString(nm)
-
-	re = regexp.MustCompile("kernelopt=.*")
-	o = re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(" netdevice="+host.Mac+" ip="+host.IP+" netmask="+netmask+" gateway="+host.Pool.Gateway)...))
-
-	// if vlan is configured for the group, append the vlan to kernelopts
-	if host.Group.Vlan != "" {
-		re = regexp.MustCompile("kernelopt=.*")
-		o = re.Find(bc)
-		bc = re.ReplaceAllLiteral(bc, append(o, []byte(" vlanid="+host.Group.Vlan)...))
+	// the modules are only fetched over http from the signed prefix when plain http is enabled
+	if conf.HTTPPort == 0 {
+		urls.Prefix = ""
 	}
 
-	// load options from the group
-	options := models.GroupOptions{}
-	err = json.Unmarshal(host.Group.Options, &options)
+	bc, err := api.RenderBootCfg(host, image, urls)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"err": err,
-		}).Warn("could not unmarshal group options")
+		}).Warn("could not render boot.cfg")
 		return
 	}
 
-	// if autopart is configured for the group, append autopart to kernelopt - https://kb.vmware.com/s/article/77009
-	/*
-		if options.AutoPart {
-			re = regexp.MustCompile("kernelopt=.*")
-			o = re.Find(bc)
-			bc = re.ReplaceAllLiteral(bc, append(o, []byte(" autoPartitionOnlyOnceAndSkipSsd=true")...))
-		}*/
-
-	// add allowLegacyCPU=true to kernelopt
-	if options.AllowLegacyCPU {
-		re = regexp.MustCompile("kernelopt=.*")
-		o = re.Find(bc)
-		bc = re.ReplaceAllLiteral(bc, append(o, []byte(" allowLegacyCPU=true")...))
-	}
-
-	// replace prefix with prefix=foldername
-	split := strings.Split(image.Path, "/")
-	re = regexp.MustCompile("prefix=")
-	o = re.Find(bc)
-	bc = re.ReplaceAllLiteral(bc, append(o, []byte(split[1])...))
-
 	// Make a buffer to read from
 	buff := bytes.NewBuffer(bc)
 
@@ -290,10 +276,24 @@ func serveBootCfg(filename string, host models.Host, image models.Image, rf io.R
 	//return nil
 }
 
-func ipv4MaskString(m []byte) string {
-	if len(m) != 4 {
-		panic("ipv4Mask: len must be 4 bytes")
+// bootScheme returns the scheme and port the installer uses to reach go-via.
+// the installer doesn't validate our certificate, so prefer plain http if it's enabled
+func bootScheme(conf *config.Config) (string, int) {
+	if conf.HTTPPort != 0 {
+		return "http", conf.HTTPPort
 	}
+	return "https", conf.Port
+}
 
-	return fmt.Sprintf("%d.%d.%d.%d", m[0], m[1], m[2], m[3])
+// transition moves a host that fetches a boot file forward, a stale fetch doesn't move it back
+func transition(host models.Host, state string, ip string) {
+	if host.ID == 0 {
+		return
+	}
+	if _, err := provisioning.Transition(host.ID, state, "tftp", ip, ""); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"id":  host.ID,
+			"err": err,
+		}).Warn("tftpd")
+	}
 }
@@ -0,0 +1,177 @@
+// Package vcenter adds installed ESXi hosts to a vCenter server.
+package vcenter
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/sirupsen/logrus"
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/object"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// Client is a session on a vCenter server
+type Client struct {
+	client *govmomi.Client
+}
+
+// HostSpec describes how a host is added to vCenter
+type HostSpec struct {
+	Datacenter string
+	Cluster    string
+	// the name the host gets in the inventory, vCenter connects to it with this name
+	Name     string
+	Username string
+	Password string
+	// SHA-1 thumbprint of the certificate of the host, vCenter refuses the host if it presents another one
+	Thumbprint string
+	// leave the host in maintenance mode, otherwise it is taken out of it
+	MaintenanceMode bool
+}
+
+// Connect logs in to a vCenter server. With a thumbprint the certificate of vCenter is pinned to it,
+// otherwise it has to be trusted by the system.
+func Connect(ctx context.Context, u *url.URL, thumbprint string) (*Client, error) {
+	sc := soap.NewClient(u, false)
+	if thumbprint != "" {
+		sc.SetThumbprint(u.Host, thumbprint)
+	}
+	vc, err := vim25.NewClient(ctx, sc)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to vCenter %s: %w", u.Host, err)
+	}
+	c := &govmomi.Client{Client: vc, SessionManager: session.NewManager(vc)}
+	if err := c.Login(ctx, u.User); err != nil {
+		return nil, fmt.Errorf("could not log in to vCenter %s: %w", u.Host, err)
+	}
+	return &Client{client: c}, nil
+}
+
+// Logout ends the session
+func (c *Client) Logout(ctx context.Context) error {
+	return c.client.Logout(ctx)
+}
+
+// AddHost adds a host to the cluster of the spec. A host that is already in the cluster, e.g. because it
+// was reimaged, is reconnected with the new credentials and thumbprint instead.
+func (c *Client) AddHost(ctx context.Context, spec HostSpec) error {
+	finder := find.NewFinder(c.client.Client)
+	dc, err := finder.Datacenter(ctx, spec.Datacenter)
+	if err != nil {
+		return err
+	}
+	finder.SetDatacenter(dc)
+	cluster, err := finder.ClusterComputeResource(ctx, spec.Cluster)
+	if err != nil {
+		return err
+	}
+
+	connect := types.HostConnectSpec{
+		HostName:      spec.Name,
+		UserName:      spec.Username,
+		Password:      spec.Password,
+		SslThumbprint: spec.Thumbprint,
+	}
+
+	host, err := c.findHost(ctx, dc, spec.Name)
+	if err != nil {
+		return err
+	}
+
+	if host == nil {
+		task, err := cluster.AddHost(ctx, connect, true, nil, nil)
+		if err != nil {
+			return err
+		}
+		info, err := task.WaitForResult(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("could not add %s to %s: %w", spec.Name, spec.Cluster, err)
+		}
+		host = object.NewHostSystem(c.client.Client, info.Result.(types.ManagedObjectReference))
+		logrus.WithFields(logrus.Fields{
+			"host":       spec.Name,
+			"datacenter": spec.Datacenter,
+			"cluster":    spec.Cluster,
+		}).Info("vcenter: added host")
+	} else {
+		var parent mo.HostSystem
+		if err := host.Properties(ctx, host.Reference(), []string{"parent"}, &parent); err != nil {
+			return err
+		}
+		if parent.Parent == nil || *parent.Parent != cluster.Reference() {
+			return fmt.Errorf("%s is already in the inventory outside of cluster %s", spec.Name, spec.Cluster)
+		}
+		task, err := host.Reconnect(ctx, &connect, nil)
+		if err != nil {
+			return err
+		}
+		if err := task.Wait(ctx); err != nil {
+			return fmt.Errorf("could not reconnect %s: %w", spec.Name, err)
+		}
+		logrus.WithFields(logrus.Fields{
+			"host":       spec.Name,
+			"datacenter": spec.Datacenter,
+			"cluster":    spec.Cluster,
+		}).Info("vcenter: reconnected host")
+	}
+
+	return setMaintenanceMode(ctx, host, spec.Name, spec.MaintenanceMode)
+}
+
+// findHost looks up a host by its name in the datacenter, it returns nil if there is none
+func (c *Client) findHost(ctx context.Context, dc *object.Datacenter, name string) (*object.HostSystem, error) {
+	m := view.NewManager(c.client.Client)
+	v, err := m.CreateContainerView(ctx, dc.Reference(), []string{"HostSystem"}, true)
+	if err != nil {
+		return nil, err
+	}
+	defer v.Destroy(ctx)
+
+	var hosts []mo.HostSystem
+	if err := v.Retrieve(ctx, []string{"HostSystem"}, []string{"name"}, &hosts); err != nil {
+		return nil, err
+	}
+	for _, h := range hosts {
+		if h.Name == name {
+			return object.NewHostSystem(c.client.Client, h.Reference()), nil
+		}
+	}
+	return nil, nil
+}
+
+func setMaintenanceMode(ctx context.Context, host *object.HostSystem, name string, enabled bool) error {
+	var h mo.HostSystem
+	if err := host.Properties(ctx, host.Reference(), []string{"runtime.inMaintenanceMode"}, &h); err != nil {
+		return err
+	}
+	if h.Runtime.InMaintenanceMode == enabled {
+		return nil
+	}
+
+	var task *object.Task
+	var err error
+	if enabled {
+		task, err = host.EnterMaintenanceMode(ctx, 0, false, nil)
+	} else {
+		task, err = host.ExitMaintenanceMode(ctx, 0)
+	}
+	if err != nil {
+		return err
+	}
+	if err := task.Wait(ctx); err != nil {
+		return fmt.Errorf("could not change the maintenance mode of %s: %w", name, err)
+	}
+	logrus.WithFields(logrus.Fields{
+		"host":        name,
+		"maintenance": enabled,
+	}).Info("vcenter: maintenance mode")
+	return nil
+}
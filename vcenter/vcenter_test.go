@@ -0,0 +1,145 @@
+package vcenter
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmware/govmomi/find"
+	"github.com/vmware/govmomi/simulator"
+	"github.com/vmware/govmomi/vim25/mo"
+	"github.com/vmware/govmomi/vim25/soap"
+)
+
+// newVCenter starts a simulated vCenter with datacenter DC0, cluster DC0_C0 and hosts DC0_H0 and DC0_C0_H0..2
+func newVCenter(t *testing.T) *simulator.Server {
+	t.Helper()
+	model := simulator.VPX()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	model.Service.TLS = new(tls.Config)
+	s := model.Service.NewServer()
+	t.Cleanup(func() {
+		s.Close()
+		model.Remove()
+	})
+	return s
+}
+
+func connect(t *testing.T, s *simulator.Server) *Client {
+	t.Helper()
+	c, err := Connect(context.Background(), s.URL, soap.ThumbprintSHA1(s.Certificate()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Logout(context.Background()) })
+	return c
+}
+
+func hostInfo(t *testing.T, c *Client, name string) mo.HostSystem {
+	t.Helper()
+	ctx := context.Background()
+	finder := find.NewFinder(c.client.Client)
+	dc, err := finder.Datacenter(ctx, "DC0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := c.findHost(ctx, dc, name)
+	if err != nil || host == nil {
+		t.Fatalf("%s is not in the inventory (%v)", name, err)
+	}
+	var h mo.HostSystem
+	if err := host.Properties(ctx, host.Reference(), []string{"parent", "runtime"}, &h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func clusterRef(t *testing.T, c *Client) string {
+	t.Helper()
+	finder := find.NewFinder(c.client.Client)
+	cluster, err := finder.ClusterComputeResource(context.Background(), "/DC0/host/DC0_C0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cluster.Reference().Value
+}
+
+func TestConnect(t *testing.T) {
+	s := newVCenter(t)
+	connect(t, s)
+
+	// the certificate of vCenter is pinned to the thumbprint
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := Connect(ctx, s.URL, "00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00:11:22:33"); err == nil {
+		t.Fatal("expected a wrong thumbprint to be refused")
+	}
+	// without a thumbprint the certificate has to be trusted by the system
+	if _, err := Connect(ctx, s.URL, ""); err == nil {
+		t.Fatal("expected an untrusted certificate to be refused")
+	}
+}
+
+func TestAddHost(t *testing.T) {
+	s := newVCenter(t)
+	c := connect(t, s)
+	ctx := context.Background()
+
+	spec := HostSpec{
+		Datacenter:      "DC0",
+		Cluster:         "DC0_C0",
+		Name:            "esx01.example.com",
+		Username:        "root",
+		Password:        "VMware1!",
+		Thumbprint:      "00:11:22:33:44:55:66:77:88:99:AA:BB:CC:DD:EE:FF:00:11:22:33",
+		MaintenanceMode: true,
+	}
+	if err := c.AddHost(ctx, spec); err != nil {
+		t.Fatal(err)
+	}
+	h := hostInfo(t, c, spec.Name)
+	if h.Parent == nil || h.Parent.Value != clusterRef(t, c) {
+		t.Errorf("esx01 was added to %v instead of the cluster", h.Parent)
+	}
+	if !h.Runtime.InMaintenanceMode {
+		t.Error("esx01 is not in maintenance mode")
+	}
+
+	// adding it again after a reimage reconnects the host
+	spec.MaintenanceMode = false
+	if err := c.AddHost(ctx, spec); err != nil {
+		t.Fatal(err)
+	}
+	if h := hostInfo(t, c, spec.Name); h.Runtime.InMaintenanceMode {
+		t.Error("esx01 is still in maintenance mode")
+	}
+}
+
+func TestAddHostOutsideCluster(t *testing.T) {
+	s := newVCenter(t)
+	c := connect(t, s)
+
+	// DC0_H0 is a standalone host of the datacenter
+	spec := HostSpec{Datacenter: "DC0", Cluster: "DC0_C0", Name: "DC0_H0", Username: "root", Password: "VMware1!"}
+	if err := c.AddHost(context.Background(), spec); err == nil || !strings.Contains(err.Error(), "outside of cluster") {
+		t.Fatalf("expected a host in another part of the inventory to be refused, got %v", err)
+	}
+}
+
+func TestAddHostUnknownCluster(t *testing.T) {
+	s := newVCenter(t)
+	c := connect(t, s)
+
+	spec := HostSpec{Datacenter: "DC0", Cluster: "nope", Name: "esx01.example.com", Username: "root", Password: "VMware1!"}
+	if err := c.AddHost(context.Background(), spec); err == nil {
+		t.Fatal("expected an unknown cluster to fail")
+	}
+	spec.Datacenter, spec.Cluster = "nope", "DC0_C0"
+	if err := c.AddHost(context.Background(), spec); err == nil {
+		t.Fatal("expected an unknown datacenter to fail")
+	}
+}
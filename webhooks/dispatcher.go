@@ -0,0 +1,226 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"github.com/sirupsen/logrus"
+)
+
+// MaxAttempts is the number of times a delivery is tried before it is failed
+var MaxAttempts = 10
+
+// the delay after the first failed attempt, it doubles with every attempt up to maxBackoff
+var (
+	baseBackoff = 30 * time.Second
+	maxBackoff  = time.Hour
+)
+
+// wakeup makes the dispatcher look for deliveries right away instead of at the next interval
+var wakeup = make(chan struct{}, 1)
+
+func wake() {
+	select {
+	case wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Sign returns the signature of a payload, sent in the X-Via-Signature header. Receivers compute the
+// HMAC-SHA256 of the timestamp header, a dot and the body with the secret of the webhook.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// backoff returns the delay before the next attempt after attempts failed ones
+func backoff(attempts int) time.Duration {
+	d := baseBackoff
+	for i := 1; i < attempts && d < maxBackoff; i++ {
+		d *= 2
+	}
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// Dispatcher posts the pending deliveries and retries the ones that failed
+type Dispatcher struct {
+	key      string
+	interval time.Duration
+	client   *http.Client
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+// NewDispatcher creates a Dispatcher that looks for due deliveries every interval, key decrypts the
+// secrets of the webhooks.
+func NewDispatcher(key string, interval time.Duration) *Dispatcher {
+	return &Dispatcher{
+		key:      key,
+		interval: interval,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (d *Dispatcher) Name() string {
+	return "webhooks"
+}
+
+func (d *Dispatcher) Listen() error {
+	return nil
+}
+
+func (d *Dispatcher) Serve(ctx context.Context) error {
+	defer close(d.stopped)
+	t := time.NewTicker(d.interval)
+	defer t.Stop()
+	for {
+		d.Dispatch(ctx)
+		select {
+		case <-t.C:
+		case <-wakeup:
+		case <-d.done:
+			return nil
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Shutdown waits for the running delivery to finish, the others stay pending until the next start
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	close(d.done)
+	select {
+	case <-d.stopped:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("the webhook dispatcher did not stop: %w", ctx.Err())
+	}
+}
+
+// Dispatch tries every delivery that is due
+func (d *Dispatcher) Dispatch(ctx context.Context) {
+	var due []models.WebhookDelivery
+	if res := db.DB.Where("status = ? AND next_attempt_at <= ?", Pending, time.Now()).Order("id").Limit(100).Find(&due); res.Error != nil {
+		logrus.WithFields(logrus.Fields{
+			"err": res.Error,
+		}).Warn("webhooks")
+		return
+	}
+
+	for _, delivery := range due {
+		select {
+		case <-d.done:
+			return
+		case <-ctx.Done():
+			return
+		default:
+		}
+		d.deliver(ctx, delivery)
+	}
+}
+
+func (d *Dispatcher) deliver(ctx context.Context, delivery models.WebhookDelivery) {
+	var secret string
+	if delivery.WebhookID.Valid {
+		var hook models.Webhook
+		if res := db.DB.First(&hook, delivery.WebhookID.Int32); res.Error != nil || !hook.Enabled {
+			db.DB.Model(&delivery).Updates(map[string]interface{}{"status": Failed, "error": "the webhook was deleted or disabled"})
+			return
+		}
+		if hook.Secret != "" {
+			var err error
+			if secret, err = secrets.TryDecrypt(hook.Secret, d.key); err != nil {
+				// retrying won't make the secret readable, and the payload isn't sent unsigned
+				db.DB.Model(&delivery).Updates(map[string]interface{}{"status": Failed, "error": "the secret of the webhook can't be decrypted"})
+				logrus.WithFields(logrus.Fields{
+					"id":  delivery.ID,
+					"url": delivery.URL,
+					"err": err,
+				}).Warn("webhooks: delivery failed")
+				return
+			}
+		}
+	}
+
+	now := time.Now()
+	attempt := delivery.Attempts + 1
+	status, err := d.post(ctx, delivery, secret)
+	updates := map[string]interface{}{
+		"attempts":        attempt,
+		"last_attempt_at": now,
+		"response_status": status,
+		"error":           "",
+	}
+	switch {
+	case err == nil:
+		updates["status"] = Delivered
+	case attempt >= MaxAttempts:
+		updates["status"] = Failed
+		updates["error"] = err.Error()
+	default:
+		updates["next_attempt_at"] = now.Add(backoff(attempt))
+		updates["error"] = err.Error()
+	}
+	db.DB.Model(&delivery).Updates(updates)
+
+	fields := logrus.Fields{
+		"id":      delivery.ID,
+		"event":   delivery.Event,
+		"url":     delivery.URL,
+		"attempt": attempt,
+	}
+	if err != nil {
+		fields["err"] = err
+		logrus.WithFields(fields).Warn("webhooks: delivery failed")
+		return
+	}
+	logrus.WithFields(fields).Debug("webhooks: delivered")
+}
+
+// post sends the payload of the delivery, only a 2xx response counts as delivered
+func (d *Dispatcher) post(ctx context.Context, delivery models.WebhookDelivery, secret string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-via")
+	req.Header.Set("X-Via-Event", delivery.Event)
+	req.Header.Set("X-Via-Event-Id", delivery.EventID)
+	req.Header.Set("X-Via-Delivery", strconv.Itoa(delivery.ID))
+	req.Header.Set("X-Via-Timestamp", timestamp)
+	if secret != "" {
+		req.Header.Set("X-Via-Signature", Sign(secret, timestamp, delivery.Payload))
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("the receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,199 @@
+// Package webhooks delivers the events of go-via to subscribers, signed and with retries.
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/maxiepax/go-via/db"
+	"github.com/maxiepax/go-via/models"
+	"github.com/maxiepax/go-via/secrets"
+	"gorm.io/gorm"
+)
+
+// SchemaVersion is the version of the event payload, it changes when fields are removed or change meaning
+const SchemaVersion = 1
+
+// the event types webhooks can subscribe to
+const (
+	HostStateChanged = "host.state_changed"
+	HostFailed       = "host.failed"
+	ImageAdded       = "image.added"
+	LeaseGranted     = "lease.granted"
+	// the completed or stalled host, sent to the callback url of its group
+	HostCallback = "host.callback"
+)
+
+// the status of a delivery
+const (
+	Pending   = "pending"
+	Delivered = "delivered"
+	Failed    = "failed"
+)
+
+// EventTypes are the events a webhook can subscribe to
+var EventTypes = []string{HostStateChanged, HostFailed, ImageAdded, LeaseGranted}
+
+// Event is the payload posted to webhooks
+type Event struct {
+	ID      string      `json:"id"`
+	Type    string      `json:"type"`
+	Version int         `json:"version"`
+	Time    time.Time   `json:"time"`
+	Data    interface{} `json:"data"`
+}
+
+// HostStateChange is the data of host.state_changed and host.failed
+type HostStateChange struct {
+	Host    models.Host `json:"host"`
+	From    string      `json:"from"`
+	To      string      `json:"to"`
+	Source  string      `json:"source"`
+	Actor   string      `json:"actor"`
+	Message string      `json:"message"`
+}
+
+// Lease is the data of lease.granted
+type Lease struct {
+	HostID   int       `json:"host_id"`
+	PoolID   int       `json:"pool_id"`
+	Mac      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname"`
+	Relay    string    `json:"relay"`
+	Expires  time.Time `json:"expires"`
+}
+
+// ValidateEvents checks the event filter of a webhook
+func ValidateEvents(events []string) error {
+	for _, e := range events {
+		if !contains(EventTypes, e) {
+			return fmt.Errorf("unknown event %s, use one of %v", e, EventTypes)
+		}
+	}
+	return nil
+}
+
+// Publish queues an event for every enabled webhook that subscribed to it. Pass the transaction that made
+// the change, so the event is only sent if the change is committed.
+func Publish(tx *gorm.DB, eventType string, data interface{}) error {
+	if tx == nil {
+		tx = db.DB
+	}
+
+	var hooks []models.Webhook
+	if res := tx.Where("enabled = ?", true).Find(&hooks); res.Error != nil {
+		return res.Error
+	}
+
+	event := Event{
+		ID:      secrets.NewNonce(),
+		Type:    eventType,
+		Version: SchemaVersion,
+		Time:    time.Now().UTC(),
+		Data:    data,
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	for _, hook := range hooks {
+		var events []string
+		if len(hook.Events) > 0 {
+			if err := json.Unmarshal(hook.Events, &events); err != nil {
+				return fmt.Errorf("webhook %d has an invalid event filter: %w", hook.ID, err)
+			}
+		}
+		if len(events) > 0 && !contains(events, eventType) {
+			continue
+		}
+
+		delivery := models.WebhookDelivery{
+			URL:           hook.URL,
+			EventID:       event.ID,
+			Event:         eventType,
+			Payload:       payload,
+			Status:        Pending,
+			NextAttemptAt: time.Now(),
+		}
+		delivery.WebhookID.Int32, delivery.WebhookID.Valid = int32(hook.ID), true
+		if res := tx.Create(&delivery); res.Error != nil {
+			return res.Error
+		}
+	}
+
+	wake()
+	return nil
+}
+
+// Callback queues a post of data to url, unsigned. It keeps the payload of the callback url of groups,
+// which predates the events.
+func Callback(tx *gorm.DB, url string, data interface{}) error {
+	if tx == nil {
+		tx = db.DB
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	delivery := models.WebhookDelivery{
+		URL:           url,
+		EventID:       secrets.NewNonce(),
+		Event:         HostCallback,
+		Payload:       payload,
+		Status:        Pending,
+		NextAttemptAt: time.Now(),
+	}
+	if res := tx.Create(&delivery); res.Error != nil {
+		return res.Error
+	}
+
+	wake()
+	return nil
+}
+
+// Replay queues a delivery again with the same event, to the current url of its webhook
+func Replay(id int) (models.WebhookDelivery, error) {
+	var original models.WebhookDelivery
+	if res := db.DB.First(&original, id); res.Error != nil {
+		return original, res.Error
+	}
+
+	replay := models.WebhookDelivery{
+		WebhookID:     original.WebhookID,
+		URL:           original.URL,
+		EventID:       original.EventID,
+		Event:         original.Event,
+		Payload:       original.Payload,
+		Status:        Pending,
+		NextAttemptAt: time.Now(),
+	}
+	replay.ReplayOf.Int32, replay.ReplayOf.Valid = int32(original.ID), true
+
+	if original.WebhookID.Valid {
+		var hook models.Webhook
+		if res := db.DB.First(&hook, original.WebhookID.Int32); res.Error != nil {
+			return replay, fmt.Errorf("the webhook of the delivery no longer exists: %w", res.Error)
+		}
+		replay.URL = hook.URL
+	}
+
+	if res := db.DB.Create(&replay); res.Error != nil {
+		return replay, res.Error
+	}
+
+	wake()
+	return replay, nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -44,14 +44,30 @@ func (hook *hook) Fire(entry *logrus.Entry) error {
 		return err
 	}
 
-	ls := hook.ls
+	hook.ls.Publish(json)
 
+	return nil
+}
+
+// Levels define on which log levels this hook would trigger
+func (hook *hook) Levels() []logrus.Level {
+	return []logrus.Level{
+		logrus.PanicLevel,
+		logrus.FatalLevel,
+		logrus.ErrorLevel,
+		logrus.WarnLevel,
+		logrus.InfoLevel,
+	}
+}
+
+// Publish sends a message to all subscribers and keeps it in the history
+func (ls *LogServer) Publish(msg []byte) {
 	ls.subscribersMu.Lock()
 	defer ls.subscribersMu.Unlock()
 
 	for s := range ls.subscribers {
 		select {
-		case s.msgs <- json:
+		case s.msgs <- msg:
 		default:
 			go s.closeSlow()
 		}
@@ -59,24 +75,11 @@ func (hook *hook) Fire(entry *logrus.Entry) error {
 
 	ls.historyMu.Lock()
 	if len(ls.history) < 50 {
-		ls.history = append(ls.history, json)
+		ls.history = append(ls.history, msg)
 	} else {
-		ls.history = append(ls.history[1:], json)
+		ls.history = append(ls.history[1:], msg)
 	}
 	ls.historyMu.Unlock()
-
-	return nil
-}
-
-// Levels define on which log levels this hook would trigger
-func (hook *hook) Levels() []logrus.Level {
-	return []logrus.Level{
-		logrus.PanicLevel,
-		logrus.FatalLevel,
-		logrus.ErrorLevel,
-		logrus.WarnLevel,
-		logrus.InfoLevel,
-	}
 }
 
 func NewLogServer() *LogServer {